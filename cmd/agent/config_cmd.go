@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nexus/nexus-agent/internal/config"
+)
+
+// runConfigCommand handles "nexus-agent config <subcommand>"
+func runConfigCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: nexus-agent config validate [-config path | path]")
+		return 2
+	}
+
+	switch args[0] {
+	case "validate":
+		return runConfigValidate(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown config subcommand %q\n", args[0])
+		return 2
+	}
+}
+
+// runConfigValidate loads the config (including environment overrides) and
+// prints every problem found. It exits non-zero if any problem is found so it
+// can be used in CI.
+func runConfigValidate(args []string) int {
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	configPath := fs.String("config", defaultConfigPath(), "Path to configuration file (empty to validate environment only)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// The path may also be given as an argument
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		if flagSet(fs, "config") {
+			fmt.Fprintln(os.Stderr, "config validate: give the path either as -config or as an argument")
+			return 2
+		}
+		*configPath = fs.Arg(0)
+	default:
+		fmt.Fprintf(os.Stderr, "config validate: unexpected arguments %q\n", fs.Args()[1:])
+		return 2
+	}
+
+	problems, err := config.Check(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	name := *configPath
+	if name == "" {
+		name = "(environment)"
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("%s: OK\n", name)
+		return 0
+	}
+
+	for _, p := range problems {
+		fmt.Printf("%s:%s\n", name, formatProblem(p))
+	}
+	fmt.Printf("%d problem(s) found\n", len(problems))
+	return 1
+}
+
+// formatProblem renders a problem as "line: field: message"
+func formatProblem(p config.Problem) string {
+	s := ""
+	if p.Line > 0 {
+		s = fmt.Sprintf("%d:", p.Line)
+	}
+	s += " "
+	if p.Field != "" {
+		s += p.Field + ": "
+	}
+	return s + p.Message
+}
+
+// flagSet reports whether a flag was given on the command line
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -5,22 +5,47 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	stdsync "sync"
 	"syscall"
 	"time"
 
+	"github.com/nexus/nexus-agent/internal/auth"
 	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/crypto"
+	"github.com/nexus/nexus-agent/internal/destination"
 	"github.com/nexus/nexus-agent/internal/handler"
+	"github.com/nexus/nexus-agent/internal/health"
+	"github.com/nexus/nexus-agent/internal/logging"
+	"github.com/nexus/nexus-agent/internal/metrics"
 	"github.com/nexus/nexus-agent/internal/queue"
+	"github.com/nexus/nexus-agent/internal/ratelimit"
 	"github.com/nexus/nexus-agent/internal/sender"
+	"github.com/nexus/nexus-agent/internal/server"
 	"github.com/nexus/nexus-agent/internal/sync"
+	"github.com/nexus/nexus-agent/internal/tracing"
+	"github.com/nexus/nexus-agent/internal/transport"
+	"github.com/nexus/nexus-agent/internal/upstream"
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "queue" {
+		os.Exit(runQueueCommand(os.Args[2:]))
+	}
+
 	// Parse command line flags
-	configPath := flag.String("config", "config.yml", "Path to configuration file")
+	configPath := flag.String("config", defaultConfigPath(), "Path to configuration file (empty to configure from environment only)")
 	flag.Parse()
 
 	// Load configuration
@@ -29,47 +54,146 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	log.Printf("Nexus Agent starting...")
+	// Set up structured logging
+	logCloser, err := logging.Setup(cfg.Logging)
+	if err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	defer logCloser.Close()
+
+	slog.Info("Nexus Agent starting...")
+
+	// Set up tracing (propagation only unless tracing.enabled is set)
+	tracer := tracing.New(cfg.Tracing)
+	if cfg.Tracing.Enabled {
+		slog.Info("Tracing enabled", "endpoint", cfg.Tracing.Endpoint, "sample_ratio", cfg.Tracing.SampleRatio)
+	}
+
+	// Cancelled on the shutdown signal
+	sigCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+
+	// Set up the destinations: the nexus section and any extra ones, each
+	// with its own endpoint pool (probed in the background) and sender
+	var dests []*destination.Destination
+	for _, dc := range cfg.DestinationList() {
+		d := &destination.Destination{Name: dc.Name, Config: dc}
+		if dc.Type == config.DestinationNexus {
+			opts, err := upstreamOptions(cfg, dc)
+			if err != nil {
+				log.Fatalf("Failed to set up destination %s: %v", dc.Name, err)
+			}
+			d.Pool = upstream.New(dc.EndpointList(), opts)
+			d.Pool.Start(sigCtx)
+		}
+		d.Sender = sender.New(cfg, dc, d.Pool)
+		dests = append(dests, d)
+	}
+	destinations := destination.NewSet(cfg, dests)
+	primary := destinations.Default()
+	if len(cfg.Nexus.Endpoints) > 0 {
+		slog.Info("Using multiple Nexus endpoints", "endpoints", len(cfg.Nexus.Endpoints), "strategy", cfg.Nexus.Strategy)
+	}
+	if len(cfg.Destinations) > 0 {
+		slog.Info("Extra destinations configured", "destinations", len(cfg.Destinations))
+	}
+	if proxy := cfg.Nexus.Proxy.URL; proxy != "" && proxy != config.ProxyDirect {
+		if u, err := url.Parse(proxy); err == nil {
+			proxy = u.Redacted()
+		}
+		slog.Info("Connecting to Nexus through a proxy", "proxy", proxy, "no_proxy", cfg.Nexus.Proxy.NoProxy)
+	}
 
 	// Start auto-sync if configured
 	var syncer *sync.Syncer
 	if cfg.HasAutoSync() {
-		syncer = sync.NewSyncer(cfg)
-		syncer.Start()
+		syncer = sync.NewSyncer(cfg, primary.Pool)
+		syncer.Start(sigCtx)
 		defer syncer.Stop()
-		log.Printf("Auto-sync enabled (token configured)")
+		slog.Info("Auto-sync enabled (token configured)")
 	} else {
-		log.Printf("Using static config for %d app(s)", len(cfg.Apps))
+		slog.Info("Using static config", "apps", len(cfg.Apps))
 	}
 
-	// Initialize sender
-	s := sender.New(cfg)
-
-	// Initialize queue if buffering is enabled
-	var q *queue.Queue
+	// Initialize a queue per destination if buffering is enabled
+	var workers stdsync.WaitGroup
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
 	if cfg.Buffer.Enabled {
-		q, err = queue.New(cfg.Buffer.DBPath, cfg.Buffer.MaxSize)
-		if err != nil {
-			log.Fatalf("Failed to initialize queue: %v", err)
+		for _, d := range dests {
+			d.Queue, err = queue.Open(queue.Backend(cfg.Buffer.Backend), destinationBufferPath(cfg, d.Name), queueOptions(cfg, d.Name))
+			if err != nil {
+				fatal("Failed to initialize queue", "destination", d.Name, logging.Err(err))
+			}
 		}
-		defer q.Close()
-		log.Printf("Offline buffering enabled (max: %d messages)", cfg.Buffer.MaxSize)
+		slog.Info("Offline buffering enabled", "backend", cfg.Buffer.Backend, "max_size", cfg.Buffer.MaxSize, "max_bytes", cfg.Buffer.MaxBytes,
+			"overflow", cfg.Buffer.Overflow, "drain", cfg.Buffer.Drain, "workers", cfg.Buffer.Workers)
 
-		// Start queue processor
-		go processQueue(cfg, s, q)
+		// Start queue workers; they run until stopWorkers is called
+		for _, d := range dests {
+			registerQueueMetrics(d)
+			for i := 0; i < cfg.Buffer.Workers; i++ {
+				workers.Add(1)
+				go func(worker int) {
+					defer workers.Done()
+					processQueue(workerCtx, cfg, d, worker)
+				}(i)
+			}
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				sweepQueue(workerCtx, cfg, d)
+			}()
+		}
+	}
+
+	// Register health checks
+	checker := health.New(cfg.Health.CheckTimeout)
+	checker.Register("apps", health.AppsCheck(cfg))
+	checker.Register("nexus", health.NexusCheck(cfg, primary.Pool))
+	if syncer != nil {
+		checker.Register("sync", health.SyncCheck(syncer, cfg.Health.MaxSyncAge))
+	}
+	if primary.Queue != nil {
+		checker.Register("queue", health.QueueCheck(primary.Queue, queueLimits(cfg)))
+	}
+	for _, d := range dests {
+		if d != primary {
+			checker.Register("destination."+d.Name, health.DestinationCheck(d, queueLimits(cfg)))
+		}
+	}
+
+	// Initialize rate limiting
+	var limiter *ratelimit.Ingress
+	if cfg.Agent.RateLimit.Enabled {
+		limiter = ratelimit.NewIngress(cfg)
+		slog.Info("Rate limiting enabled",
+			"per_app_rate", cfg.Agent.RateLimit.PerApp.Rate,
+			"per_client_rate", cfg.Agent.RateLimit.PerClient.Rate)
 	}
 
 	// Initialize handler
-	h := handler.New(cfg, s, q)
+	h := handler.New(cfg, destinations, checker, limiter)
 
 	// Set up HTTP routes
 	mux := http.NewServeMux()
-	mux.HandleFunc("/send", h.HandleSend)
+	var send http.Handler = http.HandlerFunc(h.HandleSend)
+	if limiter != nil {
+		send = limiter.ClientMiddleware(send)
+	}
+	if cfg.Agent.Auth.Enabled {
+		send = auth.New(cfg.Agent.Auth).Middleware(send)
+		slog.Info("Local client authentication enabled", "clients", len(cfg.Agent.Auth.Clients))
+	}
+	mux.Handle("/send", send)
 	mux.HandleFunc("/health", h.HandleHealth)
+	mux.HandleFunc("/livez", h.HandleLive)
+	mux.HandleFunc("/readyz", h.HandleReady)
+	mux.HandleFunc("/metrics", metrics.Handler())
 
 	// Create server
 	addr := fmt.Sprintf("%s:%d", cfg.Agent.Bind, cfg.Agent.Port)
-	server := &http.Server{
+	httpServer := &http.Server{
 		Addr:         addr,
 		Handler:      loggingMiddleware(mux),
 		ReadTimeout:  10 * time.Second,
@@ -77,75 +201,427 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
-	// Start server in goroutine
-	go func() {
-		log.Printf("Agent listening on %s", addr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server error: %v", err)
+	// Enable TLS on the listener if configured
+	if cfg.Agent.TLS.Enabled {
+		tlsConfig, stopReload, err := server.NewTLSConfig(cfg.Agent.TLS, cfg.Agent.Bind)
+		if err != nil {
+			fatal("Failed to configure TLS", logging.Err(err))
 		}
-	}()
+		defer stopReload()
+		httpServer.TLSConfig = tlsConfig
+	}
+
+	// Start TCP listener
+	if !cfg.Agent.Socket.DisableTCP {
+		go func() {
+			var err error
+			if httpServer.TLSConfig != nil {
+				slog.Info("Agent listening (TLS)", "addr", addr, "min_version", cfg.Agent.TLS.MinVersion,
+					"client_certs", cfg.Agent.TLS.ClientCAFile != "")
+				err = httpServer.ListenAndServeTLS("", "")
+			} else {
+				slog.Info("Agent listening", "addr", addr)
+				err = httpServer.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				fatal("Server error", logging.Err(err))
+			}
+		}()
+	}
+
+	// Start Unix socket listener (plain HTTP; access is controlled by file permissions)
+	if cfg.Agent.Socket.Path != "" {
+		listener, err := server.ListenUnix(cfg.Agent.Socket)
+		if err != nil {
+			fatal("Failed to listen on Unix socket", logging.Err(err))
+		}
+		go func() {
+			slog.Info("Agent listening on Unix socket", "path", cfg.Agent.Socket.Path, "mode", cfg.Agent.Socket.Mode)
+			if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+				fatal("Unix socket server error", logging.Err(err))
+			}
+		}()
+	}
 
 	// Wait for shutdown signal
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	<-sigCtx.Done()
+	stopSignals()
 
-	log.Println("Shutting down agent...")
+	slog.Info("Shutting down agent...", "grace_period", cfg.Agent.ShutdownGracePeriod.String())
 
-	// Graceful shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// Graceful shutdown, bounded by the grace period
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Agent.ShutdownGracePeriod)
 	defer cancel()
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("Server shutdown error: %v", err)
+	// 1. Stop accepting requests, and 2. buffer the data of direct sends
+	// still in progress. Shutdown waits for those requests to finish.
+	serverDone := make(chan error, 1)
+	go func() { serverDone <- httpServer.Shutdown(ctx) }()
+	h.Drain()
+	if err := <-serverDone; err != nil {
+		slog.Error("Server shutdown error", logging.Err(err))
+	}
+
+	// 3. Stop the queue workers; messages they were sending are released
+	stopWorkers()
+	if !waitContext(ctx, &workers) {
+		slog.Warn("Queue workers did not stop within the grace period")
+	}
+
+	// 4. Flush the buffer to disk
+	for _, d := range dests {
+		if d.Queue == nil {
+			continue
+		}
+		if err := d.Queue.Close(); err != nil {
+			slog.Error("Failed to close queue", "destination", d.Name, logging.Err(err))
+		}
 	}
 
-	log.Println("Agent stopped")
+	tracer.Shutdown(ctx)
+
+	slog.Info("Agent stopped")
 }
 
-// processQueue continuously processes queued messages
-func processQueue(cfg *config.Config, s *sender.Sender, q *queue.Queue) {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+// waitContext waits for wg and reports whether it finished before ctx was
+// done
+func waitContext(ctx context.Context, wg *stdsync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
-	for range ticker.C {
-		for {
-			// Get next message from queue
-			msg, err := q.Dequeue()
-			if err != nil {
-				log.Printf("Queue dequeue error: %v", err)
-				break
+// processQueue is a queue worker for a destination: it leases batches of
+// buffered messages and sends them, waiting poll_interval whenever the
+// queue is empty or a send fails. It returns once ctx is cancelled.
+func processQueue(ctx context.Context, cfg *config.Config, d *destination.Destination, worker int) {
+	for ctx.Err() == nil {
+		leasedUntil := leaseEnd(cfg, time.Now())
+		batch, err := d.Queue.Lease(ctx, cfg.Buffer.BatchSize, cfg.Buffer.LeaseDuration)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Queue lease error", "destination", d.Name, "worker", worker, logging.Err(err))
+		}
+		if err != nil || len(batch) == 0 || !sendBatch(ctx, cfg, d.Sender, d.Queue, worker, batch, leasedUntil) {
+			select {
+			case <-ctx.Done():
+			case <-time.After(cfg.Buffer.PollInterval):
 			}
-			if msg == nil {
-				// Queue is empty
-				break
+		}
+	}
+}
+
+// sendBatch sends leased messages in order and reports whether all were
+// handled. On a retryable failure the rest of the batch is released
+// unsent, so per-app ordering is kept. When ctx is cancelled the message
+// being sent and the rest are released without counting an attempt.
+//
+// The leases of the unsent messages, held until leasedUntil, are renewed
+// before each send, so a lease only has to cover one send. If they can't
+// all be renewed the rest of the batch is given up: released while this
+// worker still holds it, or left alone once the leases have run out, since
+// another worker may hold the messages now.
+func sendBatch(ctx context.Context, cfg *config.Config, s *sender.Sender, q queue.Store, worker int, batch []*queue.Message, leasedUntil time.Time) bool {
+	// Bookkeeping for a message already sent must not be cut short
+	qctx := context.WithoutCancel(ctx)
+	for i, msg := range batch {
+		if ctx.Err() != nil {
+			releaseAll(qctx, q, batch[i:])
+			return false
+		}
+
+		renewedUntil := leaseEnd(cfg, time.Now())
+		extended, err := extendLeases(qctx, cfg, q, batch[i:])
+		switch {
+		case err != nil && time.Now().Before(leasedUntil):
+			// The current leases are still valid for now
+			slog.Error("Failed to extend queue leases", "destination", s.Destination(), "worker", worker, logging.Err(err))
+		case err == nil && extended == len(batch)-i:
+			leasedUntil = renewedUntil
+		default:
+			// Messages removed meanwhile (e.g. expired) aren't renewed
+			if time.Now().Before(leasedUntil) {
+				releaseAll(qctx, q, batch[i:])
 			}
+			slog.Warn("Queue leases could not be renewed before sending, giving up the rest of the batch",
+				"destination", s.Destination(), "worker", worker, "messages", len(batch)-i, "renewed", extended)
+			return false
+		}
+		logger := slog.With("destination", s.Destination(), "worker", worker, logging.AppKey(msg.AppKey), logging.MessageID(msg.ID), logging.Attempt(msg.Attempts+1))
 
-			// Try to send
-			result := s.Send(msg.AppKey, msg.Data)
-			if result.Success {
-				// Remove from queue on success
-				q.Remove(msg.ID)
-				log.Printf("Queued message %d sent successfully", msg.ID)
-			} else if !result.Retry || msg.Attempts >= cfg.Nexus.RetryAttempts*3 {
-				// Remove if not retryable or too many attempts
-				q.Remove(msg.ID)
-				log.Printf("Queued message %d failed permanently: %s", msg.ID, result.Message)
-			} else {
-				// Increment attempts and keep in queue
-				q.IncrementAttempts(msg.ID)
-				log.Printf("Queued message %d failed, will retry later: %s", msg.ID, result.Message)
-				break // Wait for next tick before trying more
+		// Continue the trace of the request that queued the message
+		ctx, span := tracing.Start(tracing.ContextWithRemoteParent(ctx, msg.TraceParent),
+			"queue.process", tracing.KindConsumer)
+		span.SetAttr(logging.KeyAppKey, msg.AppKey)
+		span.SetAttr(logging.KeyMessageID, msg.ID)
+		span.SetAttr(logging.KeyAttempt, msg.Attempts+1)
+		if msg.Sequence > 0 {
+			ctx = sender.WithSequence(ctx, msg.Sequence)
+		}
+
+		// Try to send
+		start := time.Now()
+		result := sendMessage(ctx, s, msg)
+		if !result.Success {
+			span.SetError(result.Message)
+		}
+		span.End()
+		if !result.Success && ctx.Err() != nil {
+			// Interrupted by shutdown, not a failed attempt
+			releaseAll(qctx, q, batch[i:])
+			return false
+		}
+		if result.Success {
+			// Remove from queue on success
+			q.Ack(qctx, msg.ID)
+			metrics.Dequeued.Inc(s.Destination(), msg.AppKey)
+			logger.Info("Queued message sent successfully", logging.Duration(time.Since(start)))
+		} else if !result.Retry || msg.Attempts >= s.RetryAttempts()*3 {
+			// Dead-letter if not retryable or too many attempts
+			reason := "max_attempts"
+			if !result.Retry {
+				reason = "permanent_error"
+			}
+			if err := q.DeadLetter(qctx, msg.ID, reason); err != nil {
+				logger.Error("Failed to dead-letter queued message", logging.Err(err))
+			}
+			metrics.DeadLettered.Inc(s.Destination(), msg.AppKey, reason)
+			logger.Error("Queued message failed permanently", "reason", result.Message)
+		} else {
+			// Count the attempt and hold the message back until the next poll
+			q.Nack(qctx, msg.ID, cfg.Buffer.PollInterval)
+			logger.Warn("Queued message failed, will retry later", "reason", result.Message)
+			releaseAll(qctx, q, batch[i+1:])
+			return false
+		}
+	}
+	return true
+}
+
+// extendLeases renews the leases of msgs and returns how many were renewed
+func extendLeases(ctx context.Context, cfg *config.Config, q queue.Store, msgs []*queue.Message) (int, error) {
+	ids := make([]int64, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	return q.Extend(ctx, ids, cfg.Buffer.LeaseDuration)
+}
+
+// leaseEnd returns the earliest a lease taken or renewed at now can run
+// out; stores keep lease times in whole seconds
+func leaseEnd(cfg *config.Config, now time.Time) time.Time {
+	return now.Add(cfg.Buffer.LeaseDuration).Truncate(time.Second)
+}
+
+// releaseAll returns leased messages to the queue unsent
+func releaseAll(ctx context.Context, q queue.Store, msgs []*queue.Message) {
+	for _, msg := range msgs {
+		q.Release(ctx, msg.ID)
+	}
+}
+
+// sweepQueue periodically removes expired messages and old dead letters
+// from a destination's buffer until ctx is cancelled
+func sweepQueue(ctx context.Context, cfg *config.Config, d *destination.Destination) {
+	ticker := time.NewTicker(cfg.Buffer.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := d.Queue.Expire(ctx); err != nil {
+				slog.Error("Queue expiry sweep failed", "destination", d.Name, logging.Err(err))
+			}
+			if _, err := queue.TrimDeadLetters(ctx, d.Queue, cfg.Buffer.MaxDeadLetters, cfg.Buffer.DeadLetterRetention); err != nil {
+				slog.Error("Dead letter sweep failed", "destination", d.Name, logging.Err(err))
 			}
 		}
 	}
 }
 
+// defaultConfigPath returns the config path from NEXUS_AGENT_CONFIG, or
+// config.yml when it is not set. NEXUS_AGENT_CONFIG="" runs without a file.
+func defaultConfigPath() string {
+	if path, ok := os.LookupEnv(config.EnvPrefix + "CONFIG"); ok {
+		return path
+	}
+	return "config.yml"
+}
+
+// queueLimits maps buffer and health config to the limits queue health is
+// measured against
+func queueLimits(cfg *config.Config) health.QueueLimits {
+	return health.QueueLimits{
+		MaxSize:           cfg.Buffer.MaxSize,
+		MaxBytes:          cfg.Buffer.MaxBytes,
+		DegradedWatermark: cfg.Health.QueueDegradedWatermark,
+		HighWatermark:     cfg.Health.QueueHighWatermark,
+	}
+}
+
+// bufferPath returns where the configured queue backend keeps its data
+func bufferPath(cfg *config.Config) string {
+	if cfg.Buffer.Backend == string(queue.BackendFile) {
+		return cfg.Buffer.Dir
+	}
+	return cfg.Buffer.DBPath
+}
+
+// destinationBufferPath returns where a destination's queue keeps its
+// data: the buffer path for the nexus section, and a sibling named after
+// the destination for the others (queue.db -> queue.staging.db)
+func destinationBufferPath(cfg *config.Config, name string) string {
+	path := bufferPath(cfg)
+	if name == config.DefaultDestination {
+		return path
+	}
+	if cfg.Buffer.Backend == string(queue.BackendFile) {
+		return path + "." + name
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + name + ext
+}
+
+// sendMessage sends a buffered message, as is when it was imported already
+// encrypted
+func sendMessage(ctx context.Context, s *sender.Sender, msg *queue.Message) sender.SendResult {
+	if !msg.Encrypted {
+		return s.Send(ctx, msg.AppKey, msg.Data)
+	}
+	payload, err := crypto.PayloadFromMap(msg.Data)
+	if err != nil {
+		return sender.SendResult{Success: false, Message: err.Error(), Retry: false}
+	}
+	return s.SendEncrypted(ctx, msg.AppKey, payload)
+}
+
+// upstreamOptions maps a destination's config to upstream pool options,
+// including the transport its sends, syncs and probes share
+func upstreamOptions(cfg *config.Config, dest config.DestinationConfig) (upstream.Options, error) {
+	rt, err := transport.New(cfg.Nexus.Proxy, dest.TLS)
+	if err != nil {
+		return upstream.Options{}, err
+	}
+	return upstream.Options{
+		Strategy:      upstream.Strategy(dest.Strategy),
+		Timeout:       dest.Timeout,
+		ProbeInterval: cfg.Health.NexusProbeInterval,
+		Transport:     rt,
+	}, nil
+}
+
+// queueOptions maps buffer config to queue options for destination dest
+func queueOptions(cfg *config.Config, dest string) queue.Options {
+	return queue.Options{
+		Destination: dest,
+
+		MaxSize:  cfg.Buffer.MaxSize,
+		MaxBytes: cfg.Buffer.MaxBytes,
+		Overflow: queue.OverflowPolicy(cfg.Buffer.Overflow),
+		Drain:    queue.DrainPolicy(cfg.Buffer.Drain),
+
+		PriorityAging: cfg.Buffer.PriorityAging,
+		Expiry:        queue.ExpiryPolicy(cfg.Buffer.Expiry),
+		Ordering:      queue.Ordering(cfg.Buffer.Ordering),
+		Synchronous:   cfg.Buffer.Synchronous,
+		BusyTimeout:   cfg.Buffer.BusyTimeout,
+		SegmentSize:   cfg.Buffer.SegmentSize,
+		Corruption:    queue.CorruptionPolicy(cfg.Buffer.Corruption),
+		AppQuota: func(appKey string) queue.Quota {
+			aq := cfg.AppQueue(appKey)
+			return queue.Quota{
+				MaxMessages: aq.MaxMessages,
+				MaxBytes:    aq.MaxBytes,
+				Overflow:    queue.OverflowPolicy(aq.Overflow),
+				Weight:      aq.Weight,
+				Ordering:    queue.Ordering(aq.Ordering),
+			}
+		},
+	}
+}
+
+// registerQueueMetrics exposes a destination's queue depth and age at
+// scrape time
+func registerQueueMetrics(d *destination.Destination) {
+	q := d.Queue
+	metrics.QueueDepth.Set(func() float64 {
+		size, err := q.Size(context.Background())
+		if err != nil {
+			return 0
+		}
+		return float64(size)
+	}, d.Name)
+	metrics.QueueBytes.Set(func() float64 {
+		bytes, err := q.Bytes(context.Background())
+		if err != nil {
+			return 0
+		}
+		return float64(bytes)
+	}, d.Name)
+	metrics.QueueOldestAge.Set(func() float64 {
+		oldest, ok, err := q.Oldest(context.Background())
+		if err != nil || !ok {
+			return 0
+		}
+		return time.Since(oldest).Seconds()
+	}, d.Name)
+}
+
+// metricsEndpoints are the paths reported as-is in request metrics; anything
+// else is reported as "other" to keep label cardinality bounded
+var metricsEndpoints = map[string]bool{
+	"/send":    true,
+	"/health":  true,
+	"/livez":   true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
 // loggingMiddleware logs all HTTP requests
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		next.ServeHTTP(w, r)
-		log.Printf("%s %s %s", r.Method, r.URL.Path, time.Since(start))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		endpoint := r.URL.Path
+		if !metricsEndpoints[endpoint] {
+			endpoint = "other"
+		}
+		metrics.HTTPRequests.Inc(endpoint, strconv.Itoa(rec.status))
+
+		slog.Info("HTTP request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"remote", r.RemoteAddr,
+			logging.Duration(time.Since(start)),
+		)
 	})
 }
+
+// statusRecorder captures the response status code for logging
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/crypto"
+	"github.com/nexus/nexus-agent/internal/queue"
+	"github.com/nexus/nexus-agent/internal/sync"
+	"github.com/nexus/nexus-agent/internal/upstream"
+)
+
+const queueUsage = `usage: nexus-agent queue export -o bundle [-config path] [-destination name] [-dead-letters] [-remove]
+       nexus-agent queue import [-config path] [-destination name] bundle`
+
+// runQueueCommand handles "nexus-agent queue <subcommand>"
+// Both subcommands open the buffer directly, so the agent using it should
+// be stopped first.
+func runQueueCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, queueUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "export":
+		return runQueueExport(args[1:])
+	case "import":
+		return runQueueImport(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown queue subcommand %q\n", args[0])
+		return 2
+	}
+}
+
+// runQueueExport writes a destination's buffered messages (or, with
+// -dead-letters, its dead letters) to a bundle, encrypting each with its
+// app's credentials for that destination. Messages of apps that aren't
+// configured (or synced) can't be encrypted and stay in the buffer.
+func runQueueExport(args []string) int {
+	fs := flag.NewFlagSet("queue export", flag.ContinueOnError)
+	configPath := fs.String("config", defaultConfigPath(), "Path to configuration file")
+	output := fs.String("o", "", "Bundle file to write")
+	dest := fs.String("destination", config.DefaultDestination, "Destination whose buffer is exported")
+	remove := fs.Bool("remove", false, "Remove exported messages from the buffer")
+	deadLetters := fs.Bool("dead-letters", false, "Export the dead letters instead of the buffered messages")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *output == "" {
+		fmt.Fprintln(os.Stderr, queueUsage)
+		return 2
+	}
+
+	cfg, q, err := openBuffer(*configPath, *dest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer q.Close()
+	ctx := context.Background()
+
+	// Synced apps' secrets are only known after a sync
+	if cfg.HasAutoSync() {
+		nexus := cfg.DestinationList()[0]
+		opts, err := upstreamOptions(cfg, nexus)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		pool := upstream.New(nexus.EndpointList(), opts)
+		if err := sync.NewSyncer(cfg, pool).Sync(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: sync failed, only static apps can be exported: %v\n", err)
+		}
+	}
+
+	var msgs []queue.BundleMessage
+	var ids []int64
+	skipped := make(map[string]int)
+	add := func(msg *queue.Message) error {
+		bm, ok, err := bundleMessage(cfg, *dest, msg)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			skipped[msg.AppKey]++
+			return nil
+		}
+		msgs = append(msgs, bm)
+		ids = append(ids, msg.ID)
+		return nil
+	}
+	if *deadLetters {
+		err = q.DeadLetters(ctx, func(dl *queue.DeadLetter) error { return add(&dl.Message) })
+	} else {
+		err = q.Scan(ctx, add)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	source, _ := os.Hostname()
+	header := queue.BundleHeader{CreatedAt: time.Now().UTC(), Source: source, Destination: *dest}
+	if err := writeBundleFile(*output, header, msgs); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Printf("Exported %d message(s) to %s\n", len(msgs), *output)
+
+	for appKey, count := range skipped {
+		fmt.Fprintf(os.Stderr, "warning: kept %d message(s) for unknown app %s in the buffer\n", count, appKey)
+	}
+
+	// Only once the bundle is safely on disk
+	if *remove && *deadLetters {
+		if err := q.RemoveDeadLetters(ctx, ids); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		fmt.Printf("Removed %d exported dead letter(s)\n", len(ids))
+	} else if *remove {
+		for _, id := range ids {
+			if err := q.Ack(ctx, id); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to remove message %d: %v\n", id, err)
+				return 1
+			}
+		}
+		fmt.Printf("Removed %d exported message(s) from the buffer\n", len(ids))
+	}
+	return 0
+}
+
+// bundleMessage converts a message buffered for dest for a bundle,
+// encrypting it as a send to dest would unless it was imported encrypted.
+// It reports false if the message's app is unknown.
+func bundleMessage(cfg *config.Config, dest string, msg *queue.Message) (queue.BundleMessage, bool, error) {
+	payload := msg.Data
+	if !msg.Encrypted {
+		apiKey, masterSecret, ok := cfg.AppCredentials(msg.AppKey, dest)
+		if !ok {
+			return queue.BundleMessage{}, false, nil
+		}
+		encrypted, err := crypto.EncryptPayload(msg.Data, masterSecret, apiKey)
+		if err != nil {
+			return queue.BundleMessage{}, false, fmt.Errorf("failed to encrypt message %d: %w", msg.ID, err)
+		}
+		if payload, err = encrypted.Map(); err != nil {
+			return queue.BundleMessage{}, false, err
+		}
+	}
+
+	bm := queue.BundleMessage{
+		AppKey:      msg.AppKey,
+		Payload:     payload,
+		CreatedAt:   msg.CreatedAt,
+		Priority:    msg.Priority,
+		TraceParent: msg.TraceParent,
+		Sequence:    msg.Sequence,
+	}
+	if !msg.ExpiresAt.IsZero() {
+		bm.ExpiresAt = msg.ExpiresAt.Unix()
+	}
+	return bm, true, nil
+}
+
+// runQueueImport adds the messages of a bundle to a destination's buffer.
+// They are sent as exported, without being decrypted, so they must go to the
+// destination they were encrypted for.
+func runQueueImport(args []string) int {
+	fs := flag.NewFlagSet("queue import", flag.ContinueOnError)
+	configPath := fs.String("config", defaultConfigPath(), "Path to configuration file")
+	dest := fs.String("destination", config.DefaultDestination, "Destination whose buffer receives the messages")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, queueUsage)
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open bundle: %v\n", err)
+		return 1
+	}
+	header, msgs, err := queue.ReadBundle(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	// Bundles from before destinations were recorded are for nexus
+	if exported := header.Destination; exported != *dest && (exported != "" || *dest != config.DefaultDestination) {
+		if exported == "" {
+			exported = config.DefaultDestination
+		}
+		fmt.Fprintf(os.Stderr, "%s: exported for destination %q, not %q\n", fs.Arg(0), exported, *dest)
+		return 1
+	}
+	for i, msg := range msgs {
+		if _, err := crypto.PayloadFromMap(msg.Payload); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: message %d: %v\n", fs.Arg(0), i+1, err)
+			return 1
+		}
+	}
+
+	cfg, q, err := openBuffer(*configPath, *dest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer q.Close()
+	ctx := context.Background()
+
+	// Expired messages are skipped
+	now := time.Now()
+	live := msgs[:0]
+	for _, msg := range msgs {
+		if msg.ExpiresAt == 0 || time.Unix(msg.ExpiresAt, 0).After(now) {
+			live = append(live, msg)
+		}
+	}
+	expired := len(msgs) - len(live)
+	msgs = live
+
+	// Don't start an import that a rejecting buffer can't finish
+	if err := checkImportRoom(ctx, cfg, q, msgs); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	// All or nothing: a failed import removes what it added. Strict apps'
+	// messages are queued in their original order and numbered from this
+	// agent's counter.
+	queue.OrderBundleBySequence(msgs)
+	ids := make([]int64, 0, len(msgs))
+	for _, msg := range msgs {
+		m := &queue.Message{
+			AppKey:      msg.AppKey,
+			Data:        msg.Payload,
+			CreatedAt:   msg.CreatedAt,
+			TraceParent: msg.TraceParent,
+			Priority:    msg.Priority,
+			Encrypted:   true,
+		}
+		if msg.ExpiresAt > 0 {
+			m.ExpiresAt = time.Unix(msg.ExpiresAt, 0)
+		}
+		if cfg.AppOrdering(msg.AppKey) == string(queue.OrderingStrict) {
+			if m.Sequence, err = q.NextSequence(ctx, msg.AppKey); err != nil {
+				undoImport(ctx, q, ids, err)
+				return 1
+			}
+		}
+		id, err := q.Enqueue(ctx, m)
+		if err != nil {
+			undoImport(ctx, q, ids, err)
+			return 1
+		}
+		ids = append(ids, id)
+	}
+	imported := len(ids)
+
+	fmt.Printf("Imported %d message(s) exported from %s at %s", imported, header.Source, header.CreatedAt.Format(time.RFC3339))
+	if expired > 0 {
+		fmt.Printf(" (%d expired, skipped)", expired)
+	}
+	fmt.Println()
+	return 0
+}
+
+// undoImport removes the messages an import added before it failed
+func undoImport(ctx context.Context, q queue.Store, ids []int64, cause error) {
+	for _, id := range ids {
+		if err := q.Ack(ctx, id); err != nil {
+			fmt.Fprintf(os.Stderr, "import failed (%v) and could not be undone: %v\n", cause, err)
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "import failed, nothing imported: %v\n", cause)
+}
+
+// checkImportRoom returns an error if msgs can't all be added to q without
+// exceeding a limit whose overflow policy is reject: the global message and
+// byte caps, or an app's quota
+func checkImportRoom(ctx context.Context, cfg *config.Config, q queue.Store, msgs []queue.BundleMessage) error {
+	type usage struct {
+		count int
+		bytes int64
+	}
+	size := func(data map[string]interface{}) int64 {
+		b, _ := json.Marshal(data)
+		return int64(len(b))
+	}
+	rejects := func(overflow string) bool {
+		if overflow == "" {
+			overflow = cfg.Buffer.Overflow
+		}
+		return overflow == string(queue.OverflowReject)
+	}
+
+	var adding usage
+	addingApps := make(map[string]*usage)
+	for _, msg := range msgs {
+		u := addingApps[msg.AppKey]
+		if u == nil {
+			u = &usage{}
+			addingApps[msg.AppKey] = u
+		}
+		n := size(msg.Payload)
+		u.count++
+		u.bytes += n
+		adding.count++
+		adding.bytes += n
+	}
+
+	var used usage
+	usedApps := make(map[string]*usage)
+	err := q.Scan(ctx, func(msg *queue.Message) error {
+		n := size(msg.Data)
+		used.count++
+		used.bytes += n
+		if u := usedApps[msg.AppKey]; u != nil {
+			u.count++
+			u.bytes += n
+		} else if addingApps[msg.AppKey] != nil {
+			usedApps[msg.AppKey] = &usage{count: 1, bytes: n}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if rejects(cfg.Buffer.Overflow) {
+		if max := cfg.Buffer.MaxSize; max > 0 && used.count+adding.count > max {
+			return fmt.Errorf("buffer has room for %d message(s), bundle has %d", max-used.count, adding.count)
+		}
+		if max := cfg.Buffer.MaxBytes; max > 0 && used.bytes+adding.bytes > max {
+			return fmt.Errorf("buffer has room for %d byte(s), bundle has %d", max-used.bytes, adding.bytes)
+		}
+	}
+	for appKey, add := range addingApps {
+		quota := cfg.AppQueue(appKey)
+		if !rejects(quota.Overflow) {
+			continue
+		}
+		u := usage{}
+		if usedApps[appKey] != nil {
+			u = *usedApps[appKey]
+		}
+		if max := quota.MaxMessages; max > 0 && u.count+add.count > max {
+			return fmt.Errorf("app %s has room for %d message(s), bundle has %d", appKey, max-u.count, add.count)
+		}
+		if max := quota.MaxBytes; max > 0 && u.bytes+add.bytes > max {
+			return fmt.Errorf("app %s has room for %d byte(s), bundle has %d", appKey, max-u.bytes, add.bytes)
+		}
+	}
+	return nil
+}
+
+// openBuffer loads the config and opens the named destination's buffer
+func openBuffer(configPath, dest string) (*config.Config, queue.Store, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if !cfg.Buffer.Enabled {
+		return nil, nil, fmt.Errorf("buffering is disabled (buffer.enabled)")
+	}
+	if cfg.Buffer.Backend == string(queue.BackendMemory) {
+		return nil, nil, fmt.Errorf("the memory buffer can't be opened from another process")
+	}
+	if !hasDestination(cfg, dest) {
+		return nil, nil, fmt.Errorf("unknown destination %q", dest)
+	}
+	q, err := queue.Open(queue.Backend(cfg.Buffer.Backend), destinationBufferPath(cfg, dest), queueOptions(cfg, dest))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open buffer: %w", err)
+	}
+	return cfg, q, nil
+}
+
+// hasDestination reports whether a destination is configured
+func hasDestination(cfg *config.Config, name string) bool {
+	for _, d := range cfg.DestinationList() {
+		if d.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// writeBundleFile writes a bundle next to path and renames it into place
+// once it is fully on disk
+func writeBundleFile(path string, header queue.BundleHeader, msgs []queue.BundleMessage) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+	err = queue.WriteBundle(f, header, msgs)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+)
+
+// Header names used for HMAC-signed requests
+const (
+	HeaderClient    = "X-Nexus-Client"
+	HeaderTimestamp = "X-Nexus-Timestamp"
+	HeaderSignature = "X-Nexus-Signature"
+)
+
+// maxSignedBodyBytes bounds the body read to verify an HMAC signature
+const maxSignedBodyBytes = 10 << 20
+
+// Authentication methods reported in Identity.Method
+const (
+	MethodBearer = "bearer"
+	MethodHMAC   = "hmac"
+	MethodMTLS   = "mtls"
+)
+
+// ErrUnauthenticated is returned when no valid credentials were presented
+var ErrUnauthenticated = errors.New("authentication required")
+
+// Identity is an authenticated local client
+type Identity struct {
+	Name   string
+	Method string
+	apps   map[string]bool // nil allows every app
+}
+
+// Allows reports whether the client may send events for appKey
+func (id *Identity) Allows(appKey string) bool {
+	return id.apps == nil || id.apps[appKey]
+}
+
+// client is a configured client with its parsed credentials
+type client struct {
+	name        string
+	token       []byte
+	hmacSecret  []byte
+	certSubject string
+	apps        map[string]bool
+}
+
+// Authenticator verifies local clients of the ingress server
+type Authenticator struct {
+	clients []*client
+	byName  map[string]*client
+	maxSkew time.Duration
+}
+
+// New creates an Authenticator from the agent auth config
+func New(cfg config.AuthConfig) *Authenticator {
+	a := &Authenticator{
+		byName:  make(map[string]*client),
+		maxSkew: cfg.MaxClockSkew,
+	}
+	for _, c := range cfg.Clients {
+		cl := &client{
+			name:        c.Name,
+			token:       []byte(c.Token),
+			hmacSecret:  []byte(c.HMACSecret),
+			certSubject: c.CertSubject,
+		}
+		if !containsWildcard(c.AppKeys) {
+			cl.apps = make(map[string]bool, len(c.AppKeys))
+			for _, key := range c.AppKeys {
+				cl.apps[key] = true
+			}
+		}
+		a.clients = append(a.clients, cl)
+		a.byName[c.Name] = cl
+	}
+	return a
+}
+
+func containsWildcard(keys []string) bool {
+	for _, k := range keys {
+		if k == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate checks the request's credentials in order: mTLS client
+// certificate, bearer token, HMAC signature. The request body is buffered
+// and restored when a signature has to be verified.
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if id := a.authenticateCert(r); id != nil {
+		return id, nil
+	}
+
+	if h := r.Header.Get("Authorization"); h != "" {
+		token, ok := strings.CutPrefix(h, "Bearer ")
+		if !ok {
+			return nil, fmt.Errorf("unsupported authorization scheme")
+		}
+		return a.authenticateToken(strings.TrimSpace(token))
+	}
+
+	if r.Header.Get(HeaderSignature) != "" {
+		return a.authenticateHMAC(r)
+	}
+
+	return nil, ErrUnauthenticated
+}
+
+// authenticateCert matches a verified client certificate's common name or
+// DNS SANs against cert_subject. It requires the listener to verify client
+// certificates against a CA.
+func (a *Authenticator) authenticateCert(r *http.Request) *Identity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	for _, c := range a.clients {
+		if c.certSubject != "" && certMatches(cert, c.certSubject) {
+			return &Identity{Name: c.name, Method: MethodMTLS, apps: c.apps}
+		}
+	}
+	return nil
+}
+
+func certMatches(cert *x509.Certificate, subject string) bool {
+	if cert.Subject.CommonName == subject {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if name == subject {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Authenticator) authenticateToken(token string) (*Identity, error) {
+	if token == "" {
+		return nil, ErrUnauthenticated
+	}
+	for _, c := range a.clients {
+		if len(c.token) > 0 && subtle.ConstantTimeCompare(c.token, []byte(token)) == 1 {
+			return &Identity{Name: c.name, Method: MethodBearer, apps: c.apps}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid bearer token")
+}
+
+// authenticateHMAC verifies X-Nexus-Signature, which is the hex HMAC-SHA256
+// of "<timestamp>.<method>.<path>.<body>" keyed with the client's secret
+func (a *Authenticator) authenticateHMAC(r *http.Request) (*Identity, error) {
+	c, ok := a.byName[r.Header.Get(HeaderClient)]
+	if !ok || len(c.hmacSecret) == 0 {
+		return nil, fmt.Errorf("unknown client %q", r.Header.Get(HeaderClient))
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header", HeaderTimestamp)
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > a.maxSkew {
+		return nil, fmt.Errorf("request timestamp outside allowed clock skew")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodyBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	if len(body) > maxSignedBodyBytes {
+		return nil, fmt.Errorf("request body too large to verify")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := Sign(c.hmacSecret, ts, r.Method, r.URL.Path, body)
+	given, err := hex.DecodeString(r.Header.Get(HeaderSignature))
+	if err != nil || !hmac.Equal(given, expected) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	return &Identity{Name: c.name, Method: MethodHMAC, apps: c.apps}, nil
+}
+
+// Sign computes the HMAC-SHA256 request signature
+func Sign(secret []byte, timestamp int64, method, path string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.%s.%s.", timestamp, method, path)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a context carrying the authenticated client
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the authenticated client, or nil when auth is disabled
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
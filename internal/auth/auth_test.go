@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+)
+
+func newTestAuthenticator() *Authenticator {
+	return New(config.AuthConfig{
+		MaxClockSkew: 5 * time.Minute,
+		Clients: []config.ClientConfig{
+			{Name: "billing", Token: "tok-billing", AppKeys: []string{"app1"}},
+			{Name: "signer", HMACSecret: "s3cret", AppKeys: []string{"*"}},
+			{Name: "device", CertSubject: "device.local", AppKeys: []string{"app2"}},
+		},
+	})
+}
+
+// signedRequest builds a /send request signed by client with secret
+func signedRequest(client, secret string, ts time.Time, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(body))
+	unix := ts.Unix()
+	r.Header.Set(HeaderClient, client)
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(unix, 10))
+	r.Header.Set(HeaderSignature, hex.EncodeToString(Sign([]byte(secret), unix, http.MethodPost, "/send", []byte(body))))
+	return r
+}
+
+func TestAuthenticateBearer(t *testing.T) {
+	a := newTestAuthenticator()
+	tests := []struct {
+		name   string
+		header string
+		want   string // Client name, "" for a rejection
+	}{
+		{"valid token", "Bearer tok-billing", "billing"},
+		{"surrounding space", "Bearer  tok-billing ", "billing"},
+		{"wrong token", "Bearer nope", ""},
+		{"empty token", "Bearer ", ""},
+		{"other scheme", "Basic dXNlcjpwYXNz", ""},
+		{"scheme only", "Bearer", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/send", nil)
+			r.Header.Set("Authorization", tt.header)
+			id, err := a.Authenticate(r)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("authenticated as %q, want a rejection", id.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.Name != tt.want || id.Method != MethodBearer {
+				t.Errorf("identity = %s/%s, want %s/%s", id.Name, id.Method, tt.want, MethodBearer)
+			}
+		})
+	}
+}
+
+func TestAuthenticateHMAC(t *testing.T) {
+	a := newTestAuthenticator()
+	now := time.Now()
+	body := `{"app_key":"app1","data":{"x":1}}`
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		wantErr string
+	}{
+		{
+			name:    "valid",
+			request: func() *http.Request { return signedRequest("signer", "s3cret", now, body) },
+		},
+		{
+			name:    "within skew",
+			request: func() *http.Request { return signedRequest("signer", "s3cret", now.Add(-4*time.Minute), body) },
+		},
+		{
+			name:    "expired timestamp",
+			request: func() *http.Request { return signedRequest("signer", "s3cret", now.Add(-10*time.Minute), body) },
+			wantErr: "clock skew",
+		},
+		{
+			name:    "future timestamp",
+			request: func() *http.Request { return signedRequest("signer", "s3cret", now.Add(10*time.Minute), body) },
+			wantErr: "clock skew",
+		},
+		{
+			name:    "wrong secret",
+			request: func() *http.Request { return signedRequest("signer", "other", now, body) },
+			wantErr: "invalid signature",
+		},
+		{
+			name: "tampered body",
+			request: func() *http.Request {
+				r := signedRequest("signer", "s3cret", now, body)
+				r.Body = io.NopCloser(strings.NewReader(strings.Replace(body, "app1", "app2", 1)))
+				return r
+			},
+			wantErr: "invalid signature",
+		},
+		{
+			name: "different path",
+			request: func() *http.Request {
+				r := signedRequest("signer", "s3cret", now, body)
+				r.URL.Path = "/other"
+				return r
+			},
+			wantErr: "invalid signature",
+		},
+		{
+			name: "signature not hex",
+			request: func() *http.Request {
+				r := signedRequest("signer", "s3cret", now, body)
+				r.Header.Set(HeaderSignature, "not-hex")
+				return r
+			},
+			wantErr: "invalid signature",
+		},
+		{
+			name: "bad timestamp",
+			request: func() *http.Request {
+				r := signedRequest("signer", "s3cret", now, body)
+				r.Header.Set(HeaderTimestamp, "yesterday")
+				return r
+			},
+			wantErr: "invalid " + HeaderTimestamp,
+		},
+		{
+			name:    "unknown client",
+			request: func() *http.Request { return signedRequest("nobody", "s3cret", now, body) },
+			wantErr: "unknown client",
+		},
+		{
+			// billing has a token but no HMAC secret
+			name:    "client without secret",
+			request: func() *http.Request { return signedRequest("billing", "", now, body) },
+			wantErr: "unknown client",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.request()
+			id, err := a.Authenticate(r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.Name != "signer" || id.Method != MethodHMAC {
+				t.Errorf("identity = %s/%s, want signer/%s", id.Name, id.Method, MethodHMAC)
+			}
+			// The handler still needs the body
+			restored, _ := io.ReadAll(r.Body)
+			if string(restored) != body {
+				t.Errorf("body after verification = %q, want %q", restored, body)
+			}
+		})
+	}
+}
+
+func TestAuthenticateCert(t *testing.T) {
+	a := newTestAuthenticator()
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want string
+	}{
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "device.local"}}, "device"},
+		{"DNS SAN", &x509.Certificate{Subject: pkix.Name{CommonName: "x"}, DNSNames: []string{"device.local"}}, "device"},
+		{"no match", &x509.Certificate{Subject: pkix.Name{CommonName: "other"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/send", nil)
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert}}}
+			id, err := a.Authenticate(r)
+			if tt.want == "" {
+				if !errors.Is(err, ErrUnauthenticated) {
+					t.Fatalf("err = %v, want ErrUnauthenticated", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.Name != tt.want || id.Method != MethodMTLS {
+				t.Errorf("identity = %s/%s, want %s/%s", id.Name, id.Method, tt.want, MethodMTLS)
+			}
+		})
+	}
+}
+
+func TestAuthenticateNoCredentials(t *testing.T) {
+	a := newTestAuthenticator()
+	r := httptest.NewRequest(http.MethodPost, "/send", nil)
+	// An unverified certificate doesn't count
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "device.local"}}}}
+	if _, err := a.Authenticate(r); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("err = %v, want ErrUnauthenticated", err)
+	}
+}
+
+func TestIdentityAllows(t *testing.T) {
+	a := newTestAuthenticator()
+
+	r := httptest.NewRequest(http.MethodPost, "/send", nil)
+	r.Header.Set("Authorization", "Bearer tok-billing")
+	billing, err := a.Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !billing.Allows("app1") || billing.Allows("app2") {
+		t.Error("billing should be limited to app1")
+	}
+
+	signer, err := a.Authenticate(signedRequest("signer", "s3cret", time.Now(), "{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signer.Allows("app1") || !signer.Allows("anything") {
+		t.Error("a wildcard client should be allowed every app")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	a := newTestAuthenticator()
+	var got *Identity
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/send", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status without credentials = %d, want 401", w.Code)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("401 without WWW-Authenticate")
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/send", nil)
+	r.Header.Set("Authorization", "Bearer tok-billing")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || got == nil || got.Name != "billing" {
+		t.Errorf("status %d, identity %+v; want 200 and billing in the context", w.Code, got)
+	}
+}
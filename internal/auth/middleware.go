@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/nexus/nexus-agent/internal/logging"
+	"github.com/nexus/nexus-agent/internal/metrics"
+)
+
+// Middleware rejects unauthenticated requests with 401 and stores the
+// client identity in the request context for per-app authorization
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := a.Authenticate(r)
+		if err != nil {
+			metrics.AuthFailures.Inc("unauthenticated")
+			slog.Warn("Rejected unauthenticated request",
+				"path", r.URL.Path, "remote", r.RemoteAddr, logging.Err(err))
+
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nexus-agent"`)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(errorResponse{Success: false, Message: err.Error()})
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+	})
+}
+
+// errorResponse matches the handler's SendResponse shape
+type errorResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"sync"
 	"time"
@@ -11,10 +12,17 @@ import (
 
 // Config represents the agent configuration
 type Config struct {
-	Agent  AgentConfig  `yaml:"agent"`
-	Nexus  NexusConfig  `yaml:"nexus"`
-	Apps   []AppConfig  `yaml:"apps"` // Static apps (fallback if auto-sync fails)
-	Buffer BufferConfig `yaml:"buffer"`
+	Agent   AgentConfig   `yaml:"agent"`
+	Nexus   NexusConfig   `yaml:"nexus"`
+	Apps    []AppConfig   `yaml:"apps"` // Static apps (fallback if auto-sync fails)
+	Buffer  BufferConfig  `yaml:"buffer"`
+	Logging LoggingConfig `yaml:"logging"`
+	Tracing TracingConfig `yaml:"tracing"`
+	Health  HealthConfig  `yaml:"health"`
+
+	// Destinations are extra places apps can deliver to (see
+	// AppConfig.Destinations)
+	Destinations []DestinationConfig `yaml:"destinations"`
 
 	// Runtime state (not from config file)
 	syncedApps map[string]*AppConfig
@@ -23,53 +31,358 @@ type Config struct {
 
 // AgentConfig contains local HTTP server settings
 type AgentConfig struct {
-	Port int    `yaml:"port"`
-	Bind string `yaml:"bind"`
+	Port      int             `yaml:"port"`
+	Bind      string          `yaml:"bind"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Socket    SocketConfig    `yaml:"socket"`
+	Auth      AuthConfig      `yaml:"auth"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+
+	// ShutdownGracePeriod bounds the whole shutdown sequence: buffering
+	// in-flight sends, stopping queue workers and flushing the buffer
+	// (default: 30s)
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+}
+
+// RateLimitConfig contains token-bucket limits for /send
+// Per-app limits can be overridden by apps[].rate_limit or pushed down by
+// sync; the most specific limit wins.
+type RateLimitConfig struct {
+	Enabled   bool      `yaml:"enabled"`
+	PerApp    RateLimit `yaml:"per_app"`    // Default limit for each app_key
+	PerClient RateLimit `yaml:"per_client"` // Limit for each auth identity, or client IP without auth
+}
+
+// RateLimit is a token-bucket rate in requests per second
+// A zero rate means unlimited; burst defaults to the rate.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate" json:"rate"`
+	Burst int     `yaml:"burst" json:"burst"`
+}
+
+// SocketConfig contains settings for the Unix domain socket listener
+type SocketConfig struct {
+	Path       string `yaml:"path"`        // Socket file path; empty disables the socket
+	Mode       string `yaml:"mode"`        // Octal file mode (default: 0660)
+	Owner      string `yaml:"owner"`       // User name or uid (default: agent user)
+	Group      string `yaml:"group"`       // Group name or gid (default: agent group)
+	DisableTCP bool   `yaml:"disable_tcp"` // Serve only on the socket
+}
+
+// TLSConfig contains TLS settings for the local HTTP listener
+type TLSConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	CertFile          string        `yaml:"cert_file"`
+	KeyFile           string        `yaml:"key_file"`
+	MinVersion        string        `yaml:"min_version"`         // "1.2" or "1.3" (default: 1.2)
+	ClientCAFile      string        `yaml:"client_ca_file"`      // Verify client certificates against this CA bundle (mTLS)
+	RequireClientCert bool          `yaml:"require_client_cert"` // Reject connections without a valid client certificate
+	SelfSigned        bool          `yaml:"self_signed"`         // Generate a certificate (written to cert_file/key_file if set)
+	ReloadInterval    time.Duration `yaml:"reload_interval"`     // How often cert files are checked for renewal (default: 1m)
+}
+
+// AuthConfig contains optional authentication for local clients of /send
+type AuthConfig struct {
+	Enabled      bool           `yaml:"enabled"`
+	MaxClockSkew time.Duration  `yaml:"max_clock_skew"` // Allowed age of HMAC-signed requests (default: 5m)
+	Clients      []ClientConfig `yaml:"clients"`
+}
+
+// ClientConfig is a local client allowed to submit events
+// A client may use any combination of the credential types.
+type ClientConfig struct {
+	Name        string   `yaml:"name"`
+	Token       string   `yaml:"token"`        // Bearer token
+	HMACSecret  string   `yaml:"hmac_secret"`  // Secret for X-Nexus-Signature
+	CertSubject string   `yaml:"cert_subject"` // mTLS client certificate CN or DNS SAN
+	AppKeys     []string `yaml:"app_keys"`     // Apps this client may send for ("*" for all)
 }
 
 // NexusConfig contains settings for connecting to the Nexus server
 type NexusConfig struct {
-	ServerURL     string        `yaml:"server_url"`
-	AgentToken    string        `yaml:"agent_token"`   // NEW: Token for auto-sync
-	SyncInterval  time.Duration `yaml:"sync_interval"` // How often to sync (default: 60s)
-	Timeout       time.Duration `yaml:"timeout"`
-	RetryAttempts int           `yaml:"retry_attempts"`
-	RetryDelay    time.Duration `yaml:"retry_delay"`
+	ServerURL     string           `yaml:"server_url"`
+	Endpoints     []EndpointConfig `yaml:"endpoints"`     // Instead of server_url, for several upstreams
+	Strategy      string           `yaml:"strategy"`      // failover, round_robin or lowest_latency (default: failover)
+	AgentToken    string           `yaml:"agent_token"`   // NEW: Token for auto-sync
+	SyncInterval  time.Duration    `yaml:"sync_interval"` // How often to sync (default: 60s)
+	Timeout       time.Duration    `yaml:"timeout"`
+	RetryAttempts int              `yaml:"retry_attempts"`
+	RetryDelay    time.Duration    `yaml:"retry_delay"`
+	Proxy         ProxyConfig      `yaml:"proxy"` // Used for every Nexus destination
+	TLS           ClientTLSConfig  `yaml:"tls"`
+}
+
+// ProxyDirect as proxy.url connects directly, ignoring the proxy environment
+// variables
+const ProxyDirect = "direct"
+
+// ProxyConfig contains the outbound proxy for connections to Nexus
+type ProxyConfig struct {
+	URL     string   `yaml:"url"`      // http, https, socks5 or socks5h URL, or "direct" (default: HTTPS_PROXY/HTTP_PROXY/NO_PROXY)
+	NoProxy []string `yaml:"no_proxy"` // Hosts, domains (.example.com) and CIDRs reached directly when url is set
+}
+
+// ClientTLSConfig contains TLS settings for connections to Nexus
+type ClientTLSConfig struct {
+	CAFile       string   `yaml:"ca_file"`       // PEM bundle trusted in addition to the system roots
+	CertFile     string   `yaml:"cert_file"`     // Client certificate for mTLS
+	KeyFile      string   `yaml:"key_file"`      // Client key for mTLS
+	PinnedSHA256 []string `yaml:"pinned_sha256"` // Accept only server chains with a certificate of one of these fingerprints
+}
+
+// IsZero reports whether no TLS settings are configured
+func (t *ClientTLSConfig) IsZero() bool {
+	return t.CAFile == "" && t.CertFile == "" && t.KeyFile == "" && len(t.PinnedSHA256) == 0
+}
+
+// EndpointConfig is one upstream Nexus server
+type EndpointConfig struct {
+	Name string `yaml:"name"` // Label in metrics and health output (default: the URL's host)
+	URL  string `yaml:"url"`
+}
+
+// EndpointList returns the configured upstream endpoints: endpoints, or
+// server_url as the only one
+func (n *NexusConfig) EndpointList() []EndpointConfig {
+	if len(n.Endpoints) > 0 {
+		return n.Endpoints
+	}
+	return []EndpointConfig{{Name: endpointName(n.ServerURL), URL: n.ServerURL}}
 }
 
 // AppConfig contains credentials for a sender app
 type AppConfig struct {
-	Name         string `yaml:"name" json:"name"`
-	AppKey       string `yaml:"app_key" json:"app_key"`
-	MasterSecret string `yaml:"master_secret" json:"master_secret"`
+	Name         string     `yaml:"name" json:"name"`
+	AppKey       string     `yaml:"app_key" json:"app_key"`
+	MasterSecret string     `yaml:"master_secret" json:"master_secret"`
+	RateLimit    *RateLimit `yaml:"rate_limit" json:"rate_limit,omitempty"` // Overrides agent.rate_limit.per_app
+	Queue        *AppQueue  `yaml:"queue" json:"queue,omitempty"`           // Overrides buffer.per_app
+
+	// Destinations the app's messages are delivered to (default: nexus only)
+	Destinations []AppDestination `yaml:"destinations" json:"destinations,omitempty"`
+}
+
+// DefaultDestination is the name of the destination configured by the
+// nexus section
+const DefaultDestination = "nexus"
+
+// Destination types
+const (
+	DestinationNexus   = "nexus"   // A Nexus server
+	DestinationArchive = "archive" // A local file of encrypted payloads
+)
+
+// DestinationConfig is a place messages can be delivered to besides the
+// nexus section. Each destination has its own buffer and retry state.
+type DestinationConfig struct {
+	Name          string           `yaml:"name"`
+	Type          string           `yaml:"type"` // nexus or archive (default: nexus)
+	ServerURL     string           `yaml:"server_url"`
+	Endpoints     []EndpointConfig `yaml:"endpoints"`
+	Strategy      string           `yaml:"strategy"`       // Default: nexus.strategy
+	Timeout       time.Duration    `yaml:"timeout"`        // Default: nexus.timeout
+	RetryAttempts int              `yaml:"retry_attempts"` // Default: nexus.retry_attempts
+	RetryDelay    time.Duration    `yaml:"retry_delay"`    // Default: nexus.retry_delay
+	Path          string           `yaml:"path"`           // File messages are appended to (archive)
+	TLS           ClientTLSConfig  `yaml:"tls"`            // Default: nexus.tls
+}
+
+// EndpointList returns the destination's endpoints: endpoints, or
+// server_url as the only one
+func (d *DestinationConfig) EndpointList() []EndpointConfig {
+	if len(d.Endpoints) > 0 {
+		return d.Endpoints
+	}
+	name := endpointName(d.ServerURL)
+	if d.Name != DefaultDestination {
+		name = d.Name
+	}
+	return []EndpointConfig{{Name: name, URL: d.ServerURL}}
+}
+
+// AppDestination routes an app's messages to a destination
+type AppDestination struct {
+	Name         string `yaml:"name" json:"name"`                   // nexus or a destinations[].name
+	AppKey       string `yaml:"app_key" json:"app_key"`             // Default: the app's app_key
+	MasterSecret string `yaml:"master_secret" json:"master_secret"` // Default: the app's master_secret
 }
 
 // BufferConfig contains settings for offline buffering
 type BufferConfig struct {
-	Enabled bool   `yaml:"enabled"`
-	MaxSize int    `yaml:"max_size"`
-	DBPath  string `yaml:"db_path"`
+	Enabled  bool     `yaml:"enabled"`
+	Backend  string   `yaml:"backend"` // sqlite, file or memory (default: sqlite)
+	MaxSize  int      `yaml:"max_size"`
+	MaxBytes int64    `yaml:"max_bytes"` // Cap on total buffered payload size (0 = unlimited)
+	DBPath   string   `yaml:"db_path"`   // Database file for the sqlite backend
+	Dir      string   `yaml:"dir"`       // Log directory for the file backend
+	Overflow string   `yaml:"overflow"`  // reject, drop_oldest or drop_lowest_priority (default: reject)
+	Drain    string   `yaml:"drain"`     // fifo, round_robin or weighted (default: fifo)
+	PerApp   AppQueue `yaml:"per_app"`   // Default quota for each app
+
+	// PriorityAging adds one priority level per interval a message waits
+	// (default: 5m)
+	PriorityAging time.Duration `yaml:"priority_aging"`
+
+	// Expiry is whether messages past their TTL are kept as dead letters
+	// or deleted: dead_letter or drop (default: dead_letter)
+	Expiry string `yaml:"expiry"`
+	// SweepInterval is how often expired messages are removed (default: 1m)
+	SweepInterval time.Duration `yaml:"sweep_interval"`
+	// Dead letters beyond these limits are removed by the sweep, oldest
+	// first (default: 10000 and 168h)
+	MaxDeadLetters      int           `yaml:"max_dead_letters"`
+	DeadLetterRetention time.Duration `yaml:"dead_letter_retention"`
+
+	Workers       int           `yaml:"workers"`        // Concurrent queue senders (default: 4)
+	BatchSize     int           `yaml:"batch_size"`     // Messages leased by a worker at a time (default: 10)
+	LeaseDuration time.Duration `yaml:"lease_duration"` // How long a lease lasts; renewed before each send (default: one send plus 30s)
+	PollInterval  time.Duration `yaml:"poll_interval"`  // Wait when the queue is empty or a send fails (default: 10s)
+	Ordering      string        `yaml:"ordering"`       // ordered, unordered or strict per app (default: ordered)
+
+	Synchronous string        `yaml:"synchronous"`  // SQLite synchronous mode: normal or full (default: normal)
+	BusyTimeout time.Duration `yaml:"busy_timeout"` // Wait for the database write lock (default: 5s)
+	SegmentSize int64         `yaml:"segment_size"` // File backend segment size in bytes (default: 16 MiB)
+
+	// What to do when the buffer fails its startup integrity check:
+	// quarantine (move it aside and start empty) or fail (default: quarantine)
+	Corruption string `yaml:"corruption"`
+}
+
+// AppQueue is an app's share of the offline buffer
+// Zero limits mean the app is only bound by the global limits.
+type AppQueue struct {
+	MaxMessages int    `yaml:"max_messages" json:"max_messages"`
+	MaxBytes    int64  `yaml:"max_bytes" json:"max_bytes"`
+	Overflow    string `yaml:"overflow" json:"overflow"`       // Default: buffer.overflow
+	Weight      int    `yaml:"weight" json:"weight"`           // Drain share under weighted draining (default: 1)
+	Priority    int    `yaml:"priority" json:"priority"`       // Default priority of the app's buffered messages
+	TTLSeconds  int    `yaml:"ttl_seconds" json:"ttl_seconds"` // Discard buffered messages after this long (0 = never)
+	Ordering    string `yaml:"ordering" json:"ordering"`       // Default: buffer.ordering
+}
+
+// defaultEndpointNames names endpoints without a name after their URL's
+// host, with prefix so extra destinations' endpoints can be told apart
+func defaultEndpointNames(endpoints []EndpointConfig, prefix string) {
+	for i := range endpoints {
+		if endpoints[i].Name == "" {
+			endpoints[i].Name = prefix + endpointName(endpoints[i].URL)
+		}
+	}
+}
+
+// endpointName is the default name of an endpoint: its URL's host
+func endpointName(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return rawURL
+}
+
+// LoggingConfig contains log output settings
+type LoggingConfig struct {
+	Level  string `yaml:"level"`  // debug, info, warn, error (default: info)
+	Format string `yaml:"format"` // json or text (default: text)
+	File   string `yaml:"file"`   // Log file path (default: stderr)
+}
+
+// TracingConfig contains OpenTelemetry trace export settings
+type TracingConfig struct {
+	Enabled        bool              `yaml:"enabled"`
+	Endpoint       string            `yaml:"endpoint"`        // OTLP/HTTP collector base URL (default: http://localhost:4318)
+	ServiceName    string            `yaml:"service_name"`    // Reported service.name (default: nexus-agent)
+	SampleRatio    float64           `yaml:"sample_ratio"`    // Fraction of new traces to record (default: 1)
+	ExportInterval time.Duration     `yaml:"export_interval"` // How often spans are flushed (default: 5s)
+	Headers        map[string]string `yaml:"headers"`         // Extra headers for the collector, e.g. auth
+}
+
+// HealthConfig contains thresholds for the /readyz and /health checks
+type HealthConfig struct {
+	CheckTimeout       time.Duration `yaml:"check_timeout"`        // Bound on a single health run (default: 5s)
+	NexusProbeInterval time.Duration `yaml:"nexus_probe_interval"` // How often each Nexus endpoint is probed (default: 30s)
+	MaxSyncAge         time.Duration `yaml:"max_sync_age"`         // Sync older than this is degraded (default: 3x sync_interval)
+	QueueHighWatermark float64       `yaml:"queue_high_watermark"` // Queue fill ratio at which the agent is not ready (default: 0.9)
+
+	// QueueDegradedWatermark is the queue fill ratio at which the agent is
+	// degraded (default: 0.5, or queue_high_watermark if that is lower)
+	QueueDegradedWatermark float64 `yaml:"queue_degraded_watermark"`
 }
 
-// Load reads and parses the configuration file
+// Load reads the configuration file, applies environment overrides and
+// defaults, and validates the result. An empty path skips the file entirely
+// so the agent can be configured from the environment alone (see env.go for
+// naming and precedence rules). Validation failures are returned as a
+// *ValidationError listing every problem found.
 func Load(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
+	config, problems, err := load(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return nil, err
 	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return config, nil
+}
 
+// Check loads and validates the configuration without failing fast
+// It returns every problem found; err is only set if the file can't be read.
+func Check(path string) ([]Problem, error) {
+	_, problems, err := load(path)
+	return problems, err
+}
+
+// load does the work for Load and Check
+func load(path string) (*Config, []Problem, error) {
 	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	var root *yaml.Node
+	var problems []Problem
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+
+		// Unknown fields are rejected so typos aren't silently dropped
+		root, problems = decodeStrict(data, &config)
 	}
 
-	// Set defaults
+	// Environment overrides take precedence over the file
+	if err := applyEnv(&config); err != nil {
+		problems = append(problems, Problem{Message: err.Error()})
+	}
+
+	applyDefaults(&config)
+	problems = append(problems, validate(&config, root)...)
+
+	// Initialize synced apps map
+	config.syncedApps = make(map[string]*AppConfig)
+
+	return &config, problems, nil
+}
+
+// applyDefaults fills in any fields left unset by the file and environment
+func applyDefaults(config *Config) {
 	if config.Agent.Port == 0 {
 		config.Agent.Port = 9000
 	}
 	if config.Agent.Bind == "" {
 		config.Agent.Bind = "127.0.0.1"
 	}
+	if config.Agent.ShutdownGracePeriod == 0 {
+		config.Agent.ShutdownGracePeriod = 30 * time.Second
+	}
+	if config.Agent.TLS.MinVersion == "" {
+		config.Agent.TLS.MinVersion = "1.2"
+	}
+	if config.Agent.TLS.ReloadInterval == 0 {
+		config.Agent.TLS.ReloadInterval = time.Minute
+	}
+	if config.Agent.Socket.Mode == "" {
+		config.Agent.Socket.Mode = "0660"
+	}
+	if config.Agent.Auth.MaxClockSkew == 0 {
+		config.Agent.Auth.MaxClockSkew = 5 * time.Minute
+	}
 	if config.Nexus.Timeout == 0 {
 		config.Nexus.Timeout = 30 * time.Second
 	}
@@ -82,27 +395,125 @@ func Load(path string) (*Config, error) {
 	if config.Nexus.SyncInterval == 0 {
 		config.Nexus.SyncInterval = 60 * time.Second
 	}
+	if config.Nexus.Strategy == "" {
+		config.Nexus.Strategy = "failover"
+	}
+	defaultEndpointNames(config.Nexus.Endpoints, "")
+	for i := range config.Destinations {
+		dest := &config.Destinations[i]
+		if dest.Type == "" {
+			dest.Type = DestinationNexus
+		}
+		if dest.Strategy == "" {
+			dest.Strategy = config.Nexus.Strategy
+		}
+		if dest.Timeout == 0 {
+			dest.Timeout = config.Nexus.Timeout
+		}
+		if dest.RetryAttempts == 0 {
+			dest.RetryAttempts = config.Nexus.RetryAttempts
+		}
+		if dest.RetryDelay == 0 {
+			dest.RetryDelay = config.Nexus.RetryDelay
+		}
+		if dest.TLS.IsZero() {
+			dest.TLS = config.Nexus.TLS
+		}
+		defaultEndpointNames(dest.Endpoints, dest.Name+"/")
+	}
 	if config.Buffer.MaxSize == 0 {
 		config.Buffer.MaxSize = 10000
 	}
+	if config.Buffer.Backend == "" {
+		config.Buffer.Backend = "sqlite"
+	}
 	if config.Buffer.DBPath == "" {
 		config.Buffer.DBPath = "./queue.db"
 	}
-
-	// Validate
-	if config.Nexus.ServerURL == "" {
-		return nil, fmt.Errorf("nexus.server_url is required")
+	if config.Buffer.Dir == "" {
+		config.Buffer.Dir = "./queue"
 	}
-
-	// Either agent_token OR static apps must be configured
-	if config.Nexus.AgentToken == "" && len(config.Apps) == 0 {
-		return nil, fmt.Errorf("either nexus.agent_token or apps must be configured")
+	if config.Buffer.SegmentSize == 0 {
+		config.Buffer.SegmentSize = 16 << 20
+	}
+	if config.Buffer.Overflow == "" {
+		config.Buffer.Overflow = "reject"
+	}
+	if config.Buffer.Drain == "" {
+		config.Buffer.Drain = "fifo"
+	}
+	if config.Buffer.PriorityAging == 0 {
+		config.Buffer.PriorityAging = 5 * time.Minute
+	}
+	if config.Buffer.Expiry == "" {
+		config.Buffer.Expiry = "dead_letter"
+	}
+	if config.Buffer.SweepInterval == 0 {
+		config.Buffer.SweepInterval = time.Minute
+	}
+	if config.Buffer.MaxDeadLetters == 0 {
+		config.Buffer.MaxDeadLetters = 10000
+	}
+	if config.Buffer.DeadLetterRetention == 0 {
+		config.Buffer.DeadLetterRetention = 7 * 24 * time.Hour
+	}
+	if config.Buffer.Workers == 0 {
+		config.Buffer.Workers = 4
+	}
+	if config.Buffer.BatchSize == 0 {
+		config.Buffer.BatchSize = 10
+	}
+	if config.Buffer.LeaseDuration == 0 {
+		config.Buffer.LeaseDuration, _ = config.sendLeaseTime()
+	}
+	if config.Buffer.PollInterval == 0 {
+		config.Buffer.PollInterval = 10 * time.Second
+	}
+	if config.Buffer.Ordering == "" {
+		config.Buffer.Ordering = "ordered"
+	}
+	if config.Buffer.Synchronous == "" {
+		config.Buffer.Synchronous = "normal"
+	}
+	if config.Buffer.BusyTimeout == 0 {
+		config.Buffer.BusyTimeout = 5 * time.Second
+	}
+	if config.Buffer.Corruption == "" {
+		config.Buffer.Corruption = "quarantine"
+	}
+	if config.Logging.Level == "" {
+		config.Logging.Level = "info"
+	}
+	if config.Logging.Format == "" {
+		config.Logging.Format = "text"
+	}
+	if config.Tracing.Endpoint == "" {
+		config.Tracing.Endpoint = "http://localhost:4318"
+	}
+	if config.Tracing.ServiceName == "" {
+		config.Tracing.ServiceName = "nexus-agent"
+	}
+	if config.Tracing.SampleRatio == 0 {
+		config.Tracing.SampleRatio = 1
+	}
+	if config.Tracing.ExportInterval == 0 {
+		config.Tracing.ExportInterval = 5 * time.Second
+	}
+	if config.Health.CheckTimeout == 0 {
+		config.Health.CheckTimeout = 5 * time.Second
+	}
+	if config.Health.NexusProbeInterval == 0 {
+		config.Health.NexusProbeInterval = 30 * time.Second
+	}
+	if config.Health.MaxSyncAge == 0 {
+		config.Health.MaxSyncAge = 3 * config.Nexus.SyncInterval
+	}
+	if config.Health.QueueHighWatermark == 0 {
+		config.Health.QueueHighWatermark = 0.9
+	}
+	if config.Health.QueueDegradedWatermark == 0 {
+		config.Health.QueueDegradedWatermark = min(0.5, config.Health.QueueHighWatermark)
 	}
-
-	// Initialize synced apps map
-	config.syncedApps = make(map[string]*AppConfig)
-
-	return &config, nil
 }
 
 // GetAppByKey finds an app configuration by its app_key
@@ -157,6 +568,119 @@ func (c *Config) GetAllApps() []AppConfig {
 	return apps
 }
 
+// AppQueue returns the buffer quota for an app: the app's own queue settings
+// (static or synced) when present, otherwise buffer.per_app
+func (c *Config) AppQueue(appKey string) AppQueue {
+	if app := c.GetAppByKey(appKey); app != nil && app.Queue != nil {
+		return *app.Queue
+	}
+	return c.Buffer.PerApp
+}
+
+// AppOrdering returns the buffer ordering for an app: its queue ordering,
+// or buffer.ordering when that isn't set
+func (c *Config) AppOrdering(appKey string) string {
+	if ordering := c.AppQueue(appKey).Ordering; ordering != "" {
+		return ordering
+	}
+	return c.Buffer.Ordering
+}
+
+// leaseMargin is how much longer than a send a queue lease lasts, to cover
+// the bookkeeping around it
+const leaseMargin = 30 * time.Second
+
+// MaxSendTime is the longest a send to d can take: every attempt tries
+// every endpoint until it times out, with retry_delay between attempts
+func (d *DestinationConfig) MaxSendTime() time.Duration {
+	if d.Type == DestinationArchive || d.RetryAttempts < 1 {
+		return 0
+	}
+	attempts := time.Duration(d.RetryAttempts)
+	endpoints := time.Duration(len(d.EndpointList()))
+	return attempts*endpoints*d.Timeout + (attempts-1)*d.RetryDelay
+}
+
+// sendLeaseTime returns how long a queue lease must last to cover one send
+// to the slowest destination, and that destination's name. Workers renew
+// their leases before each send, so a lease never has to cover a batch.
+func (c *Config) sendLeaseTime() (time.Duration, string) {
+	var longest time.Duration
+	var name string
+	for _, d := range c.DestinationList() {
+		if t := d.MaxSendTime(); t > longest {
+			longest, name = t, d.Name
+		}
+	}
+	return longest + leaseMargin, name
+}
+
+// DestinationList returns every destination, the nexus section first
+func (c *Config) DestinationList() []DestinationConfig {
+	dests := []DestinationConfig{{
+		Name:          DefaultDestination,
+		Type:          DestinationNexus,
+		ServerURL:     c.Nexus.ServerURL,
+		Endpoints:     c.Nexus.Endpoints,
+		Strategy:      c.Nexus.Strategy,
+		Timeout:       c.Nexus.Timeout,
+		RetryAttempts: c.Nexus.RetryAttempts,
+		RetryDelay:    c.Nexus.RetryDelay,
+		TLS:           c.Nexus.TLS,
+	}}
+	return append(dests, c.Destinations...)
+}
+
+// AppDestinations returns the names of the destinations an app delivers to
+func (c *Config) AppDestinations(appKey string) []string {
+	routes := c.appRoutes(appKey)
+	if len(routes) == 0 {
+		return []string{DefaultDestination}
+	}
+	names := make([]string, len(routes))
+	for i, route := range routes {
+		names[i] = route.Name
+	}
+	return names
+}
+
+// AppCredentials returns the app key and master secret an app uses toward
+// a destination; ok is false if the app isn't configured
+func (c *Config) AppCredentials(appKey, destination string) (key, secret string, ok bool) {
+	app := c.GetAppByKey(appKey)
+	if app == nil {
+		return "", "", false
+	}
+	key, secret = app.AppKey, app.MasterSecret
+	for _, route := range c.appRoutes(appKey) {
+		if route.Name != destination {
+			continue
+		}
+		if route.AppKey != "" {
+			key = route.AppKey
+		}
+		if route.MasterSecret != "" {
+			secret = route.MasterSecret
+		}
+		break
+	}
+	return key, secret, true
+}
+
+// appRoutes returns an app's destinations. Routing is local config: a
+// static app's routes still apply once the app is synced.
+func (c *Config) appRoutes(appKey string) []AppDestination {
+	if app := c.GetAppByKey(appKey); app != nil && len(app.Destinations) > 0 {
+		return app.Destinations
+	}
+	for i := range c.Apps {
+		if c.Apps[i].AppKey == appKey {
+			return c.Apps[i].Destinations
+		}
+	}
+	return nil
+}
+
 // HasAutoSync returns true if agent token is configured
 func (c *Config) HasAutoSync() bool {
 	return c.Nexus.AgentToken != ""
@@ -0,0 +1,215 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is the prefix for all environment variable overrides
+const EnvPrefix = "NEXUS_AGENT_"
+
+// Environment variable names are derived from the yaml tags of the Config
+// struct: the section and field names are joined with "_" and upper-cased,
+// e.g. nexus.agent_token becomes NEXUS_AGENT_NEXUS_AGENT_TOKEN. List entries
+// are addressed by index, e.g. NEXUS_AGENT_APPS_0_MASTER_SECRET. Scalar lists
+// are comma-separated and maps use "key=value,key2=value2".
+//
+// Any variable may instead be given as <NAME>_FILE pointing at a file whose
+// contents (with surrounding whitespace trimmed) are used as the value. This
+// is intended for Docker and Kubernetes secrets. Setting both <NAME> and
+// <NAME>_FILE is an error.
+//
+// Precedence, lowest to highest:
+//  1. built-in defaults (applyDefaults)
+//  2. the YAML config file, if one is given
+//  3. NEXUS_AGENT_* environment variables and their *_FILE variants
+//
+// Defaults are applied last but only fill in fields that are still zero, so
+// they never override values from the file or the environment.
+
+// applyEnv overrides config fields from environment variables
+func applyEnv(cfg *Config) error {
+	return applyEnvStruct(reflect.ValueOf(cfg).Elem(), strings.TrimSuffix(EnvPrefix, "_"))
+}
+
+// applyEnvStruct walks the exported, yaml-tagged fields of a struct
+func applyEnvStruct(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		if err := applyEnvValue(v.Field(i), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyEnvValue sets a single value, recursing into structs and slices
+func applyEnvValue(v reflect.Value, name string) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		return applyEnvStruct(v, name)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			return applyEnvSlice(v, name)
+		}
+	case reflect.Ptr:
+		// Optional sections are allocated when any of their variables is set
+		if v.Type().Elem().Kind() == reflect.Struct {
+			if v.IsNil() {
+				if !hasEnvWithPrefix(name + "_") {
+					return nil
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			return applyEnvStruct(v.Elem(), name)
+		}
+	}
+
+	raw, ok, err := lookupEnv(name)
+	if err != nil || !ok {
+		return err
+	}
+	if err := setFromString(v, raw); err != nil {
+		return fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+	return nil
+}
+
+// applyEnvSlice handles indexed list entries (NAME_0_FIELD, NAME_1_FIELD, ...)
+// Entries beyond the current length are appended as long as some variable
+// with their index prefix is set.
+func applyEnvSlice(v reflect.Value, name string) error {
+	for i := 0; ; i++ {
+		itemPrefix := fmt.Sprintf("%s_%d", name, i)
+		if i >= v.Len() {
+			if !hasEnvWithPrefix(itemPrefix + "_") {
+				return nil
+			}
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		}
+		if err := applyEnvStruct(v.Index(i), itemPrefix); err != nil {
+			return err
+		}
+	}
+}
+
+// lookupEnv resolves NAME or NAME_FILE
+func lookupEnv(name string) (string, bool, error) {
+	value, ok := os.LookupEnv(name)
+	path, fileOK := os.LookupEnv(name + "_FILE")
+
+	if ok && fileOK {
+		return "", false, fmt.Errorf("both %s and %s_FILE are set", name, name)
+	}
+	if fileOK {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read %s_FILE: %w", name, err)
+		}
+		return strings.TrimSpace(string(data)), true, nil
+	}
+	return value, ok, nil
+}
+
+// hasEnvWithPrefix reports whether any environment variable starts with prefix
+func hasEnvWithPrefix(prefix string) bool {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// setFromString parses raw into v according to its type
+func setFromString(v reflect.Value, raw string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(raw, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		// Comma-separated list of scalars
+		parts := strings.Split(raw, ",")
+		slice := reflect.MakeSlice(v.Type(), 0, len(parts))
+		for _, part := range parts {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := setFromString(elem, part); err != nil {
+				return err
+			}
+			slice = reflect.Append(slice, elem)
+		}
+		v.Set(slice)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		m := reflect.MakeMap(v.Type())
+		for _, pair := range strings.Split(raw, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("expected key=value, got %q", pair)
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := setFromString(elem, strings.TrimSpace(value)); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(key)).Convert(v.Type().Key()), elem)
+		}
+		v.Set(m)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "ZJrOd6BXNK6dAax2Yl1UOrjRoloN6WXfs9T0MrNAx6Y="
+
+// writeConfig writes a config file into a temporary directory
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyEnvScalars(t *testing.T) {
+	t.Setenv("NEXUS_AGENT_AGENT_PORT", "9100")
+	t.Setenv("NEXUS_AGENT_NEXUS_TIMEOUT", "5s")
+	t.Setenv("NEXUS_AGENT_BUFFER_ENABLED", "true")
+	t.Setenv("NEXUS_AGENT_NEXUS_PROXY_NO_PROXY", "a.example.com, ,10.0.0.0/8")
+
+	var cfg Config
+	if err := applyEnv(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Agent.Port != 9100 {
+		t.Errorf("agent.port = %d, want 9100", cfg.Agent.Port)
+	}
+	if cfg.Nexus.Timeout != 5*time.Second {
+		t.Errorf("nexus.timeout = %v, want 5s", cfg.Nexus.Timeout)
+	}
+	if !cfg.Buffer.Enabled {
+		t.Error("buffer.enabled not set")
+	}
+	if got := strings.Join(cfg.Nexus.Proxy.NoProxy, "|"); got != "a.example.com|10.0.0.0/8" {
+		t.Errorf("nexus.proxy.no_proxy = %q", got)
+	}
+}
+
+func TestApplyEnvInvalidValue(t *testing.T) {
+	t.Setenv("NEXUS_AGENT_AGENT_PORT", "not-a-number")
+
+	var cfg Config
+	err := applyEnv(&cfg)
+	if err == nil || !strings.Contains(err.Error(), "NEXUS_AGENT_AGENT_PORT") {
+		t.Fatalf("err = %v, want an error naming the variable", err)
+	}
+}
+
+func TestApplyEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("  agt_from_file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NEXUS_AGENT_NEXUS_AGENT_TOKEN_FILE", path)
+
+	var cfg Config
+	if err := applyEnv(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Nexus.AgentToken != "agt_from_file" {
+		t.Errorf("nexus.agent_token = %q, want the trimmed file contents", cfg.Nexus.AgentToken)
+	}
+}
+
+func TestApplyEnvFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{
+			name: "both set",
+			env: map[string]string{
+				"NEXUS_AGENT_NEXUS_AGENT_TOKEN":      "agt",
+				"NEXUS_AGENT_NEXUS_AGENT_TOKEN_FILE": "/dev/null",
+			},
+			want: "both NEXUS_AGENT_NEXUS_AGENT_TOKEN and NEXUS_AGENT_NEXUS_AGENT_TOKEN_FILE are set",
+		},
+		{
+			name: "missing file",
+			env:  map[string]string{"NEXUS_AGENT_NEXUS_AGENT_TOKEN_FILE": "/nonexistent/token"},
+			want: "failed to read NEXUS_AGENT_NEXUS_AGENT_TOKEN_FILE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var cfg Config
+			err := applyEnv(&cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyEnvSliceEntries(t *testing.T) {
+	t.Setenv("NEXUS_AGENT_APPS_1_NAME", "second")
+	t.Setenv("NEXUS_AGENT_APPS_1_APP_KEY", "key2")
+	t.Setenv("NEXUS_AGENT_APPS_0_MASTER_SECRET_FILE", writeConfig(t, testSecret+"\n"))
+
+	cfg := Config{Apps: []AppConfig{{Name: "first", AppKey: "key1", MasterSecret: "old"}}}
+	if err := applyEnv(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Apps) != 2 {
+		t.Fatalf("len(apps) = %d, want 2", len(cfg.Apps))
+	}
+	if cfg.Apps[0].Name != "first" || cfg.Apps[0].MasterSecret != testSecret {
+		t.Errorf("apps[0] = %+v, want the existing entry with the secret from file", cfg.Apps[0])
+	}
+	if cfg.Apps[1].Name != "second" || cfg.Apps[1].AppKey != "key2" {
+		t.Errorf("apps[1] = %+v, want an entry appended from the environment", cfg.Apps[1])
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+agent:
+  port: 9001
+nexus:
+  server_url: "https://file.example.com"
+  retry_attempts: 2
+apps:
+  - name: demo
+    app_key: demo
+    master_secret: "`+testSecret+`"
+`)
+	t.Setenv("NEXUS_AGENT_NEXUS_SERVER_URL", "https://env.example.com")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Nexus.ServerURL != "https://env.example.com" {
+		t.Errorf("nexus.server_url = %q, want the environment value", cfg.Nexus.ServerURL)
+	}
+	if cfg.Agent.Port != 9001 || cfg.Nexus.RetryAttempts != 2 {
+		t.Errorf("file values lost: port %d, retry_attempts %d", cfg.Agent.Port, cfg.Nexus.RetryAttempts)
+	}
+	if cfg.Nexus.Timeout != 30*time.Second {
+		t.Errorf("nexus.timeout = %v, want the 30s default", cfg.Nexus.Timeout)
+	}
+}
+
+func TestLoadFromEnvironmentOnly(t *testing.T) {
+	t.Setenv("NEXUS_AGENT_NEXUS_SERVER_URL", "https://env.example.com")
+	t.Setenv("NEXUS_AGENT_NEXUS_AGENT_TOKEN", "agt_env")
+
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.HasAutoSync() {
+		t.Error("agent token from the environment not applied")
+	}
+}
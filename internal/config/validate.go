@@ -0,0 +1,724 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// masterSecretLength is the expected decoded length of a master secret
+// (matches crypto.KeyLength; not imported to avoid a package cycle)
+const masterSecretLength = 32
+
+// Problem describes a single configuration error
+type Problem struct {
+	Line    int    // Line in the config file (0 if unknown or from environment)
+	Field   string // Dotted field path, e.g. nexus.server_url
+	Message string
+}
+
+func (p Problem) String() string {
+	var b strings.Builder
+	if p.Line > 0 {
+		fmt.Fprintf(&b, "line %d: ", p.Line)
+	}
+	if p.Field != "" {
+		fmt.Fprintf(&b, "%s: ", p.Field)
+	}
+	b.WriteString(p.Message)
+	return b.String()
+}
+
+// ValidationError collects every problem found in a configuration
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].String()
+	}
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.String()
+	}
+	return fmt.Sprintf("%d configuration problems:\n  %s", len(e.Problems), strings.Join(msgs, "\n  "))
+}
+
+// typeErrorLine matches yaml.v3 decode error entries ("line 5: ...")
+var typeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// unknownField matches yaml.v3 strict-mode errors for unknown keys
+var unknownField = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+
+// decodeStrict decodes YAML into config, rejecting unknown fields
+// Every decode error is returned as a problem rather than stopping at the first.
+func decodeStrict(data []byte, config *Config) (*yaml.Node, []Problem) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, []Problem{yamlProblem(err.Error())}
+	}
+	if root.Kind == 0 {
+		// Empty file
+		return &root, nil
+	}
+
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	err := dec.Decode(config)
+	if err == nil {
+		return &root, nil
+	}
+
+	var problems []Problem
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		for _, msg := range typeErr.Errors {
+			problems = append(problems, yamlProblem(msg))
+		}
+	} else {
+		problems = append(problems, yamlProblem(err.Error()))
+	}
+	return &root, problems
+}
+
+// yamlProblem converts a yaml.v3 error message into a Problem
+func yamlProblem(msg string) Problem {
+	msg = strings.TrimPrefix(msg, "yaml: ")
+	if m := typeErrorLine.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		msg = m[2]
+		if u := unknownField.FindStringSubmatch(msg); u != nil {
+			msg = fmt.Sprintf("unknown field %q", u[1])
+		}
+		return Problem{Line: line, Message: msg}
+	}
+	return Problem{Message: msg}
+}
+
+// validate checks the loaded configuration and returns every problem found
+// root is the parsed YAML document (nil when no file was used) and is only
+// used to report line numbers.
+func validate(config *Config, root *yaml.Node) []Problem {
+	var problems []Problem
+	add := func(field, format string, args ...interface{}) {
+		problems = append(problems, Problem{
+			Line:    nodeLine(root, field),
+			Field:   field,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	// Strict ordering queues new messages behind buffered ones, so it
+	// can't work without a buffer
+	strictNeedsBuffer := func(field, ordering string) {
+		if ordering == "strict" && !config.Buffer.Enabled {
+			add(field, "strict ordering requires buffer.enabled")
+		}
+	}
+
+	// Agent
+	if config.Agent.Port < 1 || config.Agent.Port > 65535 {
+		add("agent.port", "must be between 1 and 65535, got %d", config.Agent.Port)
+	}
+	if config.Agent.Bind != "" && net.ParseIP(config.Agent.Bind) == nil && !validHostname(config.Agent.Bind) {
+		add("agent.bind", "%q is not a valid IP address or hostname", config.Agent.Bind)
+	}
+	if config.Agent.ShutdownGracePeriod < 0 {
+		add("agent.shutdown_grace_period", "must not be negative")
+	}
+
+	validateTLS(config.Agent.TLS, add)
+
+	if config.Agent.Socket.Path != "" {
+		if mode, err := strconv.ParseUint(config.Agent.Socket.Mode, 8, 32); err != nil || mode > 0777 {
+			add("agent.socket.mode", "invalid file mode %q (expected octal, e.g. \"0660\")", config.Agent.Socket.Mode)
+		}
+		if err := checkDirWritable(filepath.Dir(config.Agent.Socket.Path)); err != nil {
+			add("agent.socket.path", "%v", err)
+		}
+	} else if config.Agent.Socket.DisableTCP {
+		add("agent.socket.disable_tcp", "requires agent.socket.path")
+	}
+
+	if config.Agent.Auth.Enabled && len(config.Agent.Auth.Clients) == 0 {
+		add("agent.auth.clients", "at least one client is required when auth is enabled")
+	}
+	if config.Agent.Auth.MaxClockSkew < 0 {
+		add("agent.auth.max_clock_skew", "must not be negative")
+	}
+	clientNames := make(map[string]int)
+	for i, c := range config.Agent.Auth.Clients {
+		prefix := fmt.Sprintf("agent.auth.clients.%d", i)
+		if c.Name == "" {
+			add(prefix+".name", "is required")
+		} else if first, dup := clientNames[c.Name]; dup {
+			add(prefix+".name", "duplicate client name %q (also used by clients.%d)", c.Name, first)
+		} else {
+			clientNames[c.Name] = i
+		}
+		if c.Token == "" && c.HMACSecret == "" && c.CertSubject == "" {
+			add(prefix, "needs at least one of token, hmac_secret or cert_subject")
+		}
+		if len(c.AppKeys) == 0 {
+			add(prefix+".app_keys", "must list allowed app keys (use \"*\" for all)")
+		}
+		if c.CertSubject != "" && (!config.Agent.TLS.Enabled || config.Agent.TLS.ClientCAFile == "") {
+			add(prefix+".cert_subject", "requires agent.tls.enabled and agent.tls.client_ca_file")
+		}
+	}
+
+	validateRateLimit("agent.rate_limit.per_app", config.Agent.RateLimit.PerApp, add)
+	validateRateLimit("agent.rate_limit.per_client", config.Agent.RateLimit.PerClient, add)
+
+	// Nexus
+	validateEndpoints("nexus", config.Nexus.ServerURL, config.Nexus.Endpoints, config.Nexus.Strategy, add)
+	if config.Nexus.Timeout < 0 {
+		add("nexus.timeout", "must not be negative")
+	}
+	if config.Nexus.SyncInterval < 0 {
+		add("nexus.sync_interval", "must not be negative")
+	}
+	if config.Nexus.RetryAttempts < 1 {
+		add("nexus.retry_attempts", "must be at least 1, got %d", config.Nexus.RetryAttempts)
+	}
+	if config.Nexus.RetryDelay < 0 {
+		add("nexus.retry_delay", "must not be negative")
+	}
+	validateProxy(config.Nexus.Proxy, add)
+	validateClientTLS("nexus.tls", config.Nexus.TLS, add)
+
+	// Either agent_token OR static apps must be configured
+	if config.Nexus.AgentToken == "" && len(config.Apps) == 0 {
+		add("", "either nexus.agent_token or apps must be configured")
+	}
+
+	// Destinations
+	destinations := map[string]int{DefaultDestination: -1}
+	for i, dest := range config.Destinations {
+		prefix := fmt.Sprintf("destinations.%d", i)
+		switch first, dup := destinations[dest.Name]; {
+		case dest.Name == "":
+			add(prefix+".name", "is required")
+		case dup && first < 0:
+			add(prefix+".name", "%q is reserved for the nexus section", dest.Name)
+		case dup:
+			add(prefix+".name", "duplicate destination name %q (also used by destinations.%d)", dest.Name, first)
+		default:
+			destinations[dest.Name] = i
+		}
+
+		switch dest.Type {
+		case DestinationNexus:
+			validateEndpoints(prefix, dest.ServerURL, dest.Endpoints, dest.Strategy, add)
+			// Inherited settings were already checked as nexus.tls
+			if !reflect.DeepEqual(dest.TLS, config.Nexus.TLS) {
+				validateClientTLS(prefix+".tls", dest.TLS, add)
+			}
+		case DestinationArchive:
+			if dest.Path == "" {
+				add(prefix+".path", "is required for an archive")
+			} else if err := checkWritable(dest.Path); err != nil {
+				add(prefix+".path", "%v", err)
+			}
+		default:
+			add(prefix+".type", "must be nexus or archive, got %q", dest.Type)
+		}
+		if dest.Timeout < 0 {
+			add(prefix+".timeout", "must not be negative")
+		}
+		if dest.RetryAttempts < 1 {
+			add(prefix+".retry_attempts", "must be at least 1, got %d", dest.RetryAttempts)
+		}
+		if dest.RetryDelay < 0 {
+			add(prefix+".retry_delay", "must not be negative")
+		}
+	}
+
+	// Apps
+	seen := make(map[string]int)
+	for i, app := range config.Apps {
+		prefix := fmt.Sprintf("apps.%d", i)
+		if app.AppKey == "" {
+			add(prefix+".app_key", "is required")
+		} else if first, dup := seen[app.AppKey]; dup {
+			add(prefix+".app_key", "duplicate app_key %q (also used by apps.%d)", app.AppKey, first)
+		} else {
+			seen[app.AppKey] = i
+		}
+
+		if app.RateLimit != nil {
+			validateRateLimit(prefix+".rate_limit", *app.RateLimit, add)
+		}
+		if app.Queue != nil {
+			validateAppQueue(prefix+".queue", *app.Queue, add)
+			strictNeedsBuffer(prefix+".queue.ordering", app.Queue.Ordering)
+		}
+
+		if app.MasterSecret == "" {
+			add(prefix+".master_secret", "is required")
+		} else {
+			validateMasterSecret(prefix+".master_secret", app.MasterSecret, add)
+		}
+
+		routed := make(map[string]bool)
+		for j, route := range app.Destinations {
+			routePrefix := fmt.Sprintf("%s.destinations.%d", prefix, j)
+			if _, ok := destinations[route.Name]; !ok {
+				add(routePrefix+".name", "unknown destination %q", route.Name)
+			} else if routed[route.Name] {
+				add(routePrefix+".name", "destination %q is listed twice", route.Name)
+			}
+			routed[route.Name] = true
+			if route.MasterSecret != "" {
+				validateMasterSecret(routePrefix+".master_secret", route.MasterSecret, add)
+			}
+		}
+	}
+
+	// Buffer
+	if config.Buffer.MaxSize < 1 {
+		add("buffer.max_size", "must be at least 1, got %d", config.Buffer.MaxSize)
+	}
+	if config.Buffer.MaxBytes < 0 {
+		add("buffer.max_bytes", "must not be negative")
+	}
+	if config.Buffer.PriorityAging < 0 {
+		add("buffer.priority_aging", "must not be negative")
+	}
+	switch config.Buffer.Expiry {
+	case "dead_letter", "drop":
+	default:
+		add("buffer.expiry", "unknown policy %q (expected dead_letter or drop)", config.Buffer.Expiry)
+	}
+	if config.Buffer.SweepInterval < 0 {
+		add("buffer.sweep_interval", "must not be negative")
+	}
+	if config.Buffer.MaxDeadLetters < 0 {
+		add("buffer.max_dead_letters", "must not be negative")
+	}
+	if config.Buffer.DeadLetterRetention < 0 {
+		add("buffer.dead_letter_retention", "must not be negative")
+	}
+	if config.Buffer.Workers < 0 {
+		add("buffer.workers", "must not be negative")
+	}
+	if config.Buffer.BatchSize < 0 {
+		add("buffer.batch_size", "must not be negative")
+	}
+	if config.Buffer.LeaseDuration < 0 {
+		add("buffer.lease_duration", "must not be negative")
+	}
+	if config.Buffer.PollInterval < 0 {
+		add("buffer.poll_interval", "must not be negative")
+	}
+	if !validOrdering(config.Buffer.Ordering) {
+		add("buffer.ordering", "unknown ordering %q (expected ordered, unordered or strict)", config.Buffer.Ordering)
+	}
+	strictNeedsBuffer("buffer.ordering", config.Buffer.Ordering)
+	switch config.Buffer.Synchronous {
+	case "normal", "full":
+	default:
+		add("buffer.synchronous", "unknown mode %q (expected normal or full)", config.Buffer.Synchronous)
+	}
+	if config.Buffer.BusyTimeout < 0 {
+		add("buffer.busy_timeout", "must not be negative")
+	}
+	// A lease must outlast a send, or another worker may lease and send
+	// the same message
+	if need, dest := config.sendLeaseTime(); config.Buffer.Enabled && config.Buffer.LeaseDuration > 0 && config.Buffer.LeaseDuration < need {
+		add("buffer.lease_duration", "must be at least %s to send to destination %q, or messages may be sent twice", need, dest)
+	}
+	if !validOverflow(config.Buffer.Overflow) {
+		add("buffer.overflow", "unknown policy %q (expected reject, drop_oldest or drop_lowest_priority)", config.Buffer.Overflow)
+	}
+	switch config.Buffer.Drain {
+	case "fifo", "round_robin", "weighted":
+	default:
+		add("buffer.drain", "unknown policy %q (expected fifo, round_robin or weighted)", config.Buffer.Drain)
+	}
+	validateAppQueue("buffer.per_app", config.Buffer.PerApp, add)
+	strictNeedsBuffer("buffer.per_app.ordering", config.Buffer.PerApp.Ordering)
+	switch config.Buffer.Backend {
+	case "sqlite", "file", "memory":
+	default:
+		add("buffer.backend", "unknown backend %q (expected sqlite, file or memory)", config.Buffer.Backend)
+	}
+	if config.Buffer.SegmentSize < 0 {
+		add("buffer.segment_size", "must not be negative")
+	}
+	switch config.Buffer.Corruption {
+	case "quarantine", "fail":
+	default:
+		add("buffer.corruption", "unknown policy %q (expected quarantine or fail)", config.Buffer.Corruption)
+	}
+	if config.Buffer.Enabled {
+		switch config.Buffer.Backend {
+		case "sqlite":
+			if err := checkWritable(config.Buffer.DBPath); err != nil {
+				add("buffer.db_path", "%v", err)
+			}
+		case "file":
+			dir := config.Buffer.Dir
+			if _, err := os.Stat(dir); err != nil {
+				// Created on startup
+				dir = filepath.Dir(dir)
+			}
+			if err := checkDirWritable(dir); err != nil {
+				add("buffer.dir", "%v", err)
+			}
+		}
+	}
+
+	// Logging
+	switch strings.ToLower(config.Logging.Level) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		add("logging.level", "unknown level %q (expected debug, info, warn or error)", config.Logging.Level)
+	}
+	switch strings.ToLower(config.Logging.Format) {
+	case "json", "text":
+	default:
+		add("logging.format", "unknown format %q (expected json or text)", config.Logging.Format)
+	}
+	if config.Logging.File != "" {
+		if err := checkWritable(config.Logging.File); err != nil {
+			add("logging.file", "%v", err)
+		}
+	}
+
+	// Tracing
+	if config.Tracing.Enabled {
+		if err := validateURL(config.Tracing.Endpoint); err != nil {
+			add("tracing.endpoint", "%v", err)
+		}
+	}
+	if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+		add("tracing.sample_ratio", "must be between 0 and 1, got %g", config.Tracing.SampleRatio)
+	}
+	if config.Tracing.ExportInterval < 0 {
+		add("tracing.export_interval", "must not be negative")
+	}
+
+	// Health
+	if config.Health.QueueHighWatermark <= 0 || config.Health.QueueHighWatermark > 1 {
+		add("health.queue_high_watermark", "must be greater than 0 and at most 1, got %g", config.Health.QueueHighWatermark)
+	}
+	if config.Health.QueueDegradedWatermark <= 0 || config.Health.QueueDegradedWatermark > config.Health.QueueHighWatermark {
+		add("health.queue_degraded_watermark", "must be greater than 0 and at most health.queue_high_watermark, got %g", config.Health.QueueDegradedWatermark)
+	}
+	if config.Health.CheckTimeout < 0 {
+		add("health.check_timeout", "must not be negative")
+	}
+	if config.Health.NexusProbeInterval < 0 {
+		add("health.nexus_probe_interval", "must not be negative")
+	}
+	if config.Health.MaxSyncAge < 0 {
+		add("health.max_sync_age", "must not be negative")
+	}
+
+	return problems
+}
+
+// validateTLS checks listener TLS settings
+func validateTLS(tls TLSConfig, add func(field, format string, args ...interface{})) {
+	if !tls.Enabled {
+		return
+	}
+
+	switch tls.MinVersion {
+	case "1.2", "1.3":
+	default:
+		add("agent.tls.min_version", "must be \"1.2\" or \"1.3\", got %q", tls.MinVersion)
+	}
+
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		add("agent.tls", "cert_file and key_file must be set together")
+	}
+	if tls.SelfSigned {
+		// Files are generated if missing, so only their directories must be writable
+		for field, path := range map[string]string{"agent.tls.cert_file": tls.CertFile, "agent.tls.key_file": tls.KeyFile} {
+			if path != "" {
+				if err := checkWritable(path); err != nil {
+					add(field, "%v", err)
+				}
+			}
+		}
+	} else {
+		if tls.CertFile == "" {
+			add("agent.tls", "cert_file and key_file are required unless self_signed is set")
+		}
+		for field, path := range map[string]string{"agent.tls.cert_file": tls.CertFile, "agent.tls.key_file": tls.KeyFile} {
+			if path != "" {
+				if _, err := os.Stat(path); err != nil {
+					add(field, "%v", err)
+				}
+			}
+		}
+	}
+
+	if tls.ClientCAFile != "" {
+		if _, err := os.Stat(tls.ClientCAFile); err != nil {
+			add("agent.tls.client_ca_file", "%v", err)
+		}
+	} else if tls.RequireClientCert {
+		add("agent.tls.require_client_cert", "requires client_ca_file")
+	}
+
+	if tls.ReloadInterval < 0 {
+		add("agent.tls.reload_interval", "must not be negative")
+	}
+}
+
+// validateEndpoints checks the upstream settings of a Nexus destination
+// (field is nexus or destinations.<n>)
+func validateEndpoints(field, serverURL string, endpoints []EndpointConfig, strategy string, add func(field, format string, args ...interface{})) {
+	switch {
+	case serverURL != "" && len(endpoints) > 0:
+		add(field+".endpoints", "can't be combined with %s.server_url", field)
+	case serverURL != "":
+		if err := validateURL(serverURL); err != nil {
+			add(field+".server_url", "%v", err)
+		}
+	case len(endpoints) == 0:
+		add(field+".server_url", "is required (or %s.endpoints)", field)
+	}
+	names := make(map[string]int)
+	for i, ep := range endpoints {
+		prefix := fmt.Sprintf("%s.endpoints.%d", field, i)
+		if ep.URL == "" {
+			add(prefix+".url", "is required")
+		} else if err := validateURL(ep.URL); err != nil {
+			add(prefix+".url", "%v", err)
+		}
+		if first, dup := names[ep.Name]; dup {
+			add(prefix+".name", "duplicate endpoint name %q (also used by %s.endpoints.%d)", ep.Name, field, first)
+		} else {
+			names[ep.Name] = i
+		}
+	}
+	switch strategy {
+	case "failover", "round_robin", "lowest_latency":
+	default:
+		add(field+".strategy", "must be failover, round_robin or lowest_latency, got %q", strategy)
+	}
+}
+
+// validateProxy checks the outbound proxy settings
+func validateProxy(proxy ProxyConfig, add func(field, format string, args ...interface{})) {
+	if proxy.URL != "" && proxy.URL != ProxyDirect {
+		if u, err := url.Parse(proxy.URL); err != nil {
+			add("nexus.proxy.url", "invalid URL: %v", err)
+		} else if u.Host == "" {
+			add("nexus.proxy.url", "URL %q has no host", proxy.URL)
+		} else {
+			switch u.Scheme {
+			case "http", "https", "socks5", "socks5h":
+			default:
+				add("nexus.proxy.url", "scheme must be http, https, socks5 or socks5h, got %q", u.Scheme)
+			}
+		}
+	}
+	for i, entry := range proxy.NoProxy {
+		field := fmt.Sprintf("nexus.proxy.no_proxy.%d", i)
+		switch {
+		case strings.TrimSpace(entry) == "":
+			add(field, "must not be empty")
+		case strings.Contains(entry, "/"):
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				add(field, "invalid CIDR: %v", err)
+			}
+		}
+	}
+	if len(proxy.NoProxy) > 0 && (proxy.URL == "" || proxy.URL == ProxyDirect) {
+		add("nexus.proxy.no_proxy", "requires nexus.proxy.url (use NO_PROXY with the proxy environment variables)")
+	}
+}
+
+// validateClientTLS checks the TLS settings for connections to Nexus
+// (field is nexus.tls or destinations.<n>.tls)
+func validateClientTLS(field string, tls ClientTLSConfig, add func(field, format string, args ...interface{})) {
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		add(field, "cert_file and key_file must be set together")
+	}
+	for name, path := range map[string]string{"ca_file": tls.CAFile, "cert_file": tls.CertFile, "key_file": tls.KeyFile} {
+		if path != "" {
+			if _, err := os.Stat(path); err != nil {
+				add(field+"."+name, "%v", err)
+			}
+		}
+	}
+	for i, pin := range tls.PinnedSHA256 {
+		if sum, err := hex.DecodeString(strings.ReplaceAll(pin, ":", "")); err != nil || len(sum) != sha256.Size {
+			add(fmt.Sprintf("%s.pinned_sha256.%d", field, i), "must be a hex SHA-256 fingerprint, got %q", pin)
+		}
+	}
+}
+
+// validateMasterSecret checks that a master secret is a base64 key of the
+// right length
+func validateMasterSecret(field, masterSecret string, add func(field, format string, args ...interface{})) {
+	if secret, err := base64.StdEncoding.DecodeString(masterSecret); err != nil {
+		add(field, "is not valid base64: %v", err)
+	} else if len(secret) != masterSecretLength {
+		add(field, "must decode to %d bytes, got %d", masterSecretLength, len(secret))
+	}
+}
+
+// validateAppQueue checks a per-app buffer quota
+func validateAppQueue(field string, q AppQueue, add func(field, format string, args ...interface{})) {
+	if q.MaxMessages < 0 {
+		add(field+".max_messages", "must not be negative")
+	}
+	if q.MaxBytes < 0 {
+		add(field+".max_bytes", "must not be negative")
+	}
+	if q.Weight < 0 {
+		add(field+".weight", "must not be negative")
+	}
+	if q.TTLSeconds < 0 {
+		add(field+".ttl_seconds", "must not be negative")
+	}
+	if q.Ordering != "" && !validOrdering(q.Ordering) {
+		add(field+".ordering", "unknown ordering %q (expected ordered, unordered or strict)", q.Ordering)
+	}
+	if q.Overflow != "" && !validOverflow(q.Overflow) {
+		add(field+".overflow", "unknown policy %q (expected reject, drop_oldest or drop_lowest_priority)", q.Overflow)
+	}
+}
+
+// validOrdering reports whether ordering is a known per-app delivery ordering
+func validOrdering(ordering string) bool {
+	return ordering == "ordered" || ordering == "unordered" || ordering == "strict"
+}
+
+// validOverflow reports whether policy is a known buffer overflow policy
+func validOverflow(policy string) bool {
+	switch policy {
+	case "reject", "drop_oldest", "drop_lowest_priority":
+		return true
+	}
+	return false
+}
+
+// validateRateLimit checks a token-bucket limit
+func validateRateLimit(field string, limit RateLimit, add func(field, format string, args ...interface{})) {
+	if limit.Rate < 0 {
+		add(field+".rate", "must not be negative")
+	}
+	if limit.Burst < 0 {
+		add(field+".burst", "must not be negative")
+	}
+}
+
+// validateURL checks that raw is an absolute http(s) URL
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https, got %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("URL %q has no host", raw)
+	}
+	return nil
+}
+
+// validHostname reports whether s looks like a DNS hostname
+func validHostname(s string) bool {
+	if len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, r := range label {
+			if !(r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkWritable verifies that path can be created or opened for writing
+// without modifying an existing file.
+func checkWritable(path string) error {
+	if info, err := os.Stat(path); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", path)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("%s is not writable: %v", path, err)
+		}
+		return f.Close()
+	}
+
+	return checkDirWritable(filepath.Dir(path))
+}
+
+// checkDirWritable verifies that a file can be created in dir
+func checkDirWritable(dir string) error {
+	if info, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("directory %s does not exist", dir)
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".nexus-agent-check-*")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %v", dir, err)
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// nodeLine returns the line of the YAML node at a dotted path, or of its
+// closest existing parent. It returns 0 when root is nil or nothing matches.
+func nodeLine(root *yaml.Node, path string) int {
+	if root == nil || root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return 0
+	}
+
+	node := root.Content[0]
+	line := 0
+	if path == "" {
+		return line
+	}
+	for _, part := range strings.Split(path, ".") {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == part {
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if idx, err := strconv.Atoi(part); err == nil && idx >= 0 && idx < len(node.Content) {
+				next = node.Content[idx]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+	}
+	return line
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// findProblem returns the first problem for field, if any
+func findProblem(problems []Problem, field string) (Problem, bool) {
+	for _, p := range problems {
+		if p.Field == field {
+			return p, true
+		}
+	}
+	return Problem{}, false
+}
+
+func TestCheckValid(t *testing.T) {
+	path := writeConfig(t, `
+nexus:
+  server_url: "https://nexus.example.com"
+apps:
+  - name: demo
+    app_key: demo
+    master_secret: "`+testSecret+`"
+`)
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Fatalf("problems = %+v, want none", problems)
+	}
+}
+
+func TestCheckUnknownFields(t *testing.T) {
+	path := writeConfig(t, `nexus:
+  server_url: "https://nexus.example.com"
+  retry_atempts: 3
+apps:
+  - name: demo
+    app_key: demo
+    master_secret: "`+testSecret+`"
+    colour: blue
+`)
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int]string{
+		3: `unknown field "retry_atempts"`,
+		8: `unknown field "colour"`,
+	}
+	for line, msg := range want {
+		found := false
+		for _, p := range problems {
+			if p.Line == line && p.Message == msg {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no problem %q on line %d in %+v", msg, line, problems)
+		}
+	}
+}
+
+func TestCheckSyntaxError(t *testing.T) {
+	path := writeConfig(t, "nexus:\n  server_url: [\n")
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) == 0 {
+		t.Fatal("no problem reported for invalid YAML")
+	}
+}
+
+func TestCheckFieldProblems(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		field string
+		line  int
+		want  string
+	}{
+		{
+			name:  "bad server url",
+			yaml:  "nexus:\n  server_url: \"ftp://nexus\"\n  agent_token: agt\n",
+			field: "nexus.server_url",
+			line:  2,
+			want:  "scheme must be http or https",
+		},
+		{
+			name:  "missing server url",
+			yaml:  "nexus:\n  agent_token: agt\n",
+			field: "nexus.server_url",
+			want:  "is required",
+		},
+		{
+			name:  "retry attempts",
+			yaml:  "nexus:\n  server_url: \"https://n\"\n  agent_token: agt\n  retry_attempts: -1\n",
+			field: "nexus.retry_attempts",
+			line:  4,
+			want:  "must be at least 1",
+		},
+		{
+			name:  "master secret length",
+			yaml:  "nexus:\n  server_url: \"https://n\"\napps:\n  - name: a\n    app_key: a\n    master_secret: \"c2hvcnQ=\"\n",
+			field: "apps.0.master_secret",
+			line:  6,
+			want:  "must decode to 32 bytes",
+		},
+		{
+			name:  "no apps or token",
+			yaml:  "nexus:\n  server_url: \"https://n\"\n",
+			field: "",
+			want:  "either nexus.agent_token or apps must be configured",
+		},
+		{
+			name:  "degraded above high watermark",
+			yaml:  "nexus:\n  server_url: \"https://n\"\n  agent_token: agt\nhealth:\n  queue_high_watermark: 0.8\n  queue_degraded_watermark: 0.9\n",
+			field: "health.queue_degraded_watermark",
+			line:  6,
+			want:  "at most health.queue_high_watermark",
+		},
+		{
+			name:  "strict buffer ordering without buffer",
+			yaml:  "nexus:\n  server_url: \"https://n\"\n  agent_token: agt\nbuffer:\n  ordering: strict\n",
+			field: "buffer.ordering",
+			line:  5,
+			want:  "strict ordering requires buffer.enabled",
+		},
+		{
+			name:  "strict per-app ordering without buffer",
+			yaml:  "nexus:\n  server_url: \"https://n\"\n  agent_token: agt\nbuffer:\n  per_app:\n    ordering: strict\n",
+			field: "buffer.per_app.ordering",
+			line:  6,
+			want:  "strict ordering requires buffer.enabled",
+		},
+		{
+			name:  "lease shorter than a send",
+			yaml:  "nexus:\n  server_url: \"https://n\"\n  agent_token: agt\n  timeout: 10s\nbuffer:\n  enabled: true\n  lease_duration: 30s\n",
+			field: "buffer.lease_duration",
+			line:  7,
+			want:  `must be at least 1m10s to send to destination "nexus"`,
+		},
+		{
+			name:  "duplicate destination",
+			yaml:  "nexus:\n  server_url: \"https://n\"\n  agent_token: agt\ndestinations:\n  - name: nexus\n    server_url: \"https://m\"\n",
+			field: "destinations.0.name",
+			line:  5,
+			want:  "reserved",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems, err := Check(writeConfig(t, tt.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, ok := findProblem(problems, tt.field)
+			if !ok {
+				t.Fatalf("no problem for %q in %+v", tt.field, problems)
+			}
+			if !strings.Contains(p.Message, tt.want) {
+				t.Errorf("message = %q, want %q", p.Message, tt.want)
+			}
+			if tt.line != 0 && p.Line != tt.line {
+				t.Errorf("line = %d, want %d", p.Line, tt.line)
+			}
+		})
+	}
+}
+
+func TestCheckLineFallsBackToParent(t *testing.T) {
+	path := writeConfig(t, "nexus:\n  server_url: \"https://n\"\n  agent_token: agt\n")
+	t.Setenv("NEXUS_AGENT_NEXUS_RETRY_DELAY", "-1s")
+
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := findProblem(problems, "nexus.retry_delay")
+	if !ok {
+		t.Fatalf("no problem for nexus.retry_delay in %+v", problems)
+	}
+	// The value came from the environment, so the nexus section is reported
+	if p.Line != 1 {
+		t.Errorf("line = %d, want 1", p.Line)
+	}
+}
@@ -9,10 +9,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"time"
 
 	"golang.org/x/crypto/hkdf"
+
+	"github.com/nexus/nexus-agent/internal/logging"
 )
 
 const (
@@ -31,6 +33,36 @@ type EncryptedPayload struct {
 	Data          string `json:"data"`
 }
 
+// Map returns the payload as a generic JSON object, e.g. for buffering
+func (p *EncryptedPayload) Map() (map[string]interface{}, error) {
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+	return m, nil
+}
+
+// PayloadFromMap is the inverse of Map. It checks that m looks like an
+// encrypted payload but can't verify the ciphertext without the secret.
+func PayloadFromMap(m map[string]interface{}) (*EncryptedPayload, error) {
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	var p EncryptedPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, fmt.Errorf("invalid encrypted payload: %w", err)
+	}
+	if !p.Encrypted || p.KeyDate == "" || p.Nonce == "" || p.Data == "" {
+		return nil, fmt.Errorf("invalid encrypted payload: missing fields")
+	}
+	return &p, nil
+}
+
 // EncryptPayload encrypts the data using AES-256-GCM with daily key derivation
 // This matches the encryption format used by the Nexus Python SDK
 func EncryptPayload(data map[string]interface{}, masterSecretB64 string, appKey string) (*EncryptedPayload, error) {
@@ -40,13 +72,9 @@ func EncryptPayload(data map[string]interface{}, masterSecretB64 string, appKey
 		return nil, fmt.Errorf("failed to decode master secret: %w", err)
 	}
 
-	// Debug: Log the first 8 chars of master secret (matching server debug format)
-	log.Printf("DEBUG EncryptPayload: appKey=%s, masterSecretB64(first8)=%s..., decodedLen=%d",
-		appKey, masterSecretB64[:min(8, len(masterSecretB64))], len(masterSecret))
-
 	// Get today's date in UTC
 	keyDate := time.Now().UTC().Format("2006-01-02")
-	log.Printf("DEBUG EncryptPayload: keyDate=%s", keyDate)
+	slog.Debug("Encrypting payload", logging.AppKey(appKey), "key_date", keyDate, "secret_len", len(masterSecret))
 
 	// Derive daily key using HKDF (must match Python SDK)
 	key, err := deriveKeyForDate(masterSecret, appKey, keyDate)
@@ -106,11 +134,3 @@ func deriveKeyForDate(masterSecret []byte, appKey string, date string) ([]byte,
 
 	return key, nil
 }
-
-// min returns the smaller of a or b
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
@@ -0,0 +1,68 @@
+package destination
+
+import (
+	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/queue"
+	"github.com/nexus/nexus-agent/internal/sender"
+	"github.com/nexus/nexus-agent/internal/upstream"
+)
+
+// Destination is a place an app's messages are delivered to: the Nexus
+// server of the nexus section, another Nexus server or a local archive.
+// Each has its own sender, buffer and queue workers, so a failing
+// destination doesn't hold up or duplicate delivery to the others.
+type Destination struct {
+	Name   string
+	Config config.DestinationConfig
+	Sender *sender.Sender
+	Pool   *upstream.Pool // nil for an archive
+	Queue  queue.Store    // nil when buffering is disabled
+}
+
+// Set is the configured destinations, routed to per app
+type Set struct {
+	config *config.Config
+	list   []*Destination
+	byName map[string]*Destination
+}
+
+// NewSet creates a set of destinations; dests must include
+// config.DefaultDestination
+func NewSet(cfg *config.Config, dests []*Destination) *Set {
+	s := &Set{
+		config: cfg,
+		list:   dests,
+		byName: make(map[string]*Destination, len(dests)),
+	}
+	for _, d := range dests {
+		s.byName[d.Name] = d
+	}
+	return s
+}
+
+// List returns every destination, the default first
+func (s *Set) List() []*Destination {
+	return s.list
+}
+
+// Default returns the destination of the nexus section
+func (s *Set) Default() *Destination {
+	return s.byName[config.DefaultDestination]
+}
+
+// Get returns a destination by name, or nil
+func (s *Set) Get(name string) *Destination {
+	return s.byName[name]
+}
+
+// ForApp returns the destinations an app's messages are delivered to
+func (s *Set) ForApp(appKey string) []*Destination {
+	names := s.config.AppDestinations(appKey)
+	dests := make([]*Destination, 0, len(names))
+	for _, name := range names {
+		if d := s.byName[name]; d != nil {
+			dests = append(dests, d)
+		}
+	}
+	return dests
+}
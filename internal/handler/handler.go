@@ -1,35 +1,80 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/nexus/nexus-agent/internal/auth"
 	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/destination"
+	"github.com/nexus/nexus-agent/internal/health"
+	"github.com/nexus/nexus-agent/internal/logging"
+	"github.com/nexus/nexus-agent/internal/metrics"
 	"github.com/nexus/nexus-agent/internal/queue"
+	"github.com/nexus/nexus-agent/internal/ratelimit"
 	"github.com/nexus/nexus-agent/internal/sender"
+	"github.com/nexus/nexus-agent/internal/tracing"
 )
 
 // Handler handles HTTP requests
 type Handler struct {
-	config *config.Config
-	sender *sender.Sender
-	queue  *queue.Queue
+	config       *config.Config
+	destinations *destination.Set
+	checker      *health.Checker
+	limiter      *ratelimit.Ingress // nil when rate limiting is disabled
+
+	appLocks sync.Map // destination/app_key -> *sync.Mutex, for strict ordering
+
+	// Cancelled by Drain when the agent shuts down
+	drainCtx context.Context
+	drain    context.CancelFunc
 }
 
 // New creates a new Handler instance
-func New(cfg *config.Config, s *sender.Sender, q *queue.Queue) *Handler {
+func New(cfg *config.Config, dests *destination.Set, checker *health.Checker, limiter *ratelimit.Ingress) *Handler {
+	drainCtx, drain := context.WithCancel(context.Background())
 	return &Handler{
-		config: cfg,
-		sender: s,
-		queue:  q,
+		config:       cfg,
+		destinations: dests,
+		checker:      checker,
+		limiter:      limiter,
+		drainCtx:     drainCtx,
+		drain:        drain,
 	}
 }
 
+// Drain is called when the agent shuts down: direct sends in progress are
+// interrupted and their data buffered, and later requests are buffered
+// without a send attempt. Without a buffer they fail with 503.
+func (h *Handler) Drain() {
+	h.drain()
+}
+
+// TimeoutHeader carries the caller's deadline for a /send response, in
+// seconds ("2.5") or as a Go duration ("2500ms"). A direct send still in
+// progress shortly before the deadline is abandoned and the data buffered.
+const TimeoutHeader = "X-Request-Timeout"
+
 // SendRequest represents the incoming request body
 type SendRequest struct {
 	AppKey string                 `json:"app_key"`
 	Data   map[string]interface{} `json:"data"`
+
+	// Priority orders the message if it has to be buffered (higher first)
+	// Defaults to the app's queue priority.
+	Priority *int `json:"priority,omitempty"`
+
+	// TTLSeconds discards the message if it is still buffered after this
+	// long. Defaults to the app's queue TTL (0 = never expires).
+	TTLSeconds *int `json:"ttl_seconds,omitempty"`
 }
 
 // SendResponse represents the response body
@@ -37,13 +82,18 @@ type SendResponse struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
 	ID      int64  `json:"id,omitempty"`
+
+	// Destinations has the outcome per destination when the app delivers
+	// to more than one
+	Destinations map[string]SendResponse `json:"destinations,omitempty"`
 }
 
 // HealthResponse represents the health check response
 type HealthResponse struct {
-	Status         string `json:"status"`
-	QueueSize      int    `json:"queue_size"`
-	AppsConfigured int    `json:"apps_configured"`
+	Status         string                   `json:"status"` // healthy, degraded or unhealthy
+	QueueSize      int                      `json:"queue_size"`
+	AppsConfigured int                      `json:"apps_configured"`
+	Components     map[string]health.Result `json:"components"`
 }
 
 // HandleSend handles POST /send requests
@@ -53,6 +103,20 @@ func (h *Handler) HandleSend(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Continue the caller's trace if a traceparent header was sent
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "POST /send", tracing.KindServer)
+	defer span.End()
+
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		h.jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
 	// Parse request body
 	var req SendRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -69,6 +133,18 @@ func (h *Handler) HandleSend(w http.ResponseWriter, r *http.Request) {
 		h.jsonError(w, "data is required", http.StatusBadRequest)
 		return
 	}
+	if req.TTLSeconds != nil && *req.TTLSeconds < 0 {
+		h.jsonError(w, "ttl_seconds must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	// Check the authenticated client (if auth is enabled) may send for this app
+	if id := auth.FromContext(ctx); id != nil && !id.Allows(req.AppKey) {
+		metrics.AuthFailures.Inc("forbidden_app")
+		slog.Warn("Client not allowed to send for app", "client", id.Name, logging.AppKey(req.AppKey))
+		h.jsonError(w, "client is not allowed to send for this app_key", http.StatusForbidden)
+		return
+	}
 
 	// Check if app_key is configured
 	if h.config.GetAppByKey(req.AppKey) == nil {
@@ -76,54 +152,444 @@ func (h *Handler) HandleSend(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Try to send immediately
-	result := h.sender.Send(req.AppKey, req.Data)
+	span.SetAttr(logging.KeyAppKey, req.AppKey)
 
-	if result.Success {
-		h.jsonSuccess(w, "data sent successfully", 0)
+	// Apply the per-app rate limit before any upstream work
+	if h.limiter != nil {
+		if ok, wait := h.limiter.AllowApp(req.AppKey); !ok {
+			ratelimit.WriteLimited(w, "rate limit exceeded for app_key", wait)
+			return
+		}
+	}
+
+	dests := h.destinations.ForApp(req.AppKey)
+	var result delivery
+	if len(dests) == 1 {
+		result = h.deliver(ctx, span, r, req, dests[0], deadline)
+	} else {
+		result = h.fanOut(ctx, span, r, req, dests, deadline)
+	}
+
+	switch {
+	case result.gone:
+		span.SetError("client went away")
 		return
+	case !result.resp.Success:
+		span.SetError(result.resp.Message)
+	}
+	if result.retryAfter != "" {
+		w.Header().Set("Retry-After", result.retryAfter)
+	}
+	h.jsonResponse(w, result.resp, result.status)
+}
+
+// delivery is the outcome of a request for one destination, or for all of
+// an app's destinations combined
+type delivery struct {
+	status     int
+	resp       SendResponse
+	retryAfter string // Retry-After header, when the buffer is full
+	gone       bool   // The client went away; nothing is written
+}
+
+// failure is a delivery that failed with message
+func failure(message string, status int) delivery {
+	return delivery{status: status, resp: SendResponse{Success: false, Message: message}}
+}
+
+// deliver sends a request to one destination, buffering it there if the
+// destination can't be reached
+func (h *Handler) deliver(ctx context.Context, span *tracing.Span, r *http.Request, req SendRequest, d *destination.Destination, deadline time.Time) delivery {
+	if h.strictOrdering(d, req.AppKey) {
+		return h.deliverStrict(ctx, span, r, req, d, deadline)
+	}
+
+	// Try to send immediately, unless the agent is shutting down
+	result := sender.SendResult{Retry: true}
+	if h.drainCtx.Err() == nil {
+		result = h.send(ctx, d, req, deadline)
+	}
+
+	if result.Success {
+		return delivery{status: http.StatusOK, resp: SendResponse{Success: true, Message: "data sent successfully"}}
+	}
+
+	// Without a response the client can't assume the data was accepted, so
+	// it isn't buffered either
+	if r.Context().Err() != nil {
+		slog.Warn("Client went away before the send completed", logging.AppKey(req.AppKey), "destination", d.Name, "reason", result.Message)
+		return delivery{gone: true}
+	}
+
+	if result.Retry && h.drainCtx.Err() != nil {
+		if d.Queue == nil {
+			return failure("agent is shutting down", http.StatusServiceUnavailable)
+		}
+		return h.queueRequest(ctx, d, req, "agent shutting down", "data queued for delivery (agent shutting down)")
 	}
 
 	// If sending failed and buffering is enabled, queue the message
-	if h.config.Buffer.Enabled && result.Retry && h.queue != nil {
-		id, err := h.queue.Enqueue(req.AppKey, req.Data)
-		if err != nil {
-			log.Printf("Failed to queue message: %v", err)
-			h.jsonError(w, "failed to send and queue message", http.StatusInternalServerError)
-			return
+	if h.config.Buffer.Enabled && result.Retry && d.Queue != nil {
+		return h.queueRequest(ctx, d, req, result.Message, "data queued for delivery (server unavailable)")
+	}
+
+	// Failed to send and can't queue
+	return failure(result.Message, http.StatusBadGateway)
+}
+
+// deliverStrict delivers a request for an app with strict ordering
+// The message is buffered first, which numbers it and keeps its place
+// behind the app's earlier messages. If none are waiting it stays leased
+// to this request and is sent directly; the app lock is only held while
+// buffering, so later requests queue behind it instead of waiting for the
+// send. A message that is then not delivered or kept (the client went
+// away, or a permanent failure) is removed, leaving a gap in the app's
+// sequence numbers.
+func (h *Handler) deliverStrict(ctx context.Context, span *tracing.Span, r *http.Request, req SendRequest, d *destination.Destination, deadline time.Time) delivery {
+	unlock := h.lockApp(d.Name, req.AppKey)
+	pending, err := d.Queue.Pending(ctx, req.AppKey)
+	if err != nil {
+		unlock()
+		slog.Error("Failed to check pending messages", logging.AppKey(req.AppKey), "destination", d.Name, logging.Err(err))
+		return failure("failed to queue message", http.StatusInternalServerError)
+	}
+	var leaseFor time.Duration
+	if pending == 0 && h.drainCtx.Err() == nil {
+		leaseFor = h.config.Buffer.LeaseDuration
+	}
+	id, seq, err := h.enqueue(ctx, d.Queue, req, leaseFor)
+	unlock()
+	if err != nil {
+		return h.enqueueFailed(d, req, err)
+	}
+	span.SetAttr("sequence", seq)
+
+	if leaseFor == 0 {
+		reason, message := "earlier messages are still queued", "data queued behind earlier messages for this app_key"
+		if pending == 0 {
+			reason, message = "agent shutting down", "data queued for delivery (agent shutting down)"
+		}
+		return h.queued(d, req, id, reason, message)
+	}
+
+	// Bookkeeping for the buffered copy must not be cut short
+	qctx := context.WithoutCancel(ctx)
+	result := h.send(sender.WithSequence(ctx, seq), d, req, deadline)
+	switch {
+	case result.Success:
+		d.Queue.Ack(qctx, id)
+		return delivery{status: http.StatusOK, resp: SendResponse{Success: true, Message: "data sent successfully"}}
+
+	case r.Context().Err() != nil:
+		d.Queue.Ack(qctx, id)
+		slog.Warn("Client went away before the send completed", logging.AppKey(req.AppKey), "destination", d.Name, "reason", result.Message)
+		return delivery{gone: true}
+
+	case !result.Retry:
+		d.Queue.Ack(qctx, id)
+		return failure(result.Message, http.StatusBadGateway)
+	}
+
+	d.Queue.Release(qctx, id)
+	if h.drainCtx.Err() != nil {
+		return h.queued(d, req, id, "agent shutting down", "data queued for delivery (agent shutting down)")
+	}
+	return h.queued(d, req, id, result.Message, "data queued for delivery (server unavailable)")
+}
+
+// fanOut delivers a request to each of an app's destinations on its own,
+// so one failing doesn't hold up the others. Once any destination has
+// accepted the data a client retry would duplicate it there, so the client
+// going away doesn't discard it for the rest: it is buffered wherever
+// possible.
+func (h *Handler) fanOut(ctx context.Context, span *tracing.Span, r *http.Request, req SendRequest, dests []*destination.Destination, deadline time.Time) delivery {
+	results := make([]delivery, len(dests))
+	var wg sync.WaitGroup
+	for i, d := range dests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = h.deliver(ctx, span, r, req, d, deadline)
+		}()
+	}
+	wg.Wait()
+
+	if !slices.ContainsFunc(results, delivery.accepted) {
+		return combine(dests, results)
+	}
+	qctx := context.WithoutCancel(ctx)
+	for i, d := range dests {
+		if !results[i].gone {
+			continue
 		}
-		h.jsonResponse(w, SendResponse{
+		if h.config.Buffer.Enabled && d.Queue != nil {
+			results[i] = h.queueRequest(qctx, d, req, "client went away", "data queued for delivery (client went away)")
+		} else {
+			results[i] = failure("client went away before the send completed", http.StatusBadGateway)
+		}
+	}
+	return combine(dests, results)
+}
+
+// accepted reports whether the destination got or buffered the data
+func (d delivery) accepted() bool {
+	return d.status == http.StatusOK || d.status == http.StatusAccepted
+}
+
+// combine merges the deliveries to an app's destinations. The request
+// succeeds once any destination accepted the data, as a retry would
+// duplicate it there: 200 when every destination got it, otherwise 202
+// with each destination's outcome. When none accepted it, the status of
+// the first destination that failed.
+func combine(dests []*destination.Destination, results []delivery) delivery {
+	out := delivery{
+		status: http.StatusOK,
+		resp:   SendResponse{Success: true, Destinations: make(map[string]SendResponse, len(dests))},
+	}
+	accepted, gone := 0, false
+	var firstFailed *delivery
+	for i, d := range dests {
+		result := results[i]
+		out.resp.Destinations[d.Name] = result.resp
+		switch {
+		case result.status == http.StatusOK:
+			accepted++
+		case result.status == http.StatusAccepted:
+			accepted++
+			out.status = http.StatusAccepted
+		case result.gone:
+			gone = true
+		case firstFailed == nil:
+			firstFailed = &results[i]
+		}
+	}
+
+	failed := len(dests) - accepted
+	switch {
+	case accepted == 0 && gone:
+		return delivery{gone: true}
+	case accepted == 0:
+		out.status = firstFailed.status
+		out.retryAfter = firstFailed.retryAfter
+		out.resp.Success = false
+		out.resp.Message = fmt.Sprintf("delivery failed for %d of %d destinations", failed, len(dests))
+	case failed > 0:
+		out.status = http.StatusAccepted
+		out.resp.Message = fmt.Sprintf("data sent or queued for %d of %d destinations", accepted, len(dests))
+	case out.status == http.StatusAccepted:
+		out.resp.Message = "data sent or queued for every destination"
+	default:
+		out.resp.Message = "data sent to every destination"
+	}
+	return out
+}
+
+// send sends a request directly. The send is abandoned when the client goes
+// away, when Drain is called, or shortly before the caller's deadline (if
+// any) so there is time left to buffer the data.
+func (h *Handler) send(ctx context.Context, d *destination.Destination, req SendRequest, deadline time.Time) sender.SendResult {
+	var cancel context.CancelFunc
+	if deadline.IsZero() {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-bufferTime(time.Until(deadline))))
+	}
+	defer cancel()
+	stop := context.AfterFunc(h.drainCtx, cancel)
+	defer stop()
+
+	return d.Sender.Send(ctx, req.AppKey, req.Data)
+}
+
+// bufferTime is the part of the remaining time reserved for buffering the
+// data after an abandoned send: a tenth, at most 500ms
+func bufferTime(remaining time.Duration) time.Duration {
+	return min(remaining/10, 500*time.Millisecond)
+}
+
+// requestTimeout parses TimeoutHeader; 0 means no deadline
+func requestTimeout(r *http.Request) (time.Duration, error) {
+	value := r.Header.Get(TimeoutHeader)
+	if value == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, ferr := strconv.ParseFloat(value, 64)
+		if ferr != nil {
+			return 0, fmt.Errorf("%s must be a number of seconds or a duration", TimeoutHeader)
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("%s must be positive", TimeoutHeader)
+	}
+	return timeout, nil
+}
+
+// strictOrdering reports whether the app's messages must reach the
+// destination in arrival order, including live sends
+func (h *Handler) strictOrdering(d *destination.Destination, appKey string) bool {
+	return h.config.Buffer.Enabled && d.Queue != nil &&
+		h.config.AppOrdering(appKey) == string(queue.OrderingStrict)
+}
+
+// lockApp serializes requests for an app to a destination and returns the
+// unlock function
+func (h *Handler) lockApp(dest, appKey string) func() {
+	mu, _ := h.appLocks.LoadOrStore(dest+"/"+appKey, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// queueRequest buffers a request for a destination
+// reason is logged; message is returned to the client on success.
+func (h *Handler) queueRequest(ctx context.Context, d *destination.Destination, req SendRequest, reason, message string) delivery {
+	id, _, err := h.enqueue(ctx, d.Queue, req, 0)
+	if err != nil {
+		return h.enqueueFailed(d, req, err)
+	}
+	return h.queued(d, req, id, reason, message)
+}
+
+// enqueueFailed is the delivery for a request that couldn't be buffered
+func (h *Handler) enqueueFailed(d *destination.Destination, req SendRequest, err error) delivery {
+	metrics.EnqueueErrors.Inc(d.Name, req.AppKey)
+	if errors.Is(err, queue.ErrFull) {
+		// Buffer or app quota full: tell the client to back off rather than
+		// reporting an internal error
+		metrics.Dropped.Inc(d.Name, req.AppKey, "rejected")
+		slog.Warn("Failed to queue message", logging.AppKey(req.AppKey), "destination", d.Name, logging.Err(err))
+		result := failure("server unavailable and buffer is full: "+err.Error(), http.StatusServiceUnavailable)
+		result.retryAfter = "30"
+		return result
+	}
+	slog.Error("Failed to queue message", logging.AppKey(req.AppKey), "destination", d.Name, logging.Err(err))
+	return failure("failed to send and queue message", http.StatusInternalServerError)
+}
+
+// queued is the delivery for a request buffered as message id
+// reason is logged; message is returned to the client.
+func (h *Handler) queued(d *destination.Destination, req SendRequest, id int64, reason, message string) delivery {
+	metrics.Enqueued.Inc(d.Name, req.AppKey)
+	slog.Info("Message queued for later delivery",
+		logging.AppKey(req.AppKey), "destination", d.Name, logging.MessageID(id), "reason", reason)
+	return delivery{
+		status: http.StatusAccepted,
+		resp: SendResponse{
 			Success: true,
-			Message: "data queued for delivery (server unavailable)",
+			Message: message,
 			ID:      id,
-		}, http.StatusAccepted)
-		return
+		},
 	}
+}
 
-	// Failed to send and can't queue
-	h.jsonError(w, result.Message, http.StatusBadGateway)
+// enqueue buffers a request, storing its trace context with the message,
+// and returns its ID and sequence number. With leaseFor the message is
+// leased to the caller for that long.
+func (h *Handler) enqueue(ctx context.Context, q queue.Store, req SendRequest, leaseFor time.Duration) (id, seq int64, err error) {
+	ctx, span := tracing.Start(ctx, "queue.enqueue", tracing.KindProducer)
+	defer span.End()
+
+	appQueue := h.config.AppQueue(req.AppKey)
+	priority := appQueue.Priority
+	if req.Priority != nil {
+		priority = *req.Priority
+	}
+	span.SetAttr("priority", priority)
+
+	ttl := appQueue.TTLSeconds
+	if req.TTLSeconds != nil {
+		ttl = *req.TTLSeconds
+	}
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(time.Duration(ttl) * time.Second)
+		span.SetAttr("ttl_seconds", ttl)
+	}
+
+	msg := &queue.Message{
+		AppKey:      req.AppKey,
+		Data:        req.Data,
+		TraceParent: tracing.Traceparent(ctx),
+		Priority:    priority,
+		ExpiresAt:   expiresAt,
+		LeasedFor:   leaseFor,
+	}
+	id, err = q.Enqueue(ctx, msg)
+	if err != nil {
+		span.SetError(err.Error())
+		return 0, 0, err
+	}
+	span.SetAttr(logging.KeyMessageID, id)
+	return id, msg.Sequence, nil
 }
 
-// HandleHealth handles GET /health requests
+// HandleHealth handles GET /health requests with a per-component report
+// It returns 503 when any component is down.
 func (h *Handler) HandleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		h.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	report := h.checker.Run(r.Context())
+
+	// Messages buffered for all destinations
 	queueSize := 0
-	if h.queue != nil {
-		size, _ := h.queue.Size()
-		queueSize = size
+	for _, d := range h.destinations.List() {
+		if d.Queue != nil {
+			size, _ := d.Queue.Size(r.Context())
+			queueSize += size
+		}
 	}
 
 	resp := HealthResponse{
-		Status:         "healthy",
 		QueueSize:      queueSize,
-		AppsConfigured: len(h.config.Apps),
+		AppsConfigured: h.config.AppCount(),
+		Components:     report.Components,
+	}
+
+	status := http.StatusOK
+	switch report.Status {
+	case health.StatusOK:
+		resp.Status = "healthy"
+	case health.StatusDegraded:
+		resp.Status = "degraded"
+	default:
+		resp.Status = "unhealthy"
+		status = http.StatusServiceUnavailable
 	}
 
-	h.jsonResponse(w, resp, http.StatusOK)
+	h.jsonResponse(w, resp, status)
+}
+
+// HandleLive handles GET /livez
+// It only reports that the process is up and serving HTTP, so orchestrators
+// don't restart the agent because of an upstream outage.
+func (h *Handler) HandleLive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		h.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.jsonResponse(w, map[string]string{"status": string(health.StatusOK)}, http.StatusOK)
+}
+
+// HandleReady handles GET /readyz
+// It returns 503 when any component is down, so load balancers can route
+// traffic to another agent.
+func (h *Handler) HandleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		h.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := h.checker.Run(r.Context())
+	status := http.StatusOK
+	if report.Status == health.StatusDown {
+		status = http.StatusServiceUnavailable
+	}
+	h.jsonResponse(w, report, status)
 }
 
 // Helper methods
@@ -134,14 +600,6 @@ func (h *Handler) jsonResponse(w http.ResponseWriter, data interface{}, status i
 	json.NewEncoder(w).Encode(data)
 }
 
-func (h *Handler) jsonSuccess(w http.ResponseWriter, message string, id int64) {
-	h.jsonResponse(w, SendResponse{
-		Success: true,
-		Message: message,
-		ID:      id,
-	}, http.StatusOK)
-}
-
 func (h *Handler) jsonError(w http.ResponseWriter, message string, status int) {
 	h.jsonResponse(w, SendResponse{
 		Success: false,
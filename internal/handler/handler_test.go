@@ -0,0 +1,454 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/destination"
+	"github.com/nexus/nexus-agent/internal/health"
+	"github.com/nexus/nexus-agent/internal/queue"
+	"github.com/nexus/nexus-agent/internal/sender"
+	"github.com/nexus/nexus-agent/internal/upstream"
+)
+
+// testSecret is a base64 master secret
+const testSecret = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+// ingress is a Nexus ingress endpoint answering with status and counting
+// the requests it gets
+type ingress struct {
+	status   atomic.Int32
+	requests atomic.Int32
+}
+
+func (i *ingress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i.requests.Add(1)
+	w.WriteHeader(int(i.status.Load()))
+}
+
+// newIngress starts an ingress endpoint answering with status
+func newIngress(t *testing.T, status int) (*ingress, string) {
+	t.Helper()
+	i := &ingress{}
+	i.status.Store(int32(status))
+	srv := httptest.NewServer(i)
+	t.Cleanup(srv.Close)
+	return i, srv.URL
+}
+
+// newDestination returns a destination sending to url, tried once, with a
+// memory buffer if buffered
+func newDestination(cfg *config.Config, name, url string, buffered bool) *destination.Destination {
+	dc := config.DestinationConfig{
+		Name:          name,
+		Type:          config.DestinationNexus,
+		Endpoints:     []config.EndpointConfig{{URL: url}},
+		Strategy:      string(upstream.StrategyFailover),
+		Timeout:       5 * time.Second,
+		RetryAttempts: 1,
+	}
+	pool := upstream.New(dc.Endpoints, upstream.Options{Strategy: upstream.StrategyFailover})
+	d := &destination.Destination{Name: name, Config: dc, Sender: sender.New(cfg, dc, pool), Pool: pool}
+	if buffered {
+		d.Queue = queue.NewMemory(queue.Options{MaxSize: 100, Ordering: queue.Ordering(cfg.Buffer.Ordering)})
+	}
+	return d
+}
+
+// newTestHandler returns a handler for cfg's app "app" and dests
+func newTestHandler(cfg *config.Config, dests ...*destination.Destination) *Handler {
+	return New(cfg, destination.NewSet(cfg, dests), health.New(time.Second), nil)
+}
+
+// testConfig configures app "app", delivering to the given destinations
+func testConfig(buffered bool, dests ...string) *config.Config {
+	app := config.AppConfig{AppKey: "app", MasterSecret: testSecret}
+	for _, name := range dests {
+		app.Destinations = append(app.Destinations, config.AppDestination{Name: name})
+	}
+	cfg := &config.Config{Apps: []config.AppConfig{app}}
+	cfg.Buffer.Enabled = buffered
+	return cfg
+}
+
+// post sends body to /send and decodes the response
+func post(t *testing.T, h *Handler, body string) (int, SendResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.HandleSend(rec, httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(body)))
+	var resp SendResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	return rec.Code, resp
+}
+
+// bufferedSequences returns the sequence numbers of the messages in q
+func bufferedSequences(t *testing.T, q queue.Store) []int64 {
+	t.Helper()
+	var seqs []int64
+	if err := q.Scan(t.Context(), func(msg *queue.Message) error {
+		seqs = append(seqs, msg.Sequence)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return seqs
+}
+
+// newHealthHandler returns a handler whose checker reports the given
+// component statuses
+func newHealthHandler(statuses map[string]health.Status) *Handler {
+	checker := health.New(time.Second)
+	for name, status := range statuses {
+		checker.Register(name, func(context.Context) health.Result {
+			return health.Result{Status: status, Message: name + " is " + string(status)}
+		})
+	}
+	cfg := &config.Config{Apps: []config.AppConfig{{AppKey: "app1"}, {AppKey: "app2"}}}
+	return New(cfg, destination.NewSet(cfg, nil), checker, nil)
+}
+
+// get calls handler with method and returns the status and decoded body
+func get(t *testing.T, handler http.HandlerFunc, method string, body interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(method, "/", nil))
+	if body != nil {
+		if err := json.NewDecoder(rec.Body).Decode(body); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+	}
+	return rec.Code
+}
+
+func TestHandleReady(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses map[string]health.Status
+		want     int
+	}{
+		{"ok", map[string]health.Status{"queue": health.StatusOK, "upstream": health.StatusOK}, http.StatusOK},
+		// A degraded agent still takes traffic
+		{"degraded", map[string]health.Status{"queue": health.StatusDegraded, "upstream": health.StatusOK}, http.StatusOK},
+		{"down", map[string]health.Status{"queue": health.StatusOK, "upstream": health.StatusDown}, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHealthHandler(tt.statuses)
+			var report health.Report
+			if status := get(t, h.HandleReady, http.MethodGet, &report); status != tt.want {
+				t.Errorf("status = %d, want %d", status, tt.want)
+			}
+			if len(report.Components) != len(tt.statuses) {
+				t.Errorf("components = %v, want one per check", report.Components)
+			}
+			if status := get(t, h.HandleReady, http.MethodHead, nil); status != tt.want {
+				t.Errorf("HEAD status = %d, want %d", status, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleLive(t *testing.T) {
+	// Liveness doesn't depend on the checks
+	h := newHealthHandler(map[string]health.Status{"upstream": health.StatusDown})
+	if status := get(t, h.HandleLive, http.MethodGet, nil); status != http.StatusOK {
+		t.Errorf("status = %d, want 200", status)
+	}
+	if status := get(t, h.HandleLive, http.MethodPost, nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", status)
+	}
+}
+
+func TestHandleHealth(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   map[string]health.Status
+		wantCode   int
+		wantStatus string
+	}{
+		{"healthy", map[string]health.Status{"queue": health.StatusOK}, http.StatusOK, "healthy"},
+		{"degraded", map[string]health.Status{"queue": health.StatusDegraded, "upstream": health.StatusOK}, http.StatusOK, "degraded"},
+		{"unhealthy", map[string]health.Status{"queue": health.StatusDegraded, "upstream": health.StatusDown}, http.StatusServiceUnavailable, "unhealthy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHealthHandler(tt.statuses)
+			var resp HealthResponse
+			if code := get(t, h.HandleHealth, http.MethodGet, &resp); code != tt.wantCode {
+				t.Errorf("status code = %d, want %d", code, tt.wantCode)
+			}
+			if resp.Status != tt.wantStatus || resp.AppsConfigured != 2 {
+				t.Errorf("response = %+v, want %s with 2 apps", resp, tt.wantStatus)
+			}
+			for name, status := range tt.statuses {
+				if c := resp.Components[name]; c.Status != status || c.Message == "" {
+					t.Errorf("%s = %+v, want %s with its message", name, c, status)
+				}
+			}
+		})
+	}
+}
+
+func TestSendValidation(t *testing.T) {
+	_, url := newIngress(t, http.StatusOK)
+	cfg := testConfig(false)
+	h := newTestHandler(cfg, newDestination(cfg, config.DefaultDestination, url, false))
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid JSON", `{`},
+		{"no app_key", `{"data":{"v":1}}`},
+		{"no data", `{"app_key":"app"}`},
+		{"negative TTL", `{"app_key":"app","data":{"v":1},"ttl_seconds":-1}`},
+		{"unknown app", `{"app_key":"other","data":{"v":1}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, resp := post(t, h, tt.body); status != http.StatusBadRequest || resp.Success {
+				t.Errorf("status = %d, %+v; want 400", status, resp)
+			}
+		})
+	}
+}
+
+func TestSendBuffersWhenDown(t *testing.T) {
+	_, url := newIngress(t, http.StatusServiceUnavailable)
+	cfg := testConfig(true)
+	d := newDestination(cfg, config.DefaultDestination, url, true)
+	h := newTestHandler(cfg, d)
+
+	status, resp := post(t, h, `{"app_key":"app","data":{"v":1},"priority":3}`)
+	if status != http.StatusAccepted || !resp.Success || resp.ID == 0 {
+		t.Fatalf("status = %d, %+v; want 202 with a message ID", status, resp)
+	}
+	msgs, err := d.Queue.Lease(t.Context(), 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].ID != resp.ID || msgs[0].Priority != 3 {
+		t.Errorf("buffered %+v, want message %d with priority 3", msgs, resp.ID)
+	}
+
+	// Without a buffer the failure is passed on
+	cfg = testConfig(false)
+	h = newTestHandler(cfg, newDestination(cfg, config.DefaultDestination, url, false))
+	if status, resp := post(t, h, `{"app_key":"app","data":{"v":1}}`); status != http.StatusBadGateway || resp.Success {
+		t.Errorf("status = %d, %+v; want 502", status, resp)
+	}
+}
+
+func TestSendFanOut(t *testing.T) {
+	up, upURL := newIngress(t, http.StatusOK)
+	_, downURL := newIngress(t, http.StatusServiceUnavailable)
+	cfg := testConfig(true, config.DefaultDestination, "staging")
+	nexus := newDestination(cfg, config.DefaultDestination, upURL, true)
+	staging := newDestination(cfg, "staging", downURL, true)
+	h := newTestHandler(cfg, nexus, staging)
+
+	status, resp := post(t, h, `{"app_key":"app","data":{"v":1}}`)
+	if status != http.StatusAccepted || !resp.Success {
+		t.Fatalf("status = %d, %+v; want 202", status, resp)
+	}
+	if r := resp.Destinations[config.DefaultDestination]; !r.Success || r.ID != 0 {
+		t.Errorf("nexus: %+v, want sent", r)
+	}
+	if r := resp.Destinations["staging"]; !r.Success || r.ID == 0 {
+		t.Errorf("staging: %+v, want queued", r)
+	}
+	if n := up.requests.Load(); n != 1 {
+		t.Errorf("nexus got %d requests, want 1", n)
+	}
+	// Only the destination that failed has the message buffered
+	if size, _ := nexus.Queue.Size(t.Context()); size != 0 {
+		t.Errorf("nexus buffered %d messages, want 0", size)
+	}
+	if size, _ := staging.Queue.Size(t.Context()); size != 1 {
+		t.Errorf("staging buffered %d messages, want 1", size)
+	}
+}
+
+func TestSendFanOutPartlyFailed(t *testing.T) {
+	_, upURL := newIngress(t, http.StatusOK)
+	_, rejectURL := newIngress(t, http.StatusBadRequest)
+	cfg := testConfig(true, config.DefaultDestination, "staging")
+	h := newTestHandler(cfg,
+		newDestination(cfg, config.DefaultDestination, upURL, true),
+		newDestination(cfg, "staging", rejectURL, true))
+
+	// nexus has the data, so a retry would duplicate it there
+	status, resp := post(t, h, `{"app_key":"app","data":{"v":1}}`)
+	if status != http.StatusAccepted || !resp.Success {
+		t.Fatalf("status = %d, %+v; want 202 success", status, resp)
+	}
+	if r := resp.Destinations["staging"]; r.Success {
+		t.Errorf("staging: %+v, want failed", r)
+	}
+}
+
+func TestCombine(t *testing.T) {
+	dests := []*destination.Destination{{Name: "a"}, {Name: "b"}}
+	sent := delivery{status: http.StatusOK, resp: SendResponse{Success: true}}
+	full := failure("buffer is full", http.StatusServiceUnavailable)
+	full.retryAfter = "30"
+
+	tests := []struct {
+		name    string
+		results []delivery
+		status  int
+		success bool
+		gone    bool
+	}{
+		{"all sent", []delivery{sent, sent}, http.StatusOK, true, false},
+		{"one failed", []delivery{sent, full}, http.StatusAccepted, true, false},
+		{"one gone", []delivery{{gone: true}, sent}, http.StatusAccepted, true, false},
+		{"all failed", []delivery{full, failure("rejected", http.StatusBadGateway)}, http.StatusServiceUnavailable, false, false},
+		{"failed and gone", []delivery{full, {gone: true}}, 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := combine(dests, tt.results)
+			if got.gone != tt.gone || got.status != tt.status || got.resp.Success != tt.success {
+				t.Errorf("combine = gone %v, %d, success %v; want gone %v, %d, success %v",
+					got.gone, got.status, got.resp.Success, tt.gone, tt.status, tt.success)
+			}
+			if tt.success && got.retryAfter != "" {
+				t.Errorf("Retry-After %q on a successful send", got.retryAfter)
+			}
+		})
+	}
+}
+
+func TestSendWhileDraining(t *testing.T) {
+	up, url := newIngress(t, http.StatusOK)
+	cfg := testConfig(true)
+	d := newDestination(cfg, config.DefaultDestination, url, true)
+	h := newTestHandler(cfg, d)
+	h.Drain()
+
+	// Requests arriving during shutdown are buffered without a send
+	status, resp := post(t, h, `{"app_key":"app","data":{"v":1}}`)
+	if status != http.StatusAccepted || resp.ID == 0 {
+		t.Errorf("status = %d, %+v; want 202 with a message ID", status, resp)
+	}
+	if n := up.requests.Load(); n != 0 {
+		t.Errorf("ingress got %d requests while draining, want 0", n)
+	}
+
+	// Without a buffer they are turned away
+	cfg = testConfig(false)
+	h = newTestHandler(cfg, newDestination(cfg, config.DefaultDestination, url, false))
+	h.Drain()
+	if status, _ := post(t, h, `{"app_key":"app","data":{"v":1}}`); status != http.StatusServiceUnavailable {
+		t.Errorf("status without a buffer = %d, want 503", status)
+	}
+}
+
+func TestSendStrictOrdering(t *testing.T) {
+	in, url := newIngress(t, http.StatusServiceUnavailable)
+	cfg := testConfig(true)
+	cfg.Buffer.Ordering = string(queue.OrderingStrict)
+	cfg.Buffer.LeaseDuration = time.Minute
+	d := newDestination(cfg, config.DefaultDestination, url, true)
+	h := newTestHandler(cfg, d)
+
+	if status, _ := post(t, h, `{"app_key":"app","data":{"v":1}}`); status != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", status)
+	}
+
+	// Once Nexus is back, a new message still waits behind the buffered one
+	in.status.Store(http.StatusOK)
+	status, resp := post(t, h, `{"app_key":"app","data":{"v":2}}`)
+	if status != http.StatusAccepted || resp.ID == 0 {
+		t.Errorf("status = %d, %+v; want 202 queued", status, resp)
+	}
+	if n := in.requests.Load(); n != 1 {
+		t.Errorf("ingress got %d requests, want only the first send", n)
+	}
+	seqs := bufferedSequences(t, d.Queue)
+	if len(seqs) != 2 || seqs[0] != 1 || seqs[1] != 2 {
+		t.Errorf("buffered sequences %v, want [1 2]", seqs)
+	}
+}
+
+func TestSendStrictDoesNotHoldUpLaterRequests(t *testing.T) {
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	cfg := testConfig(true)
+	cfg.Buffer.Ordering = string(queue.OrderingStrict)
+	cfg.Buffer.LeaseDuration = time.Minute
+	d := newDestination(cfg, config.DefaultDestination, srv.URL, true)
+	h := newTestHandler(cfg, d)
+
+	first := make(chan int, 1)
+	go func() {
+		status, _ := post(t, h, `{"app_key":"app","data":{"v":1}}`)
+		first <- status
+	}()
+	<-arrived
+
+	// While the first message is being sent, the next one queues behind it
+	second := make(chan int, 1)
+	go func() {
+		status, _ := post(t, h, `{"app_key":"app","data":{"v":2}}`)
+		second <- status
+	}()
+	select {
+	case status := <-second:
+		if status != http.StatusAccepted {
+			t.Errorf("second status = %d, want 202", status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("second request waited for the first send")
+	}
+
+	release <- struct{}{}
+	if status := <-first; status != http.StatusOK {
+		t.Errorf("first status = %d, want 200", status)
+	}
+	seqs := bufferedSequences(t, d.Queue)
+	if len(seqs) != 1 || seqs[0] != 2 {
+		t.Errorf("buffered sequences %v, want [2]", seqs)
+	}
+}
+
+func TestSendStrictRejectedLeavesGap(t *testing.T) {
+	in, url := newIngress(t, http.StatusBadRequest)
+	cfg := testConfig(true)
+	cfg.Buffer.Ordering = string(queue.OrderingStrict)
+	cfg.Buffer.LeaseDuration = time.Minute
+	d := newDestination(cfg, config.DefaultDestination, url, true)
+	h := newTestHandler(cfg, d)
+
+	if status, _ := post(t, h, `{"app_key":"app","data":{"v":1}}`); status != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", status)
+	}
+	if size, _ := d.Queue.Size(t.Context()); size != 0 {
+		t.Errorf("rejected message left %d buffered", size)
+	}
+
+	in.status.Store(http.StatusServiceUnavailable)
+	if status, _ := post(t, h, `{"app_key":"app","data":{"v":2}}`); status != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", status)
+	}
+	seqs := bufferedSequences(t, d.Queue)
+	if len(seqs) != 1 || seqs[0] != 2 {
+		t.Errorf("buffered sequences %v, want [2]", seqs)
+	}
+}
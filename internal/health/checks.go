@@ -0,0 +1,240 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/destination"
+	"github.com/nexus/nexus-agent/internal/queue"
+	agentsync "github.com/nexus/nexus-agent/internal/sync"
+	"github.com/nexus/nexus-agent/internal/upstream"
+)
+
+// AppsCheck reports down when no apps are available to send for
+func AppsCheck(cfg *config.Config) CheckFunc {
+	return func(ctx context.Context) Result {
+		count := cfg.AppCount()
+		details := map[string]interface{}{
+			"configured": count,
+			"static":     len(cfg.Apps),
+		}
+		if count == 0 {
+			return Result{Status: StatusDown, Message: "no apps configured or synced", Details: details}
+		}
+		return Result{Status: StatusOK, Details: details}
+	}
+}
+
+// QueueLimits are the buffer caps a queue's fill level is measured
+// against, and the fill levels at which it is reported
+type QueueLimits struct {
+	MaxSize  int
+	MaxBytes int64 // 0 = unlimited
+
+	DegradedWatermark float64 // Fill ratio at which the queue is degraded
+	HighWatermark     float64 // Fill ratio at which the queue is down
+}
+
+// queueFill returns how full q is: the larger of its message count against
+// MaxSize and its payload size against MaxBytes. The figures are added to
+// details.
+func queueFill(ctx context.Context, q queue.Store, limits QueueLimits, details map[string]interface{}) (float64, error) {
+	size, err := q.Size(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read queue size: %w", err)
+	}
+	details["size"] = size
+	details["max_size"] = limits.MaxSize
+	fill := 0.0
+	if limits.MaxSize > 0 {
+		fill = float64(size) / float64(limits.MaxSize)
+	}
+
+	if limits.MaxBytes > 0 {
+		bytes, err := q.Bytes(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read queue bytes: %w", err)
+		}
+		details["bytes"] = bytes
+		details["max_bytes"] = limits.MaxBytes
+		fill = max(fill, float64(bytes)/float64(limits.MaxBytes))
+	}
+	details["fill_ratio"] = fill
+	return fill, nil
+}
+
+// QueueCheck reports down when the buffer can't be written or its fill
+// level reaches the high watermark, and degraded from the degraded
+// watermark. Messages waiting for delivery are normal while Nexus is
+// unreachable and don't affect the result by themselves.
+func QueueCheck(q queue.Store, limits QueueLimits) CheckFunc {
+	return func(ctx context.Context) Result {
+		details := map[string]interface{}{}
+		fill, err := queueFill(ctx, q, limits, details)
+		if err != nil {
+			return Result{Status: StatusDown, Message: err.Error(), Details: details}
+		}
+		if oldest, ok, err := q.Oldest(ctx); err == nil && ok {
+			details["oldest_age_seconds"] = int(time.Since(oldest).Seconds())
+		}
+
+		if err := q.Ping(ctx); err != nil {
+			return Result{Status: StatusDown, Message: fmt.Sprintf("queue is not writable: %v", err), Details: details}
+		}
+
+		switch {
+		case fill >= limits.HighWatermark:
+			return Result{
+				Status:  StatusDown,
+				Message: fmt.Sprintf("queue is %.0f%% full (threshold %.0f%%)", fill*100, limits.HighWatermark*100),
+				Details: details,
+			}
+		case fill >= limits.DegradedWatermark:
+			return Result{
+				Status:  StatusDegraded,
+				Message: fmt.Sprintf("queue is %.0f%% full (threshold %.0f%%)", fill*100, limits.DegradedWatermark*100),
+				Details: details,
+			}
+		}
+		return Result{Status: StatusOK, Details: details}
+	}
+}
+
+// DestinationCheck reports on a destination besides the nexus section
+// Problems only degrade the agent: the primary Nexus server decides
+// readiness. Its queue is measured against limits like the primary one.
+func DestinationCheck(d *destination.Destination, limits QueueLimits) CheckFunc {
+	return func(ctx context.Context) Result {
+		st := d.Sender.Status()
+		details := map[string]interface{}{"type": d.Config.Type}
+		if !st.LastSuccess.IsZero() {
+			details["last_success"] = st.LastSuccess.UTC().Format(time.RFC3339)
+		}
+		if !st.LastFailure.IsZero() {
+			details["last_failure"] = st.LastFailure.UTC().Format(time.RFC3339)
+			details["last_error"] = st.LastError
+		}
+		var problems []string
+		if d.Pool != nil {
+			up := 0
+			for _, ep := range d.Pool.Endpoints() {
+				if ep.Status().Up {
+					up++
+				}
+			}
+			details["endpoints_up"] = up
+			details["endpoints"] = len(d.Pool.Endpoints())
+			if up == 0 {
+				problems = append(problems, "no endpoint is reachable")
+			}
+		}
+		if d.Queue != nil {
+			queueDetails := map[string]interface{}{}
+			fill, err := queueFill(ctx, d.Queue, limits, queueDetails)
+			details["queue"] = queueDetails
+			if err != nil {
+				problems = append(problems, err.Error())
+			} else if fill >= limits.DegradedWatermark {
+				problems = append(problems, fmt.Sprintf("queue is %.0f%% full", fill*100))
+			}
+		}
+		if st.LastFailure.After(st.LastSuccess) {
+			problems = append(problems, "last send failed")
+		}
+
+		if len(problems) > 0 {
+			return Result{Status: StatusDegraded, Message: strings.Join(problems, "; "), Details: details}
+		}
+		return Result{Status: StatusOK, Details: details}
+	}
+}
+
+// SyncCheck reports on the auto-sync loop
+// A stale sync is degraded rather than down as long as apps are still
+// available from the last sync or the static config (AppsCheck covers that).
+func SyncCheck(s *agentsync.Syncer, maxAge time.Duration) CheckFunc {
+	return func(ctx context.Context) Result {
+		st := s.Status()
+		details := map[string]interface{}{}
+		if !st.LastAttempt.IsZero() {
+			details["last_attempt"] = st.LastAttempt.UTC().Format(time.RFC3339)
+		}
+		if !st.LastSuccess.IsZero() {
+			details["last_success"] = st.LastSuccess.UTC().Format(time.RFC3339)
+		}
+		if st.LastError != "" {
+			details["last_error"] = st.LastError
+		}
+		if st.Endpoint != "" {
+			details["endpoint"] = st.Endpoint
+		}
+
+		switch {
+		case st.LastSuccess.IsZero():
+			return Result{Status: StatusDegraded, Message: "no successful sync yet", Details: details}
+		case time.Since(st.LastSuccess) > maxAge:
+			return Result{
+				Status:  StatusDegraded,
+				Message: fmt.Sprintf("last successful sync was %s ago", time.Since(st.LastSuccess).Round(time.Second)),
+				Details: details,
+			}
+		}
+		return Result{Status: StatusOK, Details: details}
+	}
+}
+
+// NexusCheck reports the health of the upstream Nexus endpoints, as seen
+// by the pool's probes and recent requests. The agent is degraded while
+// some endpoints are down; when all are, it is down unless buffering is
+// enabled, since messages are still accepted then.
+func NexusCheck(cfg *config.Config, pool *upstream.Pool) CheckFunc {
+	unreachable := StatusDown
+	if cfg.Buffer.Enabled {
+		unreachable = StatusDegraded
+	}
+
+	return func(ctx context.Context) Result {
+		endpoints := make([]map[string]interface{}, 0, len(pool.Endpoints()))
+		down := 0
+		for _, ep := range pool.Endpoints() {
+			st := ep.Status()
+			details := map[string]interface{}{
+				"name": st.Name,
+				"url":  st.URL,
+				"up":   st.Up,
+			}
+			if st.Latency > 0 {
+				details["latency_ms"] = st.Latency.Milliseconds()
+			}
+			if st.LastError != "" {
+				details["last_error"] = st.LastError
+			}
+			if !st.LastUsed.IsZero() {
+				details["last_used"] = st.LastUsed.UTC().Format(time.RFC3339)
+			}
+			if !st.Up {
+				down++
+			}
+			endpoints = append(endpoints, details)
+		}
+		details := map[string]interface{}{
+			"strategy":  string(pool.Strategy()),
+			"endpoints": endpoints,
+		}
+
+		switch {
+		case down == len(endpoints):
+			return Result{Status: unreachable, Message: "no Nexus endpoint is reachable", Details: details}
+		case down > 0:
+			return Result{
+				Status:  StatusDegraded,
+				Message: fmt.Sprintf("%d of %d Nexus endpoints unreachable", down, len(endpoints)),
+				Details: details,
+			}
+		}
+		return Result{Status: StatusOK, Details: details}
+	}
+}
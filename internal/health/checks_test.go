@@ -0,0 +1,97 @@
+package health
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/destination"
+	"github.com/nexus/nexus-agent/internal/queue"
+	"github.com/nexus/nexus-agent/internal/sender"
+	"github.com/nexus/nexus-agent/internal/upstream"
+)
+
+// filledQueue returns a queue holding n messages of about size bytes
+func filledQueue(t *testing.T, n, size int) queue.Store {
+	t.Helper()
+	q, err := queue.NewSQLite(filepath.Join(t.TempDir(), "queue.db"), queue.Options{MaxSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	for i := 0; i < n; i++ {
+		msg := &queue.Message{AppKey: "app", Data: map[string]interface{}{"v": strings.Repeat("x", size)}}
+		if _, err := q.Enqueue(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return q
+}
+
+func TestQueueCheckFillLevel(t *testing.T) {
+	tests := []struct {
+		name     string
+		count    int
+		size     int
+		maxBytes int64
+		want     Status
+	}{
+		{name: "empty", count: 0, want: StatusOK},
+		{name: "waiting below degraded", count: 3, want: StatusOK},
+		{name: "count above degraded", count: 6, want: StatusDegraded},
+		{name: "count above high", count: 9, want: StatusDown},
+		{name: "bytes above degraded", count: 1, size: 700, maxBytes: 1000, want: StatusDegraded},
+		{name: "bytes above high", count: 2, size: 500, maxBytes: 1000, want: StatusDown},
+		{name: "no byte cap", count: 2, size: 5000, want: StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := filledQueue(t, tt.count, tt.size)
+			limits := QueueLimits{MaxSize: 10, MaxBytes: tt.maxBytes, DegradedWatermark: 0.5, HighWatermark: 0.9}
+			res := QueueCheck(q, limits)(context.Background())
+			if res.Status != tt.want {
+				t.Errorf("status = %s (%s), want %s", res.Status, res.Message, tt.want)
+			}
+		})
+	}
+}
+
+func TestDestinationCheckQueue(t *testing.T) {
+	dc := config.DestinationConfig{
+		Name:          "archive",
+		Type:          config.DestinationNexus,
+		Endpoints:     []config.EndpointConfig{{URL: "http://127.0.0.1:1"}},
+		Timeout:       time.Second,
+		RetryAttempts: 1,
+	}
+	pool := upstream.New(dc.Endpoints, upstream.Options{})
+	limits := QueueLimits{MaxSize: 10, DegradedWatermark: 0.5, HighWatermark: 0.9}
+
+	tests := []struct {
+		name  string
+		count int
+		want  Status
+	}{
+		{"waiting below degraded", 3, StatusOK},
+		// Only degraded: the primary destination decides readiness
+		{"above high watermark", 9, StatusDegraded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &destination.Destination{
+				Name:   dc.Name,
+				Config: dc,
+				Sender: sender.New(&config.Config{}, dc, pool),
+				Pool:   pool,
+				Queue:  filledQueue(t, tt.count, 0),
+			}
+			res := DestinationCheck(d, limits)(context.Background())
+			if res.Status != tt.want {
+				t.Errorf("status = %s (%s), want %s", res.Status, res.Message, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status is the state of a component or of the agent as a whole
+type Status string
+
+const (
+	StatusOK       Status = "ok"
+	StatusDegraded Status = "degraded" // Working, but something needs attention
+	StatusDown     Status = "down"     // Not able to serve; readiness fails
+)
+
+// Result is the outcome of a single component check
+type Result struct {
+	Status  Status                 `json:"status"`
+	Message string                 `json:"message,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// CheckFunc checks one component
+type CheckFunc func(ctx context.Context) Result
+
+// Report is the combined result of all checks
+type Report struct {
+	Status     Status            `json:"status"`
+	Components map[string]Result `json:"components"`
+}
+
+// Checker runs a set of named component checks
+type Checker struct {
+	mu      sync.RWMutex
+	names   []string
+	checks  map[string]CheckFunc
+	timeout time.Duration
+}
+
+// New creates a Checker; each run of the checks is bounded by timeout
+func New(timeout time.Duration) *Checker {
+	return &Checker{
+		checks:  make(map[string]CheckFunc),
+		timeout: timeout,
+	}
+}
+
+// Register adds a named check, replacing any existing check with that name
+func (c *Checker) Register(name string, fn CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.checks[name]; !exists {
+		c.names = append(c.names, name)
+		sort.Strings(c.names)
+	}
+	c.checks[name] = fn
+}
+
+// Run executes all checks concurrently and combines the results
+// The overall status is the worst component status.
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.RLock()
+	names := append([]string(nil), c.names...)
+	checks := make([]CheckFunc, len(names))
+	for i, name := range names {
+		checks[i] = c.checks[name]
+	}
+	c.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	results := make([]Result, len(names))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = runCheck(ctx, checks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	report := Report{
+		Status:     StatusOK,
+		Components: make(map[string]Result, len(names)),
+	}
+	for i, name := range names {
+		report.Components[name] = results[i]
+		report.Status = worst(report.Status, results[i].Status)
+	}
+	return report
+}
+
+// runCheck runs fn, reporting the component as down if it doesn't finish in time
+func runCheck(ctx context.Context, fn CheckFunc) Result {
+	done := make(chan Result, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	select {
+	case r := <-done:
+		return r
+	case <-ctx.Done():
+		return Result{Status: StatusDown, Message: "check timed out"}
+	}
+}
+
+// worst returns the more severe of two statuses
+func worst(a, b Status) Status {
+	rank := map[Status]int{StatusOK: 0, StatusDegraded: 1, StatusDown: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
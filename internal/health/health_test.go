@@ -0,0 +1,76 @@
+package health
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fixed returns a check that always reports status
+func fixed(status Status) CheckFunc {
+	return func(context.Context) Result { return Result{Status: status} }
+}
+
+func TestRunWorstStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		checks map[string]Status
+		want   Status
+	}{
+		{"no checks", nil, StatusOK},
+		{"all ok", map[string]Status{"a": StatusOK, "b": StatusOK}, StatusOK},
+		{"degraded", map[string]Status{"a": StatusOK, "b": StatusDegraded}, StatusDegraded},
+		{"down wins", map[string]Status{"a": StatusDown, "b": StatusDegraded, "c": StatusOK}, StatusDown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(time.Second)
+			for name, status := range tt.checks {
+				c.Register(name, fixed(status))
+			}
+			report := c.Run(context.Background())
+			if report.Status != tt.want {
+				t.Errorf("status = %s, want %s", report.Status, tt.want)
+			}
+			if len(report.Components) != len(tt.checks) {
+				t.Errorf("%d components reported, want %d", len(report.Components), len(tt.checks))
+			}
+			for name, status := range tt.checks {
+				if got := report.Components[name].Status; got != status {
+					t.Errorf("%s = %s, want %s", name, got, status)
+				}
+			}
+		})
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	c := New(20 * time.Millisecond)
+	c.Register("fast", fixed(StatusOK))
+	c.Register("slow", func(ctx context.Context) Result {
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond) // Ignores its context for a while
+		return Result{Status: StatusOK}
+	})
+
+	start := time.Now()
+	report := c.Run(context.Background())
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("Run took %s, want it bounded by the timeout", elapsed)
+	}
+	if report.Status != StatusDown || report.Components["slow"].Message != "check timed out" {
+		t.Errorf("report = %+v, want the slow check down", report)
+	}
+	if report.Components["fast"].Status != StatusOK {
+		t.Errorf("fast = %+v, want ok", report.Components["fast"])
+	}
+}
+
+func TestRegisterReplaces(t *testing.T) {
+	c := New(time.Second)
+	c.Register("queue", fixed(StatusDown))
+	c.Register("queue", fixed(StatusOK))
+	if report := c.Run(context.Background()); report.Status != StatusOK || len(report.Components) != 1 {
+		t.Errorf("report = %+v, want the replacement check only", report)
+	}
+}
@@ -0,0 +1,109 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+)
+
+// Standard field names shared by every package
+const (
+	KeyAppKey    = "app_key"
+	KeyMessageID = "message_id"
+	KeyAttempt   = "attempt"
+	KeyDuration  = "duration_ms"
+	KeyError     = "error"
+)
+
+// AppKey returns the standard app_key attribute
+func AppKey(appKey string) slog.Attr {
+	return slog.String(KeyAppKey, appKey)
+}
+
+// MessageID returns the standard message_id attribute
+func MessageID(id int64) slog.Attr {
+	return slog.Int64(KeyMessageID, id)
+}
+
+// Attempt returns the standard attempt attribute
+func Attempt(n int) slog.Attr {
+	return slog.Int(KeyAttempt, n)
+}
+
+// Duration returns the standard duration attribute in milliseconds
+func Duration(d time.Duration) slog.Attr {
+	return slog.Float64(KeyDuration, float64(d.Microseconds())/1000)
+}
+
+// Err returns the standard error attribute
+func Err(err error) slog.Attr {
+	if err == nil {
+		return slog.Attr{}
+	}
+	return slog.String(KeyError, err.Error())
+}
+
+// Setup configures the default slog logger from the logging config
+// The standard library log package is routed through the same handler.
+// The returned closer releases the log file, if one was opened.
+func Setup(cfg config.LoggingConfig) (io.Closer, error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	var out io.Writer = os.Stderr
+	var closer io.Closer = nopCloser{}
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		out = f
+		closer = f
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	case "", "text":
+		handler = slog.NewTextHandler(out, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q (expected json or text)", cfg.Format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	log.SetFlags(0)
+
+	return closer, nil
+}
+
+// ParseLevel converts a config level name to a slog.Level
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q (expected debug, info, warn or error)", name)
+	}
+}
+
+// nopCloser is returned when logging to stderr
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,126 @@
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    slog.Level
+		wantErr bool
+	}{
+		{"", slog.LevelInfo, false},
+		{"debug", slog.LevelDebug, false},
+		{"INFO", slog.LevelInfo, false},
+		{"warn", slog.LevelWarn, false},
+		{"warning", slog.LevelWarn, false},
+		{"Error", slog.LevelError, false},
+		{"verbose", slog.LevelInfo, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// setupFile configures logging to a file in a temporary directory and
+// restores the previous default logger when the test ends
+func setupFile(t *testing.T, cfg config.LoggingConfig) string {
+	t.Helper()
+	prev := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	cfg.File = filepath.Join(t.TempDir(), "agent.log")
+	closer, err := Setup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closer.Close() })
+	return cfg.File
+}
+
+func TestSetupJSONFile(t *testing.T) {
+	path := setupFile(t, config.LoggingConfig{Level: "warn", Format: "json"})
+
+	slog.Info("dropped below the level")
+	slog.Warn("queued", AppKey("app1"), MessageID(7), Attempt(2), Duration(1500*time.Microsecond), Err(errors.New("boom")))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("log file has %d lines, want 1:\n%s", len(lines), data)
+	}
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"level":      "WARN",
+		"msg":        "queued",
+		KeyAppKey:    "app1",
+		KeyMessageID: 7.0,
+		KeyAttempt:   2.0,
+		KeyDuration:  1.5,
+		KeyError:     "boom",
+	}
+	for key, value := range want {
+		if rec[key] != value {
+			t.Errorf("%s = %v, want %v", key, rec[key], value)
+		}
+	}
+}
+
+func TestSetupTextFile(t *testing.T) {
+	path := setupFile(t, config.LoggingConfig{Level: "debug"})
+	slog.Debug("details", AppKey("app1"), Err(nil))
+	log.Print("from the log package")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("log file has %d lines, want 2:\n%s", len(lines), data)
+	}
+	if !strings.Contains(lines[0], "level=DEBUG") || !strings.Contains(lines[0], "app_key=app1") || strings.Contains(lines[0], KeyError) {
+		t.Errorf("log line = %q, want a text record without an error field", lines[0])
+	}
+	// The standard library logger goes through the same handler
+	if !strings.Contains(lines[1], `msg="from the log package"`) {
+		t.Errorf("log package line = %q, want a text record", lines[1])
+	}
+}
+
+func TestSetupErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.LoggingConfig
+	}{
+		{"level", config.LoggingConfig{Level: "loud"}},
+		{"format", config.LoggingConfig{Format: "xml"}},
+		{"file", config.LoggingConfig{File: filepath.Join(t.TempDir(), "missing", "agent.log")}},
+	}
+	for _, tt := range tests {
+		if closer, err := Setup(tt.cfg); err == nil {
+			closer.Close()
+			t.Errorf("%s: Setup accepted %+v", tt.name, tt.cfg)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package metrics
+
+// Agent metrics. Label values for app_key come from configured apps only, so
+// cardinality is bounded by the number of apps.
+var (
+	// Ingress
+	HTTPRequests = NewCounterVec("nexus_agent_http_requests_total",
+		"HTTP requests handled by the agent, by endpoint and status code.", "endpoint", "status")
+
+	AuthFailures = NewCounterVec("nexus_agent_auth_failures_total",
+		"Rejected local client requests by reason (unauthenticated, forbidden_app).", "reason")
+
+	RateLimited = NewCounterVec("nexus_agent_rate_limited_total",
+		"Requests rejected with 429 by limit scope (app, client).", "scope")
+
+	// Upstream delivery
+	SendDuration = NewHistogramVec("nexus_agent_send_duration_seconds",
+		"Time to deliver a message upstream, including retries.", DefaultBuckets, "app_key")
+	Sends = NewCounterVec("nexus_agent_sends_total",
+		"Upstream send operations by app and result (success, retryable, failed).", "app_key", "result")
+	UpstreamResponses = NewCounterVec("nexus_agent_upstream_responses_total",
+		"Upstream HTTP responses by status code (\"error\" for transport failures).", "code")
+	SendRetries = NewCounterVec("nexus_agent_send_retries_total",
+		"Upstream send attempts that were retried.", "app_key")
+	EndpointRequests = NewCounterVec("nexus_agent_endpoint_requests_total",
+		"Upstream requests by endpoint, kind (ingress, sync) and result (success, failure = transport error or 5xx).",
+		"endpoint", "kind", "result")
+	EndpointUp = NewGaugeVec("nexus_agent_endpoint_up",
+		"Whether an upstream endpoint is considered healthy (1) or not (0).", "endpoint")
+	EndpointLatency = NewGaugeVec("nexus_agent_endpoint_probe_latency_seconds",
+		"Smoothed round trip of health probes per upstream endpoint.", "endpoint")
+	DestinationSends = NewCounterVec("nexus_agent_destination_sends_total",
+		"Send operations by destination and result (success, failure).", "destination", "result")
+	EncryptionErrors = NewCounterVec("nexus_agent_encryption_errors_total",
+		"Payloads that could not be encrypted.", "app_key")
+
+	// Offline buffer, one per destination
+	QueueDepth = NewGaugeFunc("nexus_agent_queue_depth",
+		"Messages currently held in a destination's offline buffer.", "destination")
+	QueueOldestAge = NewGaugeFunc("nexus_agent_queue_oldest_message_age_seconds",
+		"Age of the oldest message in a destination's offline buffer (0 when empty).", "destination")
+	QueueBytes = NewGaugeFunc("nexus_agent_queue_bytes",
+		"Total payload size of messages in a destination's offline buffer.", "destination")
+	Enqueued = NewCounterVec("nexus_agent_queue_enqueued_total",
+		"Messages added to a destination's offline buffer.", "destination", "app_key")
+	Dequeued = NewCounterVec("nexus_agent_queue_dequeued_total",
+		"Messages removed from a destination's offline buffer after delivery.", "destination", "app_key")
+	EnqueueErrors = NewCounterVec("nexus_agent_queue_enqueue_errors_total",
+		"Messages that could not be added to a destination's offline buffer.", "destination", "app_key")
+	Dropped = NewCounterVec("nexus_agent_queue_dropped_total",
+		"Messages dropped or rejected by an overflow policy, by reason.", "destination", "app_key", "reason")
+	DeadLettered = NewCounterVec("nexus_agent_dead_letter_total",
+		"Messages given up on without delivery, by reason.", "destination", "app_key", "reason")
+	Quarantined = NewCounterVec("nexus_agent_queue_quarantined_total",
+		"Buffered messages moved to the quarantine because their data can't be decoded.", "destination", "app_key")
+
+	// Sync
+	Syncs = NewCounterVec("nexus_agent_sync_total",
+		"App sync attempts with the Nexus server by result (success, failure).", "result")
+	LastSyncSuccess = NewGaugeVec("nexus_agent_sync_last_success_timestamp_seconds",
+		"Unix time of the last successful app sync.")
+	SyncedApps = NewGaugeVec("nexus_agent_synced_apps",
+		"Apps received in the last successful sync.")
+)
@@ -0,0 +1,367 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds a set of metrics and renders them in the Prometheus text
+// exposition format (version 0.0.4)
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// metric is implemented by every metric type
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Default is the registry used by the agent
+var Default = &Registry{}
+
+// register adds a metric to the registry
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes all metrics in Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler returns an http.HandlerFunc serving the default registry
+func Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.WriteTo(w)
+	}
+}
+
+// desc is the common name/help/labels part of every metric
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// series is one labelled time series of a vector
+type series struct {
+	labels []string
+	value  float64
+}
+
+// vec stores series keyed by their label values
+type vec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name, help, kind string, labels []string) vec {
+	return vec{
+		desc:   desc{name: name, help: help, kind: kind, labels: labels},
+		series: make(map[string]*series),
+	}
+}
+
+// get returns the series for the given label values, creating it if needed
+// Callers must hold v.mu.
+func (v *vec) get(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) write(w *bufio.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.writeHeader(w)
+	for _, key := range sortedKeys(v.series) {
+		s := v.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labels, "", ""), formatFloat(s.value))
+	}
+}
+
+// CounterVec is a set of monotonically increasing counters
+type CounterVec struct {
+	vec
+}
+
+// NewCounterVec creates and registers a counter vector
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, "counter", labels)}
+	Default.register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta (which must be non-negative) to the counter
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if delta < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.get(values).value += delta
+	c.mu.Unlock()
+}
+
+// GaugeVec is a set of values that can go up and down
+type GaugeVec struct {
+	vec
+}
+
+// NewGaugeVec creates and registers a gauge vector
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newVec(name, help, "gauge", labels)}
+	Default.register(g)
+	return g
+}
+
+// Set sets the gauge for the given label values
+func (g *GaugeVec) Set(value float64, values ...string) {
+	g.mu.Lock()
+	g.get(values).value = value
+	g.mu.Unlock()
+}
+
+// Add adds delta to the gauge for the given label values
+func (g *GaugeVec) Add(delta float64, values ...string) {
+	g.mu.Lock()
+	g.get(values).value += delta
+	g.mu.Unlock()
+}
+
+// GaugeFunc is a gauge whose values are computed at scrape time, one
+// function per set of label values
+type GaugeFunc struct {
+	desc
+	mu  sync.Mutex
+	fns map[string]gaugeFunc
+}
+
+// gaugeFunc is one labelled series of a GaugeFunc
+type gaugeFunc struct {
+	labels []string
+	fn     func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge backed by functions
+// The functions are installed later with Set, e.g. once the queue is opened.
+func NewGaugeFunc(name, help string, labels ...string) *GaugeFunc {
+	g := &GaugeFunc{
+		desc: desc{name: name, help: help, kind: "gauge", labels: labels},
+		fns:  make(map[string]gaugeFunc),
+	}
+	Default.register(g)
+	return g
+}
+
+// Set installs the function that computes the gauge for the given label
+// values, replacing any earlier one
+func (g *GaugeFunc) Set(fn func() float64, values ...string) {
+	if len(values) != len(g.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", g.name, len(g.labels), len(values)))
+	}
+	g.mu.Lock()
+	g.fns[strings.Join(values, "\xff")] = gaugeFunc{labels: append([]string(nil), values...), fn: fn}
+	g.mu.Unlock()
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.mu.Lock()
+	keys := sortedKeys(g.fns)
+	fns := make([]gaugeFunc, len(keys))
+	for i, key := range keys {
+		fns[i] = g.fns[key]
+	}
+	g.mu.Unlock()
+	if len(fns) == 0 {
+		return
+	}
+
+	// The functions may block (e.g. on the queue), so run them unlocked
+	g.writeHeader(w)
+	for _, f := range fns {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, f.labels, "", ""), formatFloat(f.fn()))
+	}
+}
+
+// DefaultBuckets are latency buckets in seconds suited to upstream HTTP calls
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// HistogramVec is a set of histograms
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates and registers a histogram vector
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+	Default.register(h)
+	return h
+}
+
+// Observe records a value for the given label values
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	if len(values) != len(h.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", h.name, len(h.labels), len(values)))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(values, "\xff")
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{labels: append([]string(nil), values...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels, "", ""), s.count)
+	}
+}
+
+// Helpers
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders {name="value",...}, with an optional extra label
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", extraName, escapeLabel(extraValue))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+// countingWriter tracks bytes written for WriteTo
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
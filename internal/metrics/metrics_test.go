@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// render writes one metric in the text format
+func render(m metric) string {
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	m.write(w)
+	w.Flush()
+	return b.String()
+}
+
+func TestCounterVecLabels(t *testing.T) {
+	c := &CounterVec{vec: newVec("test_total", "Count.", "counter", []string{"destination", "app_key"})}
+	c.Inc("primary", "app1")
+	c.Add(2, "primary", "app1")
+	c.Add(-1, "primary", "app1")
+	c.Inc("backup", `a"b`)
+
+	want := `# HELP test_total Count.
+# TYPE test_total counter
+test_total{destination="backup",app_key="a\"b"} 1
+test_total{destination="primary",app_key="app1"} 3
+`
+	if out := render(c); out != want {
+		t.Errorf("rendered\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestGaugeVec(t *testing.T) {
+	g := &GaugeVec{vec: newVec("test_up", "Up.", "gauge", []string{"endpoint"})}
+	g.Set(1, "a")
+	g.Add(-0.5, "a")
+	g.Set(0, "b")
+
+	want := `# HELP test_up Up.
+# TYPE test_up gauge
+test_up{endpoint="a"} 0.5
+test_up{endpoint="b"} 0
+`
+	if out := render(g); out != want {
+		t.Errorf("rendered\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestGaugeFuncPerLabel(t *testing.T) {
+	g := &GaugeFunc{
+		desc: desc{name: "test_depth", help: "Depth.", kind: "gauge", labels: []string{"destination"}},
+		fns:  make(map[string]gaugeFunc),
+	}
+	if out := render(g); out != "" {
+		t.Errorf("rendered %q before any function was set, want nothing", out)
+	}
+
+	g.Set(func() float64 { return 3 }, "primary")
+	g.Set(func() float64 { return 1 }, "archive")
+	g.Set(func() float64 { return 7 }, "primary")
+
+	want := `# HELP test_depth Depth.
+# TYPE test_depth gauge
+test_depth{destination="archive"} 1
+test_depth{destination="primary"} 7
+`
+	if out := render(g); out != want {
+		t.Errorf("rendered\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestGaugeFuncLabelCount(t *testing.T) {
+	g := &GaugeFunc{
+		desc: desc{name: "test_depth", kind: "gauge", labels: []string{"destination"}},
+		fns:  make(map[string]gaugeFunc),
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Set without the destination label did not panic")
+		}
+	}()
+	g.Set(func() float64 { return 0 })
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := &HistogramVec{
+		desc:    desc{name: "test_seconds", help: "Time.", kind: "histogram", labels: []string{"app_key"}},
+		buckets: []float64{0.1, 1},
+		series:  make(map[string]*histogram),
+	}
+	h.Observe(0.05, "app1")
+	h.Observe(0.5, "app1")
+	h.Observe(2, "app1")
+
+	want := `# HELP test_seconds Time.
+# TYPE test_seconds histogram
+test_seconds_bucket{app_key="app1",le="0.1"} 1
+test_seconds_bucket{app_key="app1",le="1"} 2
+test_seconds_bucket{app_key="app1",le="+Inf"} 3
+test_seconds_sum{app_key="app1"} 2.55
+test_seconds_count{app_key="app1"} 3
+`
+	if out := render(h); out != want {
+		t.Errorf("rendered\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	c := &CounterVec{vec: newVec("test_total", "", "counter", []string{"app_key"})}
+	defer func() {
+		if recover() == nil {
+			t.Error("Inc without the app_key label did not panic")
+		}
+	}()
+	c.Inc()
+}
+
+func TestHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Handler()(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("GET: %d %q, want 200 in the text format", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), "# TYPE nexus_agent_http_requests_total counter") {
+		t.Error("agent metrics missing from the default registry")
+	}
+
+	rec = httptest.NewRecorder()
+	Handler()(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: %d, want 405", rec.Code)
+	}
+}
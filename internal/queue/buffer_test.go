@@ -0,0 +1,183 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/metrics"
+)
+
+// droppedReported reports whether a drop has been counted for appKey
+func droppedReported(t *testing.T, appKey string) bool {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := metrics.Default.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "nexus_agent_queue_dropped_total{") && strings.Contains(line, `app_key="`+appKey+`"`) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGlobalLimit(t *testing.T) {
+	ctx := context.Background()
+	forEachBackend(t, Options{MaxSize: 2}, func(t *testing.T, q Store) {
+		enqueue(t, q, &Message{AppKey: "a"})
+		enqueue(t, q, &Message{AppKey: "b"})
+
+		if _, err := q.Enqueue(ctx, &Message{AppKey: "c", Data: map[string]interface{}{"v": 1}}); !errors.Is(err, ErrFull) {
+			t.Errorf("err = %v, want ErrFull", err)
+		}
+		if size, _ := q.Size(ctx); size != 2 {
+			t.Errorf("size = %d, want 2", size)
+		}
+	})
+}
+
+func TestAppQuota(t *testing.T) {
+	ctx := context.Background()
+	quotas := map[string]Quota{
+		"strict":  {MaxMessages: 2},
+		"rolling": {MaxMessages: 2, Overflow: OverflowDropOldest},
+		"small":   {MaxBytes: 20},
+	}
+	forEachBackend(t, Options{MaxSize: 100, AppQuota: func(appKey string) Quota { return quotas[appKey] }}, func(t *testing.T, q Store) {
+
+		// Over its quota an app is rejected without touching the others
+		other := enqueue(t, q, &Message{AppKey: "other"})
+		s1 := enqueue(t, q, &Message{AppKey: "strict"})
+		s2 := enqueue(t, q, &Message{AppKey: "strict"})
+		if _, err := q.Enqueue(ctx, &Message{AppKey: "strict", Data: map[string]interface{}{"v": 1}}); !errors.Is(err, ErrFull) {
+			t.Errorf("strict: err = %v, want ErrFull", err)
+		}
+
+		// ...or has its own oldest message dropped
+		enqueue(t, q, &Message{AppKey: "rolling"})
+		r2 := enqueue(t, q, &Message{AppKey: "rolling"})
+		r3 := enqueue(t, q, &Message{AppKey: "rolling"})
+
+		// A byte quota counts the stored payload size
+		b1 := enqueue(t, q, &Message{AppKey: "small", Data: map[string]interface{}{"v": 1}})
+		if _, err := q.Enqueue(ctx, &Message{AppKey: "small", Data: map[string]interface{}{"v": "a longer value"}}); !errors.Is(err, ErrFull) {
+			t.Errorf("small: err = %v, want ErrFull", err)
+		}
+
+		want := []int64{other, s1, s2, r2, r3, b1}
+		if ids := bufferedIDs(t, q); fmt.Sprint(ids) != fmt.Sprint(want) {
+			t.Errorf("buffered %v, want %v", ids, want)
+		}
+	})
+}
+
+func TestRejectedEnqueueDropsNothing(t *testing.T) {
+	ctx := context.Background()
+	quota := Quota{MaxMessages: 1, Overflow: OverflowDropOldest}
+	opts := Options{MaxSize: 100, MaxBytes: 14, AppQuota: func(string) Quota { return quota }}
+	forEachBackend(t, opts, func(t *testing.T, q Store) {
+		appKey := "undone-" + t.Name()
+		first := enqueue(t, q, &Message{AppKey: appKey})
+
+		// The app quota would drop the first message, but the global cap
+		// then rejects the new one, so the drop never happens
+		big := &Message{AppKey: appKey, Data: map[string]interface{}{"v": "longer than the cap"}}
+		if _, err := q.Enqueue(ctx, big); !errors.Is(err, ErrFull) {
+			t.Fatalf("err = %v, want ErrFull", err)
+		}
+		if ids := bufferedIDs(t, q); fmt.Sprint(ids) != fmt.Sprint([]int64{first}) {
+			t.Errorf("buffered %v, want [%d]", ids, first)
+		}
+		if droppedReported(t, appKey) {
+			t.Error("rolled back drop was reported")
+		}
+	})
+}
+
+func TestGlobalDropOldest(t *testing.T) {
+	forEachBackend(t, Options{MaxSize: 2, Overflow: OverflowDropOldest}, func(t *testing.T, q Store) {
+		enqueue(t, q, &Message{AppKey: "a"})
+		second := enqueue(t, q, &Message{AppKey: "b"})
+		third := enqueue(t, q, &Message{AppKey: "a"})
+
+		if ids := bufferedIDs(t, q); fmt.Sprint(ids) != fmt.Sprint([]int64{second, third}) {
+			t.Errorf("buffered %v, want [%d %d]", ids, second, third)
+		}
+	})
+}
+
+func TestGlobalByteCap(t *testing.T) {
+	ctx := context.Background()
+	// Each default payload, {"v":1}, stores as 7 bytes
+	forEachBackend(t, Options{MaxSize: 100, MaxBytes: 21, Overflow: OverflowDropOldest}, func(t *testing.T, q Store) {
+		enqueue(t, q, &Message{AppKey: "a"})
+		second := enqueue(t, q, &Message{AppKey: "a"})
+		third := enqueue(t, q, &Message{AppKey: "b"})
+		fourth := enqueue(t, q, &Message{AppKey: "a"})
+
+		if ids := bufferedIDs(t, q); fmt.Sprint(ids) != fmt.Sprint([]int64{second, third, fourth}) {
+			t.Errorf("buffered %v, want [%d %d %d]", ids, second, third, fourth)
+		}
+		if bytes, err := q.Bytes(ctx); err != nil || bytes > 21 {
+			t.Errorf("Bytes() = %d, %v, want at most 21", bytes, err)
+		}
+
+		// A message that can never fit is rejected rather than emptying the queue
+		big := &Message{AppKey: "a", Data: map[string]interface{}{"v": "longer than the whole cap"}}
+		if _, err := q.Enqueue(ctx, big); !errors.Is(err, ErrFull) {
+			t.Errorf("err = %v, want ErrFull", err)
+		}
+	})
+}
+
+func TestOverflowDropLowestPriority(t *testing.T) {
+	forEachBackend(t, Options{MaxSize: 2, Overflow: OverflowDropLowestPriority}, func(t *testing.T, q Store) {
+		keep := enqueue(t, q, &Message{AppKey: "a", Priority: 1})
+		enqueue(t, q, &Message{AppKey: "a"})
+		added := enqueue(t, q, &Message{AppKey: "a", Priority: 2})
+
+		if ids := bufferedIDs(t, q); fmt.Sprint(ids) != fmt.Sprint([]int64{keep, added}) {
+			t.Errorf("buffered %v, want [%d %d]", ids, keep, added)
+		}
+	})
+}
+
+// failingJournal is a journal whose adds fail
+type failingJournal struct{ journal }
+
+func (failingJournal) add(*memEntry, []int64) error { return errors.New("disk full") }
+
+func TestFailedEnqueueKeepsVictims(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(Options{MaxSize: 1, Overflow: OverflowDropOldest})
+	first := enqueue(t, q, &Message{AppKey: "a"})
+
+	// The write that would add the new message and drop the old one fails
+	q.journal = failingJournal{}
+	if _, err := q.Enqueue(ctx, &Message{AppKey: "a", Data: map[string]interface{}{"v": 2}}); err == nil {
+		t.Fatal("enqueue succeeded with a failing journal")
+	}
+	q.journal = nil
+	if ids := bufferedIDs(t, q); fmt.Sprint(ids) != fmt.Sprint([]int64{first}) {
+		t.Errorf("buffered %v, want [%d]", ids, first)
+	}
+}
+
+func TestEnqueueKeepsCreatedAt(t *testing.T) {
+	ctx := context.Background()
+	created := time.Now().Add(-2 * time.Hour).UTC().Truncate(time.Second)
+	forEachBackend(t, Options{MaxSize: 10}, func(t *testing.T, q Store) {
+		enqueue(t, q, &Message{AppKey: "a", CreatedAt: created})
+
+		oldest, ok, err := q.Oldest(ctx)
+		if err != nil || !ok || !oldest.Equal(created) {
+			t.Errorf("Oldest() = %v, %v, %v, want %v", oldest, ok, err, created)
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package queue
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Export bundles move buffered messages between agents (see "nexus-agent
+// queue export"). A bundle is JSON lines: a BundleHeader, one
+// BundleMessage per message, and a trailer with the SHA-256 of all
+// preceding bytes. Payloads are already encrypted for Nexus, so a bundle
+// can be carried on removable media without exposing message data.
+const (
+	// BundleFormat identifies export bundles
+	BundleFormat = "nexus-agent-queue-bundle"
+	// BundleVersion is the bundle version this build writes
+	BundleVersion = 1
+)
+
+// BundleHeader is the first line of a bundle
+type BundleHeader struct {
+	Format      string    `json:"format"`
+	Version     int       `json:"version"`
+	CreatedAt   time.Time `json:"created_at"`
+	Source      string    `json:"source,omitempty"`      // Host name of the exporting agent
+	Destination string    `json:"destination,omitempty"` // Destination the payloads are encrypted for; nexus if empty
+	Messages    int       `json:"messages"`
+}
+
+// BundleMessage is one message in a bundle
+type BundleMessage struct {
+	AppKey      string                 `json:"app_key"`
+	Payload     map[string]interface{} `json:"payload"` // A crypto.EncryptedPayload
+	CreatedAt   time.Time              `json:"created_at"`
+	Priority    int                    `json:"priority,omitempty"`
+	ExpiresAt   int64                  `json:"expires_at,omitempty"` // Unix seconds, 0 = never
+	TraceParent string                 `json:"trace_parent,omitempty"`
+
+	// Sequence is the exporting agent's strict-ordering sequence number.
+	// Importing restores the apps' order from it but numbers the messages
+	// from the receiving agent's own counter, so its sequence stays
+	// increasing and gap-free.
+	Sequence int64 `json:"sequence,omitempty"`
+}
+
+// bundleTrailer is the last line of a bundle
+type bundleTrailer struct {
+	SHA256 string `json:"sha256"`
+}
+
+// WriteBundle writes a bundle of msgs; Format, Version and Messages in
+// header are filled in
+func WriteBundle(w io.Writer, header BundleHeader, msgs []BundleMessage) error {
+	header.Format = BundleFormat
+	header.Version = BundleVersion
+	header.Messages = len(msgs)
+
+	hash := sha256.New()
+	enc := json.NewEncoder(io.MultiWriter(w, hash))
+	if err := enc.Encode(header); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			return fmt.Errorf("failed to write bundle: %w", err)
+		}
+	}
+	trailer := bundleTrailer{SHA256: hex.EncodeToString(hash.Sum(nil))}
+	if err := json.NewEncoder(w).Encode(trailer); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return nil
+}
+
+// ReadBundle reads and verifies a bundle. Nothing is returned unless the
+// checksum and message count match.
+func ReadBundle(r io.Reader) (BundleHeader, []BundleMessage, error) {
+	var header BundleHeader
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return header, nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+
+	// Split off the trailer line
+	body := bytes.TrimSuffix(data, []byte("\n"))
+	cut := bytes.LastIndexByte(body, '\n')
+	if cut < 0 {
+		return header, nil, errors.New("not a queue bundle: missing trailer")
+	}
+	body, last := data[:cut+1], body[cut+1:]
+	var trailer bundleTrailer
+	if err := json.Unmarshal(last, &trailer); err != nil || trailer.SHA256 == "" {
+		return header, nil, errors.New("not a queue bundle: missing trailer")
+	}
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != trailer.SHA256 {
+		return header, nil, errors.New("bundle checksum mismatch: the file is damaged or incomplete")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if err := dec.Decode(&header); err != nil || header.Format != BundleFormat {
+		return header, nil, errors.New("not a queue bundle: bad header")
+	}
+	if header.Version > BundleVersion {
+		return header, nil, fmt.Errorf("bundle version %d is newer than supported version %d", header.Version, BundleVersion)
+	}
+	// The checksum isn't keyed, so the header is no more trusted than the
+	// rest of the file
+	if header.Messages < 0 {
+		return header, nil, fmt.Errorf("invalid bundle message count %d", header.Messages)
+	}
+
+	var msgs []BundleMessage
+	for dec.More() {
+		var msg BundleMessage
+		if err := dec.Decode(&msg); err != nil {
+			return header, nil, fmt.Errorf("invalid bundle message %d: %w", len(msgs)+1, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) != header.Messages {
+		return header, nil, fmt.Errorf("bundle has %d messages, header says %d", len(msgs), header.Messages)
+	}
+	return header, msgs, nil
+}
+
+// OrderBundleBySequence puts each app's sequenced messages back in sequence
+// order. They keep the positions the app's sequenced messages had in msgs,
+// so other messages and other apps are not moved.
+func OrderBundleBySequence(msgs []BundleMessage) {
+	positions := make(map[string][]int)
+	for i, msg := range msgs {
+		if msg.Sequence > 0 {
+			positions[msg.AppKey] = append(positions[msg.AppKey], i)
+		}
+	}
+	for _, idx := range positions {
+		sequenced := make([]BundleMessage, len(idx))
+		for i, at := range idx {
+			sequenced[i] = msgs[at]
+		}
+		sort.SliceStable(sequenced, func(i, j int) bool { return sequenced[i].Sequence < sequenced[j].Sequence })
+		for i, at := range idx {
+			msgs[at] = sequenced[i]
+		}
+	}
+}
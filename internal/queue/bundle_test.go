@@ -0,0 +1,96 @@
+package queue
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBundle writes a bundle of msgs and returns its bytes
+func testBundle(t *testing.T, msgs []BundleMessage) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteBundle(&buf, BundleHeader{CreatedAt: time.Now(), Source: "test"}, msgs); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// forgeBundle builds a bundle from raw lines with a matching trailer, as
+// anyone can since the checksum isn't keyed
+func forgeBundle(lines ...string) []byte {
+	body := strings.Join(lines, "\n") + "\n"
+	sum := sha256.Sum256([]byte(body))
+	return []byte(body + fmt.Sprintf("{\"sha256\":%q}\n", hex.EncodeToString(sum[:])))
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	msgs := []BundleMessage{
+		{AppKey: "a", Payload: map[string]interface{}{"v": "1"}, Priority: 2, Sequence: 7},
+		{AppKey: "b", Payload: map[string]interface{}{"v": "2"}, ExpiresAt: 1700000000},
+	}
+	header, got, err := ReadBundle(bytes.NewReader(testBundle(t, msgs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Format != BundleFormat || header.Messages != 2 || header.Source != "test" {
+		t.Errorf("header = %+v", header)
+	}
+	if len(got) != 2 || got[0].Sequence != 7 || got[0].Priority != 2 || got[1].ExpiresAt != 1700000000 {
+		t.Errorf("messages = %+v", got)
+	}
+}
+
+func TestBundleRejected(t *testing.T) {
+	valid := testBundle(t, []BundleMessage{{AppKey: "a"}})
+	damaged := append([]byte(nil), valid...)
+	damaged[20] ^= 0x01
+	header := `{"format":"nexus-agent-queue-bundle","version":1,"created_at":"2026-01-01T00:00:00Z","messages":%d}`
+	msg := `{"app_key":"a","payload":{},"created_at":"2026-01-01T00:00:00Z"}`
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"damaged", damaged, "checksum mismatch"},
+		{"truncated", valid[:len(valid)-5], "missing trailer"},
+		{"negative count", forgeBundle(fmt.Sprintf(header, -1), msg), "invalid bundle message count"},
+		{"huge count", forgeBundle(fmt.Sprintf(header, 1<<40), msg), "header says"},
+		{"count mismatch", forgeBundle(fmt.Sprintf(header, 2), msg), "bundle has 1 messages, header says 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, msgs, err := ReadBundle(bytes.NewReader(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+			if msgs != nil {
+				t.Errorf("returned %d messages with an error", len(msgs))
+			}
+		})
+	}
+}
+
+func TestOrderBundleBySequence(t *testing.T) {
+	msgs := []BundleMessage{
+		{AppKey: "a", Sequence: 3},
+		{AppKey: "b", Priority: 1},
+		{AppKey: "a", Sequence: 1},
+		{AppKey: "c", Sequence: 9},
+		{AppKey: "a", Sequence: 2},
+	}
+	OrderBundleBySequence(msgs)
+
+	var got []string
+	for _, msg := range msgs {
+		got = append(got, fmt.Sprintf("%s%d", msg.AppKey, msg.Sequence))
+	}
+	if want := "a1 b0 a2 c9 a3"; strings.Join(got, " ") != want {
+		t.Errorf("order = %s, want %s", strings.Join(got, " "), want)
+	}
+}
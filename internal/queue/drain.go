@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"sort"
+	"sync"
+)
+
+// DrainPolicy decides which app's messages are delivered next
+type DrainPolicy string
+
+const (
+	// DrainFIFO always serves the globally oldest message
+	DrainFIFO DrainPolicy = "fifo"
+	// DrainRoundRobin serves apps with pending messages in turn
+	DrainRoundRobin DrainPolicy = "round_robin"
+	// DrainWeighted serves apps in proportion to their quota weight
+	DrainWeighted DrainPolicy = "weighted"
+)
+
+// scheduler picks the next app to drain
+type scheduler struct {
+	policy DrainPolicy
+
+	mu      sync.Mutex
+	last    string         // round robin cursor
+	current map[string]int // smooth weighted round robin state
+}
+
+func newScheduler(policy DrainPolicy) *scheduler {
+	if policy == "" {
+		policy = DrainFIFO
+	}
+	return &scheduler{
+		policy:  policy,
+		current: make(map[string]int),
+	}
+}
+
+// next returns the app to serve from those with pending messages
+func (s *scheduler) next(apps []string, weight func(string) int) string {
+	if len(apps) == 0 {
+		return ""
+	}
+	sort.Strings(apps)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.policy == DrainWeighted {
+		return s.nextWeighted(apps, weight)
+	}
+
+	// Round robin: first app after the one served last
+	for _, app := range apps {
+		if app > s.last {
+			s.last = app
+			return app
+		}
+	}
+	s.last = apps[0]
+	return apps[0]
+}
+
+// nextWeighted implements smooth weighted round robin: every pending app
+// gains its weight, the app with the highest total is served and pays back
+// the sum of all weights. Over a round each app is served weight times,
+// interleaved rather than in bursts.
+func (s *scheduler) nextWeighted(apps []string, weight func(string) int) string {
+	pending := make(map[string]bool, len(apps))
+	total := 0
+	best := ""
+	for _, app := range apps {
+		pending[app] = true
+		w := weight(app)
+		total += w
+		s.current[app] += w
+		if best == "" || s.current[app] > s.current[best] {
+			best = app
+		}
+	}
+	s.current[best] -= total
+
+	// Forget apps that have drained so they don't carry stale credit
+	for app := range s.current {
+		if !pending[app] {
+			delete(s.current, app)
+		}
+	}
+	return best
+}
@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	s := newScheduler(DrainRoundRobin)
+	var served []string
+	for _, apps := range [][]string{{"c", "a", "b"}, {"a", "b", "c"}, {"a", "b", "c"}, {"a", "c"}, {"a", "c"}} {
+		served = append(served, s.next(apps, nil))
+	}
+	if got := strings.Join(served, ""); got != "abcac" {
+		t.Errorf("served %s, want abcac", got)
+	}
+	if app := s.next(nil, nil); app != "" {
+		t.Errorf("served %q with nothing pending", app)
+	}
+}
+
+func TestSchedulerWeighted(t *testing.T) {
+	s := newScheduler(DrainWeighted)
+	weights := map[string]int{"a": 3, "b": 1}
+	weight := func(app string) int { return weights[app] }
+
+	served := make(map[string]int)
+	var order []string
+	for i := 0; i < 8; i++ {
+		app := s.next([]string{"a", "b"}, weight)
+		served[app]++
+		order = append(order, app)
+	}
+	if served["a"] != 6 || served["b"] != 2 {
+		t.Errorf("served %v, want a 6 times and b twice", served)
+	}
+	// b isn't left waiting for a whole round of a
+	if strings.Contains(strings.Join(order, ""), "aaaa") {
+		t.Errorf("served %v, want a's turns interleaved with b's", order)
+	}
+}
+
+func TestDrainPolicies(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		policy  DrainPolicy
+		weightA int
+		want    string
+	}{
+		{"fifo", DrainFIFO, 0, "aaaabb"},
+		{"round robin", DrainRoundRobin, 0, "ababaa"},
+		{"weighted evenly", DrainWeighted, 0, "ababaa"},
+		{"weighted", DrainWeighted, 2, "abaaba"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{MaxSize: 100, Drain: tt.policy, Ordering: OrderingUnordered}
+			opts.AppQuota = func(appKey string) Quota {
+				if appKey == "a" {
+					return Quota{Weight: tt.weightA}
+				}
+				return Quota{}
+			}
+			forEachBackend(t, opts, func(t *testing.T, q Store) {
+				for _, app := range []string{"a", "a", "a", "a", "b", "b"} {
+					enqueue(t, q, &Message{AppKey: app})
+				}
+
+				// Deliver one message at a time and note whose it was
+				var served strings.Builder
+				for {
+					msgs, err := q.Lease(ctx, 1, time.Minute)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(msgs) == 0 {
+						break
+					}
+					served.WriteString(msgs[0].AppKey)
+					if err := q.Ack(ctx, msgs[0].ID); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if got := served.String(); got != tt.want {
+					t.Errorf("served %s, want %s", got, tt.want)
+				}
+			})
+		})
+	}
+}
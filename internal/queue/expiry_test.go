@@ -0,0 +1,156 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	ctx := context.Background()
+	for _, policy := range []ExpiryPolicy{ExpireDrop, ExpireDeadLetter} {
+		t.Run(string(policy), func(t *testing.T) {
+			forEachBackend(t, Options{MaxSize: 100, Expiry: policy, Ordering: OrderingUnordered}, func(t *testing.T, q Store) {
+				stale := enqueue(t, q, &Message{AppKey: "a", ExpiresAt: time.Now().Add(-time.Second)})
+				live := enqueue(t, q, &Message{AppKey: "a", ExpiresAt: time.Now().Add(time.Hour)})
+				forever := enqueue(t, q, &Message{AppKey: "a"})
+
+				// An expired message is never handed out, even before Expire runs
+				if ids := leaseIDs(t, q, 10); fmt.Sprint(ids) != fmt.Sprint([]int64{live, forever}) {
+					t.Errorf("leased %v, want [%d %d]", ids, live, forever)
+				}
+
+				n, err := q.Expire(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != 1 {
+					t.Errorf("expired %d messages, want 1", n)
+				}
+				if ids := bufferedIDs(t, q); fmt.Sprint(ids) != fmt.Sprint([]int64{live, forever}) {
+					t.Errorf("buffered %v, want [%d %d]", ids, live, forever)
+				}
+
+				var dead []int64
+				if err := q.DeadLetters(ctx, func(dl *DeadLetter) error {
+					if dl.Reason != "expired" {
+						t.Errorf("reason = %q, want expired", dl.Reason)
+					}
+					dead = append(dead, dl.ID)
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if policy == ExpireDeadLetter && fmt.Sprint(dead) != fmt.Sprint([]int64{stale}) {
+					t.Errorf("dead letters %v, want [%d]", dead, stale)
+				} else if policy == ExpireDrop && len(dead) != 0 {
+					t.Errorf("dead letters %v, want none", dead)
+				}
+			})
+		})
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	forEachBackend(t, Options{MaxSize: 1}, func(t *testing.T, q Store) {
+		id := enqueue(t, q, &Message{AppKey: "a", Priority: 3})
+		if err := q.DeadLetter(ctx, id, "permanent_error"); err != nil {
+			t.Fatal(err)
+		}
+
+		// A dead letter no longer takes up room in the buffer
+		next := enqueue(t, q, &Message{AppKey: "a"})
+		if ids := bufferedIDs(t, q); fmt.Sprint(ids) != fmt.Sprint([]int64{next}) {
+			t.Errorf("buffered %v, want [%d]", ids, next)
+		}
+
+		var dead []*DeadLetter
+		if err := q.DeadLetters(ctx, func(dl *DeadLetter) error {
+			dead = append(dead, dl)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(dead) != 1 || dead[0].ID != id || dead[0].Reason != "permanent_error" || dead[0].Priority != 3 || dead[0].Data["v"] != 1.0 {
+			t.Errorf("dead letters = %+v, want message %d with reason permanent_error", dead, id)
+		}
+	})
+}
+
+func TestTrimDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		max       int
+		retention time.Duration
+		left      int // Newest dead letters kept
+	}{
+		{"unlimited", 0, 0, 4},
+		{"max", 2, 0, 2},
+		{"retention", 0, time.Nanosecond, 0},
+		{"recent", 3, time.Hour, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, Options{MaxSize: 10}, func(t *testing.T, q Store) {
+				var ids []int64
+				for i := 0; i < 4; i++ {
+					id := enqueue(t, q, &Message{AppKey: "a"})
+					if err := q.DeadLetter(ctx, id, "max_attempts"); err != nil {
+						t.Fatal(err)
+					}
+					ids = append(ids, id)
+				}
+				time.Sleep(time.Millisecond)
+
+				removed, err := TrimDeadLetters(ctx, q, tt.max, tt.retention)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if removed != len(ids)-tt.left {
+					t.Errorf("removed %d, want %d", removed, len(ids)-tt.left)
+				}
+				var left []int64
+				if err := q.DeadLetters(ctx, func(dl *DeadLetter) error {
+					left = append(left, dl.ID)
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if want := ids[len(ids)-tt.left:]; fmt.Sprint(left) != fmt.Sprint(want) {
+					t.Errorf("dead letters left = %v, want %v", left, want)
+				}
+			})
+		})
+	}
+}
+
+func TestRemoveDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	forEachBackend(t, Options{MaxSize: 10}, func(t *testing.T, q Store) {
+		var ids []int64
+		for i := 0; i < 3; i++ {
+			id := enqueue(t, q, &Message{AppKey: "a"})
+			if err := q.DeadLetter(ctx, id, "max_attempts"); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		if err := q.RemoveDeadLetters(ctx, []int64{ids[0], ids[2]}); err != nil {
+			t.Fatal(err)
+		}
+
+		var left []int64
+		if err := q.DeadLetters(ctx, func(dl *DeadLetter) error {
+			left = append(left, dl.ID)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(left) != fmt.Sprint(ids[1:2]) {
+			t.Errorf("dead letters after removal = %v, want %v", left, ids[1:2])
+		}
+	})
+}
@@ -0,0 +1,675 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileStore is a MemoryStore persisted to an append-only log of segment
+// files in a directory. Every change is appended as a checksummed record;
+// on startup the segments are replayed to rebuild the buffer.
+//
+// A new segment is started when the current one reaches SegmentSize, and
+// whenever the store is opened. Each segment begins with a checkpoint of
+// the ID and sequence counters. Segments at the head of the log are deleted
+// once none of their messages are buffered any more; live messages in the
+// oldest segment are copied forward when a new segment starts, so a few
+// long-lived messages don't pin the whole log.
+//
+// Dead letters are kept apart from the log, in dead_letters.jsonl.
+//
+// A torn record at the end of the newest segment (a crash mid-write) is
+// truncated away on startup. A damaged record anywhere else ends the replay
+// of its segment; the messages read so far are rewritten to the new segment
+// and the damaged one is moved to the quarantine subdirectory. Removals
+// lost with it may lead to messages being delivered twice. Truncated tails
+// and messages whose data can't be decoded are kept there as well. Under
+// CorruptionFail only a torn tail is repaired; other damage makes NewFile
+// return ErrCorrupt and leaves the log untouched.
+type FileStore struct {
+	*MemoryStore
+}
+
+// Log records
+const (
+	opAdd        = "add"
+	opRemove     = "remove"
+	opAttempt    = "attempt"
+	opSequence   = "sequence"
+	opCheckpoint = "checkpoint"
+)
+
+// logRecord is one change in the file log
+type logRecord struct {
+	Op          string           `json:"op"`
+	ID          int64            `json:"id,omitempty"`
+	AppKey      string           `json:"app_key,omitempty"`
+	Data        json.RawMessage  `json:"data,omitempty"`
+	CreatedAt   time.Time        `json:"created_at,omitempty"`
+	Attempts    int              `json:"attempts,omitempty"`
+	TraceParent string           `json:"trace_parent,omitempty"`
+	Priority    int              `json:"priority,omitempty"`
+	ExpiresAt   int64            `json:"expires_at,omitempty"` // Unix seconds
+	Sequence    int64            `json:"sequence,omitempty"`
+	Encrypted   bool             `json:"encrypted,omitempty"`
+	Evicted     []int64          `json:"evicted,omitempty"`   // Add only: messages dropped to make room
+	NextID      int64            `json:"next_id,omitempty"`   // Checkpoint only
+	Sequences   map[string]int64 `json:"sequences,omitempty"` // Checkpoint only
+}
+
+// Each record is framed as a 4-byte length and a 4-byte CRC-32C of the
+// payload (both big-endian), followed by the JSON payload
+const frameHeaderSize = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// maxRecordSize bounds the length field so a corrupt header can't cause a
+// huge allocation
+const maxRecordSize = 64 << 20
+
+// NewFile opens or creates a file log store in dir
+func NewFile(dir string, opts Options) (*FileStore, error) {
+	opts = opts.withDefaults()
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	store := NewMemory(opts)
+	log := &segmentLog{
+		dir:           dir,
+		sync:          opts.Synchronous == "full",
+		maxSize:       opts.SegmentSize,
+		failOnCorrupt: opts.Corruption == CorruptionFail,
+		store:         store,
+		live:          make(map[int64]int),
+		segOf:         make(map[int64]int64),
+	}
+	if err := log.replay(); err != nil {
+		return nil, err
+	}
+	if err := log.roll(); err != nil {
+		return nil, err
+	}
+	if err := log.rescue(); err != nil {
+		return nil, err
+	}
+	if err := log.loadDeadLetters(); err != nil {
+		return nil, err
+	}
+	store.journal = log
+
+	slog.Info("Opened file queue", "dir", dir, "messages", store.total.count, "segments", len(log.segments))
+	return &FileStore{MemoryStore: store}, nil
+}
+
+// segmentLog is the journal behind a FileStore
+// All methods are called with the store's lock held.
+type segmentLog struct {
+	dir           string
+	sync          bool
+	maxSize       int64
+	failOnCorrupt bool // Return ErrCorrupt instead of quarantining
+	store         *MemoryStore
+
+	f        *os.File
+	active   int64   // Number of the segment being written
+	written  int64   // Bytes written to the active segment
+	segments []int64 // Existing segment numbers, oldest first
+	damaged  []int64 // Segments found damaged during replay
+	err      error   // Last write error, reported by ping
+
+	live  map[int64]int   // Segment -> buffered messages added in it
+	segOf map[int64]int64 // Message ID -> segment holding its latest add
+}
+
+func (l *segmentLog) add(e *memEntry, evicted []int64) error {
+	rec := addRecord(e)
+	rec.Evicted = evicted
+	if err := l.write(rec); err != nil {
+		return err
+	}
+	l.track(e.msg.ID, l.active)
+	if len(evicted) > 0 {
+		for _, id := range evicted {
+			l.untrack(id)
+		}
+		l.collect()
+	}
+	return nil
+}
+
+func (l *segmentLog) remove(id int64) error {
+	if err := l.write(logRecord{Op: opRemove, ID: id}); err != nil {
+		return err
+	}
+	l.untrack(id)
+	l.collect()
+	return nil
+}
+
+func (l *segmentLog) attempt(id int64, attempts int) error {
+	return l.write(logRecord{Op: opAttempt, ID: id, Attempts: attempts})
+}
+
+func (l *segmentLog) sequence(appKey string, seq int64) error {
+	return l.write(logRecord{Op: opSequence, AppKey: appKey, Sequence: seq})
+}
+
+func (l *segmentLog) deadLetter(d *deadEntry) error {
+	line, err := json.Marshal(deadLetterRecord{
+		logRecord:      addRecord(&d.memEntry),
+		Reason:         d.reason,
+		DeadLetteredAt: d.at,
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.deadLettersPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil && l.sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// removeDeadLetters rewrites the dead letters file with the remaining ones
+func (l *segmentLog) removeDeadLetters(remaining []*deadEntry) error {
+	var buf []byte
+	for _, d := range remaining {
+		line, err := json.Marshal(deadLetterRecord{logRecord: addRecord(&d.memEntry), Reason: d.reason, DeadLetteredAt: d.at})
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	tmp := l.deadLettersPath() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.deadLettersPath())
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// loadDeadLetters reads the dead letters file into the store. A message
+// still in the log was being dead-lettered when the agent stopped; its
+// removal is completed now.
+func (l *segmentLog) loadDeadLetters() error {
+	data, err := os.ReadFile(l.deadLettersPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	s := l.store
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var rec deadLetterRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			// A line torn by a crash; the message is still in the log
+			slog.Warn("Skipping unreadable dead letter", "file", l.deadLettersPath(), "line", i+1, "error", err)
+			continue
+		}
+		d := &deadEntry{memEntry: *entryFromRecord(rec.logRecord), reason: rec.Reason, at: rec.DeadLetteredAt}
+		s.dead[d.msg.ID] = d
+		// IDs aren't reused, even if the log no longer records them
+		if d.msg.ID > s.nextID {
+			s.nextID = d.msg.ID
+		}
+
+		if _, ok := s.msgs[d.msg.ID]; ok {
+			if err := l.remove(d.msg.ID); err != nil {
+				return err
+			}
+			s.delete(d.msg.ID)
+		}
+	}
+	return nil
+}
+
+func (l *segmentLog) quarantine(e *memEntry, reason string) error {
+	line, err := json.Marshal(quarantinedRecord{
+		logRecord:     addRecord(e),
+		Reason:        reason,
+		QuarantinedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return l.appendQuarantine("messages.jsonl", append(line, '\n'))
+}
+
+func (l *segmentLog) ping() error {
+	if l.err != nil {
+		return l.err
+	}
+	_, err := os.Stat(l.path(l.active))
+	return err
+}
+
+func (l *segmentLog) close() error {
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+// deadLetterRecord is a line of the dead letters file
+type deadLetterRecord struct {
+	logRecord
+	Reason         string    `json:"reason"`
+	DeadLetteredAt time.Time `json:"dead_lettered_at"`
+}
+
+// quarantinedRecord is a message moved to the quarantine
+type quarantinedRecord struct {
+	logRecord
+	Reason        string    `json:"reason"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// addRecord describes an entry's full current state
+func addRecord(e *memEntry) logRecord {
+	rec := logRecord{
+		Op:          opAdd,
+		ID:          e.msg.ID,
+		AppKey:      e.msg.AppKey,
+		Data:        e.data,
+		CreatedAt:   e.msg.CreatedAt,
+		Attempts:    e.msg.Attempts,
+		TraceParent: e.msg.TraceParent,
+		Priority:    e.msg.Priority,
+		Sequence:    e.msg.Sequence,
+		Encrypted:   e.msg.Encrypted,
+	}
+	if !e.msg.ExpiresAt.IsZero() {
+		rec.ExpiresAt = e.msg.ExpiresAt.Unix()
+	}
+	return rec
+}
+
+// write appends a record, starting a new segment first if it wouldn't fit
+func (l *segmentLog) write(rec logRecord) error {
+	frame, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	if l.written > 0 && l.written+int64(len(frame)) > l.maxSize {
+		if err := l.roll(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := l.f.Write(frame); err != nil {
+		l.err = fmt.Errorf("failed to write queue log: %w", err)
+		return l.err
+	}
+	if l.sync {
+		if err := l.f.Sync(); err != nil {
+			l.err = fmt.Errorf("failed to sync queue log: %w", err)
+			return l.err
+		}
+	}
+	l.written += int64(len(frame))
+	l.err = nil
+	return nil
+}
+
+// roll closes the active segment and starts a new one with a checkpoint,
+// then copies forward the live messages of the oldest segment so it can be
+// deleted
+func (l *segmentLog) roll() error {
+	if err := l.close(); err != nil {
+		return fmt.Errorf("failed to close queue segment: %w", err)
+	}
+
+	next := l.active + 1
+	f, err := os.OpenFile(l.path(next), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		l.err = fmt.Errorf("failed to create queue segment: %w", err)
+		return l.err
+	}
+	l.f = f
+	l.active = next
+	l.written = 0
+	l.segments = append(l.segments, next)
+
+	sequences := make(map[string]int64, len(l.store.sequences))
+	for appKey, seq := range l.store.sequences {
+		sequences[appKey] = seq
+	}
+	if err := l.write(logRecord{Op: opCheckpoint, NextID: l.store.nextID, Sequences: sequences}); err != nil {
+		return err
+	}
+
+	if len(l.segments) > 1 {
+		oldest := l.segments[0]
+		for id, seg := range l.segOf {
+			if seg != oldest {
+				continue
+			}
+			if err := l.write(addRecord(l.store.msgs[id])); err != nil {
+				return err
+			}
+			l.track(id, l.active)
+		}
+	}
+	l.collect()
+	return nil
+}
+
+// collect deletes segments at the head of the log that hold no buffered
+// messages. Damaged segments are left for rescue to move aside.
+func (l *segmentLog) collect() {
+	for len(l.segments) > 1 && l.segments[0] != l.active && l.live[l.segments[0]] == 0 {
+		oldest := l.segments[0]
+		if slices.Contains(l.damaged, oldest) {
+			return
+		}
+		if err := os.Remove(l.path(oldest)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to delete queue segment", "segment", l.path(oldest), "error", err)
+			return
+		}
+		delete(l.live, oldest)
+		l.segments = l.segments[1:]
+	}
+}
+
+// rescue rewrites the buffered messages of damaged segments to the active
+// segment and moves the damaged segments to the quarantine
+func (l *segmentLog) rescue() error {
+	for _, seg := range l.damaged {
+		for id, at := range l.segOf {
+			if at != seg {
+				continue
+			}
+			if err := l.write(addRecord(l.store.msgs[id])); err != nil {
+				return err
+			}
+			l.track(id, l.active)
+		}
+
+		if err := os.MkdirAll(l.quarantineDir(), 0o750); err != nil {
+			return fmt.Errorf("failed to create quarantine directory: %w", err)
+		}
+		dst := filepath.Join(l.quarantineDir(), filepath.Base(l.path(seg)))
+		if err := os.Rename(l.path(seg), dst); err != nil {
+			return fmt.Errorf("failed to quarantine queue segment: %w", err)
+		}
+		slog.Error("Moved damaged queue segment to quarantine", "segment", dst)
+
+		delete(l.live, seg)
+		for i, s := range l.segments {
+			if s == seg {
+				l.segments = append(l.segments[:i], l.segments[i+1:]...)
+				break
+			}
+		}
+	}
+	l.damaged = nil
+	l.collect()
+	return nil
+}
+
+// appendQuarantine appends data to a file in the quarantine directory
+func (l *segmentLog) appendQuarantine(name string, data []byte) error {
+	if err := os.MkdirAll(l.quarantineDir(), 0o750); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(l.quarantineDir(), name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// quarantineDir returns the directory damaged data is moved to
+func (l *segmentLog) quarantineDir() string {
+	return filepath.Join(l.dir, "quarantine")
+}
+
+// track records that message id was (re)written to seg
+func (l *segmentLog) track(id, seg int64) {
+	if old, ok := l.segOf[id]; ok {
+		l.live[old]--
+	}
+	l.segOf[id] = seg
+	l.live[seg]++
+}
+
+// untrack forgets a removed message
+func (l *segmentLog) untrack(id int64) {
+	if seg, ok := l.segOf[id]; ok {
+		l.live[seg]--
+		delete(l.segOf, id)
+	}
+}
+
+// deadLettersPath returns the file dead letters are kept in
+func (l *segmentLog) deadLettersPath() string {
+	return filepath.Join(l.dir, "dead_letters.jsonl")
+}
+
+// path returns the file name of a segment
+func (l *segmentLog) path(seg int64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%016d.log", seg))
+}
+
+// replay rebuilds the store from the existing segments
+func (l *segmentLog) replay() error {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read queue directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		seg, err := strconv.ParseInt(strings.TrimSuffix(name, ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, seg)
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i] < l.segments[j] })
+
+	for i, seg := range l.segments {
+		last := i == len(l.segments)-1
+		if err := l.replaySegment(seg, last); err != nil {
+			return err
+		}
+		l.active = seg
+	}
+	return nil
+}
+
+// replaySegment applies the records of one segment
+// A damaged record ends the segment: at the end of the newest segment it is
+// a torn write and is truncated away (keeping a copy in the quarantine),
+// elsewhere the segment is marked for rescue. With failOnCorrupt, only an
+// incomplete last record is truncated and other damage is ErrCorrupt.
+func (l *segmentLog) replaySegment(seg int64, last bool) error {
+	path := l.path(seg)
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read queue segment: %w", err)
+	}
+
+	offset := 0
+	for offset < len(buf) {
+		rec, n, err := decodeRecord(buf[offset:])
+		if err != nil {
+			if l.failOnCorrupt && !(last && errors.Is(err, errTornRecord)) {
+				return fmt.Errorf("%w: queue segment %s at offset %d: %v", ErrCorrupt, path, offset, err)
+			}
+			if last {
+				slog.Warn("Truncating incomplete record at end of queue log",
+					"segment", path, "offset", offset, "error", err)
+				name := fmt.Sprintf("%016d.tail", seg)
+				if err := l.appendQuarantine(name, buf[offset:]); err != nil {
+					return fmt.Errorf("failed to quarantine queue segment tail: %w", err)
+				}
+				if err := os.Truncate(path, int64(offset)); err != nil {
+					return fmt.Errorf("failed to truncate queue segment: %w", err)
+				}
+			} else {
+				slog.Error("Queue segment is damaged; skipping the rest of it",
+					"segment", path, "offset", offset, "bytes", len(buf)-offset, "error", err)
+				l.damaged = append(l.damaged, seg)
+			}
+			return nil
+		}
+		l.apply(rec, seg)
+		offset += n
+	}
+	return nil
+}
+
+// apply replays one record into the store
+func (l *segmentLog) apply(rec logRecord, seg int64) {
+	s := l.store
+	switch rec.Op {
+	case opAdd:
+		for _, id := range rec.Evicted {
+			s.delete(id)
+			l.untrack(id)
+		}
+		// A message copied forward replaces its earlier copy
+		s.delete(rec.ID)
+		s.insert(entryFromRecord(rec))
+		l.track(rec.ID, seg)
+		if rec.ID > s.nextID {
+			s.nextID = rec.ID
+		}
+		if rec.Sequence > s.sequences[rec.AppKey] {
+			s.sequences[rec.AppKey] = rec.Sequence
+		}
+	case opRemove:
+		s.delete(rec.ID)
+		l.untrack(rec.ID)
+	case opAttempt:
+		if e, ok := s.msgs[rec.ID]; ok {
+			e.msg.Attempts = rec.Attempts
+		}
+	case opSequence:
+		if rec.Sequence > s.sequences[rec.AppKey] {
+			s.sequences[rec.AppKey] = rec.Sequence
+		}
+	case opCheckpoint:
+		if rec.NextID > s.nextID {
+			s.nextID = rec.NextID
+		}
+		for appKey, seq := range rec.Sequences {
+			if seq > s.sequences[appKey] {
+				s.sequences[appKey] = seq
+			}
+		}
+	}
+}
+
+// entryFromRecord rebuilds an entry from an add record
+func entryFromRecord(rec logRecord) *memEntry {
+	e := &memEntry{
+		msg: Message{
+			ID:          rec.ID,
+			AppKey:      rec.AppKey,
+			CreatedAt:   rec.CreatedAt,
+			Attempts:    rec.Attempts,
+			TraceParent: rec.TraceParent,
+			Priority:    rec.Priority,
+			Sequence:    rec.Sequence,
+			Encrypted:   rec.Encrypted,
+		},
+		data: rec.Data,
+	}
+	if rec.ExpiresAt > 0 {
+		e.msg.ExpiresAt = time.Unix(rec.ExpiresAt, 0)
+	}
+	return e
+}
+
+// encodeRecord frames a record for the log
+func encodeRecord(rec logRecord) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode queue record: %w", err)
+	}
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	copy(frame[frameHeaderSize:], payload)
+	return frame, nil
+}
+
+// errTornRecord is returned (wrapped) by decodeRecord for a record cut
+// short, as left by a crash in the middle of a write
+var errTornRecord = errors.New("incomplete record")
+
+// decodeRecord reads one framed record and returns it with its total length
+func decodeRecord(buf []byte) (logRecord, int, error) {
+	var rec logRecord
+	if len(buf) < frameHeaderSize {
+		return rec, 0, fmt.Errorf("%w: short header", errTornRecord)
+	}
+	length := binary.BigEndian.Uint32(buf[0:4])
+	if length > maxRecordSize {
+		return rec, 0, fmt.Errorf("record length %d is too large", length)
+	}
+	end := frameHeaderSize + int(length)
+	if len(buf) < end {
+		return rec, 0, fmt.Errorf("%w: %d of %d bytes", errTornRecord, len(buf)-frameHeaderSize, length)
+	}
+	payload := buf[frameHeaderSize:end]
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(buf[4:8]) {
+		return rec, 0, errors.New("checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, 0, fmt.Errorf("invalid record: %w", err)
+	}
+	return rec, end, nil
+}
@@ -0,0 +1,252 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestRecordFraming(t *testing.T) {
+	rec := logRecord{Op: opAdd, ID: 7, AppKey: "app", Data: []byte(`{"v":1}`), Priority: 3}
+	frame, err := encodeRecord(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, n, err := decodeRecord(append(frame, 0xff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(frame) || got.ID != 7 || got.AppKey != "app" || got.Priority != 3 || string(got.Data) != `{"v":1}` {
+		t.Errorf("decoded %+v (%d bytes), want the record back (%d bytes)", got, n, len(frame))
+	}
+
+	// Any flipped payload bit fails the CRC
+	for i := frameHeaderSize; i < len(frame); i++ {
+		damaged := append([]byte(nil), frame...)
+		damaged[i] ^= 0x01
+		if _, _, err := decodeRecord(damaged); err == nil {
+			t.Fatalf("byte %d flipped: decoded without error", i)
+		}
+	}
+
+	// A record cut short anywhere is rejected
+	for _, cut := range []int{0, 3, frameHeaderSize, len(frame) - 1} {
+		if _, _, err := decodeRecord(frame[:cut]); err == nil {
+			t.Errorf("cut at %d: decoded without error", cut)
+		}
+	}
+}
+
+func TestFileTornTailTruncated(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewFile(dir, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := enqueue(t, q, &Message{AppKey: "a"})
+	enqueue(t, q, &Message{AppKey: "a"})
+	q.Close()
+
+	// Cut the last record in half, as a crash mid-write would
+	segs := segmentFiles(t, dir)
+	last := segs[len(segs)-1]
+	info, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = NewFile(dir, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if ids := bufferedIDs(t, q); len(ids) != 1 || ids[0] != kept {
+		t.Errorf("buffered %v, want [%d]", ids, kept)
+	}
+	// The next record after the truncation point is readable
+	id := enqueue(t, q, &Message{AppKey: "b"})
+	if id <= kept {
+		t.Errorf("new ID %d reuses an earlier one", id)
+	}
+}
+
+func TestFileSegmentRollover(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	opts := Options{MaxSize: 1000, SegmentSize: 512, Ordering: OrderingUnordered}
+	q, err := NewFile(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int64
+	for i := 0; i < 40; i++ {
+		ids = append(ids, enqueue(t, q, &Message{AppKey: "a"}))
+	}
+	peak := len(segmentFiles(t, dir))
+	if peak < 3 {
+		t.Fatalf("%d segments after 40 messages, want the log to roll over", peak)
+	}
+
+	// Deliver all but the last two and count an attempt on one of them
+	for _, id := range ids[:38] {
+		if err := q.Ack(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Nack(ctx, ids[39], 0); err != nil {
+		t.Fatal(err)
+	}
+	// Write enough to roll a few more times so old segments are collected
+	for i := 0; i < 20; i++ {
+		id := enqueue(t, q, &Message{AppKey: "b"})
+		if err := q.Ack(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if segs := segmentFiles(t, dir); len(segs) >= peak {
+		t.Errorf("%d segments after delivery, want delivered segments collected (had %d)", len(segs), peak)
+	}
+	q.Close()
+
+	q, err = NewFile(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if got := bufferedIDs(t, q); len(got) != 2 || got[0] != ids[38] || got[1] != ids[39] {
+		t.Errorf("buffered after reopen = %v, want %v", got, ids[38:])
+	}
+	msgs, err := q.Lease(ctx, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		if want := map[bool]int{true: 1, false: 0}[msg.ID == ids[39]]; msg.Attempts != want {
+			t.Errorf("message %d has %d attempts, want %d", msg.ID, msg.Attempts, want)
+		}
+	}
+	if id := enqueue(t, q, &Message{AppKey: "a"}); id <= ids[39]+20 {
+		t.Errorf("new ID %d after reopen reuses an earlier one", id)
+	}
+}
+
+func TestFileDeadLettersPersist(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	q, err := NewFile(dir, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := enqueue(t, q, &Message{AppKey: "a"})
+	live := enqueue(t, q, &Message{AppKey: "a"})
+	if err := q.DeadLetter(ctx, dead, "max_attempts"); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	q, err = NewFile(dir, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if ids := bufferedIDs(t, q); len(ids) != 1 || ids[0] != live {
+		t.Errorf("buffered after reopen = %v, want [%d]", ids, live)
+	}
+	var got []*DeadLetter
+	if err := q.DeadLetters(ctx, func(dl *DeadLetter) error {
+		got = append(got, dl)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != dead || got[0].Reason != "max_attempts" {
+		t.Errorf("dead letters after reopen = %+v, want message %d", got, dead)
+	}
+	if id := enqueue(t, q, &Message{AppKey: "a"}); id <= live {
+		t.Errorf("new ID %d after reopen reuses an earlier one", id)
+	}
+}
+
+func TestFileRemovedDeadLettersStayRemoved(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	q, err := NewFile(dir, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := enqueue(t, q, &Message{AppKey: "a"})
+	kept := enqueue(t, q, &Message{AppKey: "a"})
+	for _, id := range []int64{removed, kept} {
+		if err := q.DeadLetter(ctx, id, "expired"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.RemoveDeadLetters(ctx, []int64{removed}); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	q, err = NewFile(dir, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	var got []int64
+	if err := q.DeadLetters(ctx, func(dl *DeadLetter) error {
+		got = append(got, dl.ID)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != kept {
+		t.Errorf("dead letters after reopen = %v, want [%d]", got, kept)
+	}
+}
+
+func TestFileSequencesPersist(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	opts := Options{MaxSize: 100, Ordering: OrderingStrict}
+	q, err := NewFile(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueue(t, q, &Message{AppKey: "a"})
+	q.Close()
+
+	q, err = NewFile(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if seq, err := q.NextSequence(ctx, "a"); err != nil || seq != 2 {
+		t.Errorf("NextSequence() after reopen = %d, %v, want 2", seq, err)
+	}
+}
+
+func TestFileEvictionsPersist(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{MaxSize: 1, Overflow: OverflowDropOldest}
+	q, err := NewFile(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueue(t, q, &Message{AppKey: "a"})
+	second := enqueue(t, q, &Message{AppKey: "a"})
+	q.Close()
+
+	q, err = NewFile(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if ids := bufferedIDs(t, q); fmt.Sprint(ids) != fmt.Sprint([]int64{second}) {
+		t.Errorf("buffered after reopen = %v, want [%d]", ids, second)
+	}
+}
@@ -0,0 +1,163 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeaseExclusive(t *testing.T) {
+	ctx := context.Background()
+	const apps, perApp, workers = 5, 20, 8
+	forEachBackend(t, Options{MaxSize: 1000, Ordering: OrderingUnordered}, func(t *testing.T, q Store) {
+		for i := 0; i < apps*perApp; i++ {
+			enqueue(t, q, &Message{AppKey: fmt.Sprintf("app%d", i%apps)})
+		}
+
+		// Workers lease concurrently until the queue is drained
+		var mu sync.Mutex
+		seen := make(map[int64]int)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					batch, err := q.Lease(ctx, 3, time.Minute)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if len(batch) == 0 {
+						return
+					}
+					mu.Lock()
+					for _, msg := range batch {
+						seen[msg.ID]++
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(seen) != apps*perApp {
+			t.Errorf("leased %d distinct messages, want %d", len(seen), apps*perApp)
+		}
+		for id, n := range seen {
+			if n > 1 {
+				t.Errorf("message %d leased %d times", id, n)
+			}
+		}
+	})
+}
+
+func TestLeaseOrderedOneWorkerPerApp(t *testing.T) {
+	forEachBackend(t, Options{MaxSize: 100}, func(t *testing.T, q Store) {
+		first := enqueue(t, q, &Message{AppKey: "a"})
+		enqueue(t, q, &Message{AppKey: "a"})
+		other := enqueue(t, q, &Message{AppKey: "b"})
+
+		if ids := leaseIDs(t, q, 1); len(ids) != 1 || ids[0] != first {
+			t.Fatalf("leased %v, want [%d]", ids, first)
+		}
+		// While app a has a message in flight, only app b's are handed out
+		ids := leaseIDs(t, q, 10)
+		if len(ids) != 1 || ids[0] != other {
+			t.Errorf("leased %v, want [%d]", ids, other)
+		}
+	})
+}
+
+func TestLeaseRunsOut(t *testing.T) {
+	ctx := context.Background()
+	forEachBackend(t, Options{MaxSize: 100}, func(t *testing.T, q Store) {
+		id := enqueue(t, q, &Message{AppKey: "a"})
+
+		if _, err := q.Lease(ctx, 1, -time.Second); err != nil {
+			t.Fatal(err)
+		}
+		// An expired lease is handed out again
+		if ids := leaseIDs(t, q, 1); len(ids) != 1 || ids[0] != id {
+			t.Errorf("leased %v after the lease ran out, want [%d]", ids, id)
+		}
+	})
+}
+
+func TestExtend(t *testing.T) {
+	ctx := context.Background()
+	forEachBackend(t, Options{MaxSize: 100, Ordering: OrderingUnordered}, func(t *testing.T, q Store) {
+		held := enqueue(t, q, &Message{AppKey: "a"})
+		lapsed := enqueue(t, q, &Message{AppKey: "b"})
+		free := enqueue(t, q, &Message{AppKey: "c"})
+
+		if _, err := q.Lease(ctx, 2, -time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if got := leaseIDs(t, q, 1); len(got) != 1 || got[0] != held {
+			t.Fatalf("leased %v, want [%d]", got, held)
+		}
+
+		// Only the lease that is still held is renewed
+		n, err := q.Extend(ctx, []int64{held, lapsed, free}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("extended %d leases, want 1", n)
+		}
+		ids := leaseIDs(t, q, 10)
+		if fmt.Sprint(ids) != fmt.Sprint([]int64{lapsed, free}) {
+			t.Errorf("leased %v after Extend, want [%d %d]", ids, lapsed, free)
+		}
+	})
+}
+
+func TestEnqueueLeased(t *testing.T) {
+	forEachBackend(t, Options{MaxSize: 100, Ordering: OrderingUnordered}, func(t *testing.T, q Store) {
+		enqueue(t, q, &Message{AppKey: "a", LeasedFor: time.Hour})
+		free := enqueue(t, q, &Message{AppKey: "a"})
+
+		if ids := leaseIDs(t, q, 10); fmt.Sprint(ids) != fmt.Sprint([]int64{free}) {
+			t.Errorf("leased %v, want only [%d]", ids, free)
+		}
+	})
+}
+
+func TestEnqueueNumbersStrictMessages(t *testing.T) {
+	ctx := context.Background()
+	opts := Options{MaxSize: 2, AppQuota: func(appKey string) Quota {
+		if appKey == "strict" {
+			return Quota{Ordering: OrderingStrict}
+		}
+		return Quota{}
+	}}
+	forEachBackend(t, opts, func(t *testing.T, q Store) {
+		first := &Message{AppKey: "strict"}
+		enqueue(t, q, first)
+		other := &Message{AppKey: "other"}
+		enqueue(t, q, other)
+		if first.Sequence != 1 || other.Sequence != 0 {
+			t.Errorf("sequences = %d, %d, want 1, 0", first.Sequence, other.Sequence)
+		}
+
+		// A rejected message doesn't use up a number
+		full := &Message{AppKey: "strict", Data: map[string]interface{}{"v": 1}}
+		if _, err := q.Enqueue(ctx, full); err == nil {
+			t.Fatal("enqueue into a full store succeeded")
+		}
+		if err := q.Ack(ctx, leaseIDs(t, q, 1)[0]); err != nil {
+			t.Fatal(err)
+		}
+		next := &Message{AppKey: "strict"}
+		enqueue(t, q, next)
+		if next.Sequence != 2 {
+			t.Errorf("next sequence = %d, want 2", next.Sequence)
+		}
+		if seq, err := q.NextSequence(ctx, "strict"); err != nil || seq != 3 {
+			t.Errorf("NextSequence() = %d, %v, want 3", seq, err)
+		}
+	})
+}
@@ -0,0 +1,671 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps buffered messages in memory
+// On its own it is meant for tests and hosts that can afford to lose the
+// buffer on restart; FileStore adds persistence on top of it. Operations
+// never wait for long, so their contexts are ignored.
+type MemoryStore struct {
+	opts  Options
+	drain *scheduler
+
+	mu        sync.Mutex
+	nextID    int64
+	msgs      map[int64]*memEntry
+	total     usage
+	apps      map[string]*usage
+	sequences map[string]int64
+	dead      map[int64]*deadEntry
+	journal   journal // nil when nothing is persisted
+}
+
+// memEntry is a buffered message with its bookkeeping
+type memEntry struct {
+	msg         Message // Data is nil; the payload is kept as JSON in data
+	data        []byte
+	leasedUntil time.Time
+}
+
+// deadEntry is a dead-lettered message
+type deadEntry struct {
+	memEntry
+	reason string
+	at     time.Time
+}
+
+// usage is the number and total payload size of a set of messages
+type usage struct {
+	count int
+	bytes int64
+}
+
+// journal persists changes made to a MemoryStore
+// Methods are called with the store's lock held, before the change is
+// applied in memory.
+type journal interface {
+	add(e *memEntry, evicted []int64) error // evicted are removed in the same write
+	remove(id int64) error
+	attempt(id int64, attempts int) error
+	sequence(appKey string, seq int64) error
+	deadLetter(d *deadEntry) error
+	removeDeadLetters(remaining []*deadEntry) error
+	quarantine(e *memEntry, reason string) error
+	ping() error
+	close() error
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory(opts Options) *MemoryStore {
+	opts = opts.withDefaults()
+	return &MemoryStore{
+		opts:      opts,
+		drain:     newScheduler(opts.Drain),
+		msgs:      make(map[int64]*memEntry),
+		apps:      make(map[string]*usage),
+		sequences: make(map[string]int64),
+		dead:      make(map[int64]*deadEntry),
+	}
+}
+
+// Enqueue adds a message, applying the same limits, overflow policies and
+// sequence numbering as SQLiteStore.Enqueue. Messages are only dropped once
+// the new one is known to fit.
+func (s *MemoryStore) Enqueue(_ context.Context, msg *Message) (int64, error) {
+	data, err := json.Marshal(msg.Data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal data: %w", err)
+	}
+	size := int64(len(data))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	victims := make(map[int64]victim)
+	quota := s.opts.quota(msg.AppKey)
+	if quota.MaxMessages > 0 || quota.MaxBytes > 0 {
+		err := s.planRoom(msg.AppKey, quota.MaxMessages, quota.MaxBytes, quota.Overflow, "app_quota", size, msg.Priority, victims)
+		if err != nil {
+			return 0, fmt.Errorf("app %s: %w", msg.AppKey, err)
+		}
+	}
+	if err := s.planRoom("", s.opts.MaxSize, s.opts.MaxBytes, s.opts.Overflow, "queue_full", size, msg.Priority, victims); err != nil {
+		return 0, err
+	}
+
+	// The journal's add record carries the sequence number, so it is
+	// allocated together with the message
+	seq := msg.Sequence
+	if seq == 0 && quota.Ordering == OrderingStrict {
+		seq = s.sequences[msg.AppKey] + 1
+	}
+	createdAt := msg.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	e := &memEntry{
+		msg: Message{
+			ID:          s.nextID + 1,
+			AppKey:      msg.AppKey,
+			CreatedAt:   createdAt.UTC().Truncate(time.Second),
+			TraceParent: msg.TraceParent,
+			Priority:    msg.Priority,
+			ExpiresAt:   msg.ExpiresAt,
+			Sequence:    seq,
+			Encrypted:   msg.Encrypted,
+		},
+		data: data,
+	}
+	if msg.LeasedFor > 0 {
+		e.leasedUntil = time.Now().Add(msg.LeasedFor)
+	}
+	// The new message and the evictions are journaled together, so a failed
+	// write loses neither
+	evicted := make([]int64, 0, len(victims))
+	for id := range victims {
+		evicted = append(evicted, id)
+	}
+	if s.journal != nil {
+		if err := s.journal.add(e, evicted); err != nil {
+			return 0, fmt.Errorf("failed to write message: %w", err)
+		}
+	}
+	for id, v := range victims {
+		dropped := s.msgs[id]
+		s.delete(id)
+		recordDrop(s.opts.Destination, drop{appKey: dropped.msg.AppKey, id: id, size: int64(len(dropped.data)), policy: v.policy, reason: v.reason})
+	}
+	s.nextID++
+	s.insert(e)
+	if seq > s.sequences[msg.AppKey] {
+		s.sequences[msg.AppKey] = seq
+	}
+	msg.Sequence = seq
+	return e.msg.ID, nil
+}
+
+// victim is a message chosen to be dropped by an overflow policy
+type victim struct {
+	policy OverflowPolicy
+	reason string
+}
+
+// planRoom chooses messages to drop so a message of size bytes fits within
+// the limits for appKey ("" = the whole store). Chosen IDs are added to
+// victims; nothing is removed yet.
+func (s *MemoryStore) planRoom(appKey string, maxMessages int, maxBytes int64, policy OverflowPolicy, reason string, size int64, priority int, victims map[int64]victim) error {
+	if maxBytes > 0 && size > maxBytes {
+		return fmt.Errorf("%w: message of %d bytes exceeds limit of %d bytes", ErrFull, size, maxBytes)
+	}
+
+	inScope := func(e *memEntry) bool { return appKey == "" || e.msg.AppKey == appKey }
+
+	used := s.total
+	if appKey != "" {
+		used = usage{}
+		if u := s.apps[appKey]; u != nil {
+			used = *u
+		}
+	}
+	for id := range victims {
+		if e := s.msgs[id]; inScope(e) {
+			used.count--
+			used.bytes -= int64(len(e.data))
+		}
+	}
+
+	for {
+		overCount := maxMessages > 0 && used.count >= maxMessages
+		overBytes := maxBytes > 0 && used.bytes+size > maxBytes
+		if !overCount && !overBytes {
+			return nil
+		}
+
+		full := fmt.Errorf("%w (max: %d bytes)", ErrFull, maxBytes)
+		if overCount {
+			full = fmt.Errorf("%w (max: %d messages)", ErrFull, maxMessages)
+		}
+		if policy != OverflowDropOldest && policy != OverflowDropLowestPriority {
+			return full
+		}
+
+		var pick *memEntry
+		for id, e := range s.msgs {
+			if _, taken := victims[id]; taken || !inScope(e) {
+				continue
+			}
+			switch policy {
+			case OverflowDropOldest:
+				if pick == nil || e.msg.ID < pick.msg.ID {
+					pick = e
+				}
+			case OverflowDropLowestPriority:
+				// Only messages that are not more important than the new one
+				if e.msg.Priority > priority {
+					continue
+				}
+				if pick == nil || e.msg.Priority < pick.msg.Priority ||
+					(e.msg.Priority == pick.msg.Priority && e.msg.ID < pick.msg.ID) {
+					pick = e
+				}
+			}
+		}
+		if pick == nil {
+			return full
+		}
+
+		victims[pick.msg.ID] = victim{policy: policy, reason: reason}
+		used.count--
+		used.bytes -= int64(len(pick.data))
+	}
+}
+
+// Lease hands out up to max messages in delivery order and reserves them
+// for d, with the same ordering rules as SQLiteStore.Lease. Leases are not
+// persisted: after a restart every message can be leased again. Messages
+// whose data can't be decoded are quarantined and removed.
+func (s *MemoryStore) Lease(_ context.Context, max int, d time.Duration) ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	busy := make(map[string]bool)
+	heads := make(map[string]int64)
+	var candidates []*memEntry
+	for _, e := range s.msgs {
+		if e.leasedUntil.After(now) {
+			busy[e.msg.AppKey] = true
+		}
+		if expired(e.msg, now) {
+			continue
+		}
+		if head, ok := heads[e.msg.AppKey]; !ok || e.msg.ID < head {
+			heads[e.msg.AppKey] = e.msg.ID
+		}
+		if !e.leasedUntil.After(now) {
+			candidates = append(candidates, e)
+		}
+	}
+
+	// Fair draining picks the app first, then its next messages
+	if s.drain.policy != DrainFIFO {
+		seen := make(map[string]bool)
+		var apps []string
+		for _, e := range candidates {
+			appKey := e.msg.AppKey
+			if seen[appKey] || (busy[appKey] && s.opts.quota(appKey).Ordering != OrderingUnordered) {
+				continue
+			}
+			seen[appKey] = true
+			apps = append(apps, appKey)
+		}
+		appKey := s.drain.next(apps, func(appKey string) int { return s.opts.quota(appKey).Weight })
+		if appKey == "" {
+			return nil, nil
+		}
+		filtered := candidates[:0]
+		for _, e := range candidates {
+			if e.msg.AppKey == appKey {
+				filtered = append(filtered, e)
+			}
+		}
+		candidates = filtered
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		pi, pj := s.effectivePriority(candidates[i], now), s.effectivePriority(candidates[j], now)
+		if pi != pj {
+			return pi > pj
+		}
+		return candidates[i].msg.ID < candidates[j].msg.ID
+	})
+
+	var leased []*Message
+	for _, e := range candidates {
+		if len(leased) >= max {
+			break
+		}
+		ordering := s.opts.quota(e.msg.AppKey).Ordering
+		if busy[e.msg.AppKey] && ordering != OrderingUnordered {
+			continue
+		}
+		// Strict ordering: only the app's oldest message, one per lease
+		if ordering == OrderingStrict && e.msg.ID != heads[e.msg.AppKey] {
+			continue
+		}
+
+		msg := e.msg
+		if err := json.Unmarshal(e.data, &msg.Data); err != nil {
+			if err := s.quarantine(e, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		leased = append(leased, &msg)
+	}
+
+	for _, msg := range leased {
+		s.msgs[msg.ID].leasedUntil = now.Add(d)
+	}
+	return leased, nil
+}
+
+// effectivePriority applies PriorityAging to a message's priority
+func (s *MemoryStore) effectivePriority(e *memEntry, now time.Time) float64 {
+	priority := float64(e.msg.Priority)
+	if aging := s.opts.PriorityAging.Seconds(); aging > 0 {
+		priority += now.Sub(e.msg.CreatedAt).Seconds() / aging
+	}
+	return priority
+}
+
+// expired reports whether msg's TTL has passed
+func expired(msg Message, now time.Time) bool {
+	return !msg.ExpiresAt.IsZero() && !msg.ExpiresAt.After(now)
+}
+
+// Scan calls fn for every unexpired message in ID order
+// Messages whose data can't be decoded are skipped (Lease quarantines them).
+// fn must not call back into the store.
+func (s *MemoryStore) Scan(_ context.Context, fn func(*Message) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	ids := make([]int64, 0, len(s.msgs))
+	for id, e := range s.msgs {
+		if !expired(e.msg, now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		e := s.msgs[id]
+		msg := e.msg
+		if err := json.Unmarshal(e.data, &msg.Data); err != nil {
+			continue
+		}
+		if err := fn(&msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ack removes a message
+func (s *MemoryStore) Ack(_ context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.msgs[id]; !ok {
+		return nil
+	}
+	return s.removeLogged(id)
+}
+
+// Nack records a failed attempt and keeps the message leased for retryAfter
+func (s *MemoryStore) Nack(_ context.Context, id int64, retryAfter time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.msgs[id]
+	if !ok {
+		return nil
+	}
+	if s.journal != nil {
+		if err := s.journal.attempt(id, e.msg.Attempts+1); err != nil {
+			return err
+		}
+	}
+	e.msg.Attempts++
+	e.leasedUntil = time.Now().Add(retryAfter)
+	return nil
+}
+
+// Release returns a leased message without counting an attempt
+func (s *MemoryStore) Release(_ context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.msgs[id]; ok {
+		e.leasedUntil = time.Time{}
+	}
+	return nil
+}
+
+// Extend renews the leases of the messages among ids that are still leased
+func (s *MemoryStore) Extend(_ context.Context, ids []int64, d time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	extended := 0
+	for _, id := range ids {
+		if e, ok := s.msgs[id]; ok && e.leasedUntil.After(now) {
+			e.leasedUntil = now.Add(d)
+			extended++
+		}
+	}
+	return extended, nil
+}
+
+// Expire removes messages whose TTL has passed, moving them to the dead
+// letters under ExpireDeadLetter
+func (s *MemoryStore) Expire(_ context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	expiredApps := make(map[string]int)
+	for id, e := range s.msgs {
+		if !expired(e.msg, now) {
+			continue
+		}
+		var err error
+		if s.opts.Expiry == ExpireDeadLetter {
+			err = s.deadLetterLogged(e, "expired")
+		} else {
+			err = s.removeLogged(id)
+		}
+		if err != nil {
+			recordExpired(s.opts.Destination, s.opts.Expiry, expiredApps)
+			return 0, fmt.Errorf("failed to remove expired messages: %w", err)
+		}
+		expiredApps[e.msg.AppKey]++
+	}
+	return recordExpired(s.opts.Destination, s.opts.Expiry, expiredApps), nil
+}
+
+// DeadLetter moves a message to the dead letters
+func (s *MemoryStore) DeadLetter(_ context.Context, id int64, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.msgs[id]
+	if !ok {
+		return nil
+	}
+	return s.deadLetterLogged(e, reason)
+}
+
+// DeadLetters calls fn for every dead letter in ID order
+// Dead letters whose data can't be decoded are skipped. fn must not call
+// back into the store.
+func (s *MemoryStore) DeadLetters(_ context.Context, fn func(*DeadLetter) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.sortedDead() {
+		dl := DeadLetter{Message: d.msg, Reason: d.reason, DeadLetteredAt: d.at}
+		if err := json.Unmarshal(d.data, &dl.Data); err != nil {
+			continue
+		}
+		if err := fn(&dl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveDeadLetters deletes dead letters by ID
+func (s *MemoryStore) RemoveDeadLetters(_ context.Context, ids []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	remove := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+	if s.journal != nil {
+		var remaining []*deadEntry
+		for _, d := range s.sortedDead() {
+			if !remove[d.msg.ID] {
+				remaining = append(remaining, d)
+			}
+		}
+		if err := s.journal.removeDeadLetters(remaining); err != nil {
+			return fmt.Errorf("failed to remove dead letters: %w", err)
+		}
+	}
+	for id := range remove {
+		delete(s.dead, id)
+	}
+	return nil
+}
+
+// sortedDead returns the dead letters in ID order
+func (s *MemoryStore) sortedDead() []*deadEntry {
+	dead := make([]*deadEntry, 0, len(s.dead))
+	for _, d := range s.dead {
+		dead = append(dead, d)
+	}
+	sort.Slice(dead, func(i, j int) bool { return dead[i].msg.ID < dead[j].msg.ID })
+	return dead
+}
+
+// deadLetterLogged journals and applies moving an entry to the dead letters
+func (s *MemoryStore) deadLetterLogged(e *memEntry, reason string) error {
+	d := &deadEntry{memEntry: *e, reason: reason, at: time.Now().UTC().Truncate(time.Second)}
+	d.leasedUntil = time.Time{}
+	if s.journal != nil {
+		if err := s.journal.deadLetter(d); err != nil {
+			return fmt.Errorf("failed to write dead letter: %w", err)
+		}
+	}
+	if err := s.removeLogged(e.msg.ID); err != nil {
+		return err
+	}
+	s.dead[e.msg.ID] = d
+	return nil
+}
+
+// Pending returns the number of deliverable messages for an app
+func (s *MemoryStore) Pending(_ context.Context, appKey string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, e := range s.msgs {
+		if e.msg.AppKey == appKey && !expired(e.msg, now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// NextSequence returns the app's next sequence number, starting at 1
+func (s *MemoryStore) NextSequence(_ context.Context, appKey string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := s.sequences[appKey] + 1
+	if s.journal != nil {
+		if err := s.journal.sequence(appKey, seq); err != nil {
+			return 0, fmt.Errorf("failed to allocate sequence number: %w", err)
+		}
+	}
+	s.sequences[appKey] = seq
+	return seq, nil
+}
+
+// Size returns the number of buffered messages
+func (s *MemoryStore) Size(_ context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total.count, nil
+}
+
+// Bytes returns the total payload size of buffered messages
+func (s *MemoryStore) Bytes(_ context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total.bytes, nil
+}
+
+// Oldest returns the creation time of the oldest message
+func (s *MemoryStore) Oldest(_ context.Context) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var oldest *memEntry
+	for _, e := range s.msgs {
+		if oldest == nil || e.msg.ID < oldest.msg.ID {
+			oldest = e
+		}
+	}
+	if oldest == nil {
+		return time.Time{}, false, nil
+	}
+	return oldest.msg.CreatedAt, true, nil
+}
+
+// Ping reports whether the journal (if any) can be written
+func (s *MemoryStore) Ping(_ context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal.ping()
+}
+
+// Close closes the journal (if any)
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal.close()
+}
+
+// removeLogged journals and applies the removal of a message
+func (s *MemoryStore) removeLogged(id int64) error {
+	if s.journal != nil {
+		if err := s.journal.remove(id); err != nil {
+			return fmt.Errorf("failed to remove message: %w", err)
+		}
+	}
+	s.delete(id)
+	return nil
+}
+
+// quarantine removes an entry whose data can't be decoded, keeping a copy in
+// the journal's quarantine (if any)
+func (s *MemoryStore) quarantine(e *memEntry, cause error) error {
+	if s.journal != nil {
+		if err := s.journal.quarantine(e, cause.Error()); err != nil {
+			return fmt.Errorf("failed to quarantine message: %w", err)
+		}
+	}
+	if err := s.removeLogged(e.msg.ID); err != nil {
+		return err
+	}
+	recordCorrupt(s.opts.Destination, e.msg.AppKey, e.msg.ID, cause)
+	return nil
+}
+
+// insert adds an entry and updates usage
+func (s *MemoryStore) insert(e *memEntry) {
+	s.msgs[e.msg.ID] = e
+	size := int64(len(e.data))
+	s.total.count++
+	s.total.bytes += size
+	u := s.apps[e.msg.AppKey]
+	if u == nil {
+		u = &usage{}
+		s.apps[e.msg.AppKey] = u
+	}
+	u.count++
+	u.bytes += size
+}
+
+// delete removes an entry and updates usage
+func (s *MemoryStore) delete(id int64) {
+	e, ok := s.msgs[id]
+	if !ok {
+		return
+	}
+	delete(s.msgs, id)
+	size := int64(len(e.data))
+	s.total.count--
+	s.total.bytes -= size
+	if u := s.apps[e.msg.AppKey]; u != nil {
+		u.count--
+		u.bytes -= size
+		if u.count == 0 {
+			delete(s.apps, e.msg.AppKey)
+		}
+	}
+}
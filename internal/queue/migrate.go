@@ -0,0 +1,196 @@
+package queue
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// migration upgrades the buffer schema by one version
+// Versions are tracked in SQLite's user_version pragma. Never edit or
+// reorder a released migration; append a new one instead.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// migrations brings a database of any earlier version up to date
+// Databases created before versioning have user_version 0 and may already
+// contain some of the tables and columns added by versions 2-7 and 9, so
+// those steps only add what is missing.
+var migrations = []migration{
+	{1, "create messages table", execAll(`
+		CREATE TABLE IF NOT EXISTS messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			app_key TEXT NOT NULL,
+			data TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			attempts INTEGER DEFAULT 0
+		)`)},
+	{2, "add trace context", addColumn("messages", "trace_parent", "TEXT NOT NULL DEFAULT ''")},
+	{3, "add message sizes", func(tx *sql.Tx) error {
+		if err := addColumn("messages", "size_bytes", "INTEGER NOT NULL DEFAULT 0")(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE messages SET size_bytes = length(data) WHERE size_bytes = 0")
+		return err
+	}},
+	{4, "add priorities", addColumn("messages", "priority", "INTEGER NOT NULL DEFAULT 0")},
+	// Unix seconds, 0 = never
+	{5, "add expiry", addColumn("messages", "expires_at", "INTEGER NOT NULL DEFAULT 0")},
+	// Unix seconds; rows leased until a time in the future are being sent
+	{6, "add leases", addColumn("messages", "leased_until", "INTEGER NOT NULL DEFAULT 0")},
+	{7, "add sequence numbers", func(tx *sql.Tx) error {
+		if err := addColumn("messages", "sequence", "INTEGER NOT NULL DEFAULT 0")(tx); err != nil {
+			return err
+		}
+		return execAll(`
+			CREATE TABLE IF NOT EXISTS sequences (
+				app_key TEXT PRIMARY KEY,
+				last INTEGER NOT NULL
+			)`)(tx)
+	}},
+	// Per-app counts, quotas and strict-order heads use (app_key, id).
+	// The partial indexes keep the expiry sweep and the lease check cheap
+	// since almost all rows have expires_at = 0 and leased_until = 0.
+	{8, "add indexes", execAll(
+		"CREATE INDEX IF NOT EXISTS idx_messages_app ON messages (app_key, id)",
+		"CREATE INDEX IF NOT EXISTS idx_messages_priority ON messages (priority DESC, id)",
+		"CREATE INDEX IF NOT EXISTS idx_messages_expires ON messages (expires_at) WHERE expires_at > 0",
+		"CREATE INDEX IF NOT EXISTS idx_messages_leased ON messages (leased_until) WHERE leased_until > 0",
+	)},
+	// Expired and undeliverable messages are moved here, keeping their IDs
+	{9, "add dead letters", func(tx *sql.Tx) error {
+		err := execAll(`
+			CREATE TABLE IF NOT EXISTS dead_letters (
+				id INTEGER PRIMARY KEY,
+				app_key TEXT NOT NULL,
+				data TEXT NOT NULL,
+				created_at DATETIME,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				trace_parent TEXT NOT NULL DEFAULT '',
+				priority INTEGER NOT NULL DEFAULT 0,
+				expires_at INTEGER NOT NULL DEFAULT 0,
+				sequence INTEGER NOT NULL DEFAULT 0,
+				reason TEXT NOT NULL,
+				dead_lettered_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`)(tx)
+		if err != nil {
+			return err
+		}
+		return addColumn("dead_letters", "sequence", "INTEGER NOT NULL DEFAULT 0")(tx)
+	}},
+	// Rows whose data can't be decoded are moved here instead of stalling
+	// delivery, and kept for inspection
+	{10, "add quarantine", execAll(`
+		CREATE TABLE IF NOT EXISTS quarantine (
+			id INTEGER PRIMARY KEY,
+			app_key TEXT NOT NULL,
+			data TEXT NOT NULL,
+			created_at DATETIME,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			reason TEXT NOT NULL,
+			quarantined_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`)},
+	{11, "add encrypted flag", func(tx *sql.Tx) error {
+		if err := addColumn("messages", "encrypted", "INTEGER NOT NULL DEFAULT 0")(tx); err != nil {
+			return err
+		}
+		return addColumn("dead_letters", "encrypted", "INTEGER NOT NULL DEFAULT 0")(tx)
+	}},
+}
+
+// SchemaVersion is the buffer schema version this build writes
+var SchemaVersion = migrations[len(migrations)-1].version
+
+// migrate applies pending migrations, each in its own transaction
+func migrate(db *sql.DB) error {
+	var current int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if current > SchemaVersion {
+		return fmt.Errorf("buffer schema version %d is newer than supported version %d", current, SchemaVersion)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("failed to migrate buffer to version %d (%s): %w", m.version, m.description, err)
+		}
+		slog.Info("Migrated buffer schema", "version", m.version, "description", m.description)
+	}
+	return nil
+}
+
+// applyMigration runs one migration and records its version atomically
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	// PRAGMA doesn't take bind parameters
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// execAll returns a migration step running the statements in order
+func execAll(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn returns a migration step adding a column if it is missing
+func addColumn(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		exists, err := hasColumn(tx, table, column)
+		if err != nil || exists {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+		return err
+	}
+}
+
+// hasColumn reports whether table has the named column
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("failed to read table info: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, fmt.Errorf("failed to read table info: %w", err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
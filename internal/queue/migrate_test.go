@@ -0,0 +1,139 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// baselineSchema is the messages table written by agents released before
+// schema versioning
+const baselineSchema = `CREATE TABLE messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	app_key TEXT NOT NULL,
+	data TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	attempts INTEGER DEFAULT 0
+)`
+
+// createBaselineDB writes an unversioned database with the given extra
+// statements applied after the baseline schema
+func createBaselineDB(t *testing.T, statements ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "queue.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range append([]string{baselineSchema}, statements...) {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	return path
+}
+
+// schemaVersion reads a store's user_version
+func schemaVersion(t *testing.T, q *SQLiteStore) int {
+	t.Helper()
+	var version int
+	if err := q.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	ctx := context.Background()
+	path := createBaselineDB(t,
+		`INSERT INTO messages (app_key, data, attempts) VALUES ('app1', '{"temp":21.5}', 2)`,
+	)
+
+	q, err := NewSQLite(path, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := schemaVersion(t, q); v != SchemaVersion {
+		t.Errorf("user_version = %d, want %d", v, SchemaVersion)
+	}
+	want := int64(len(`{"temp":21.5}`))
+	if bytes, err := q.Bytes(ctx); err != nil || bytes != want {
+		t.Errorf("bytes = %d, %v; want %d backfilled from the data", bytes, err, want)
+	}
+
+	// The message survives with its data and attempts
+	msgs, err := q.Lease(ctx, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].AppKey != "app1" || msgs[0].Attempts != 2 || msgs[0].Data["temp"] != 21.5 {
+		t.Fatalf("messages after upgrade = %+v", msgs)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening applies nothing and keeps the data
+	q, err = NewSQLite(path, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer q.Close()
+	if v := schemaVersion(t, q); v != SchemaVersion {
+		t.Errorf("user_version after reopen = %d, want %d", v, SchemaVersion)
+	}
+	if size, err := q.Size(ctx); err != nil || size != 1 {
+		t.Errorf("size after reopen = %d, %v; want 1", size, err)
+	}
+}
+
+func TestMigrateColumnsAlreadyPresent(t *testing.T) {
+	ctx := context.Background()
+	// Some unversioned builds had already added columns and tables of later
+	// versions, e.g. dead letters without sequence numbers
+	path := createBaselineDB(t,
+		`ALTER TABLE messages ADD COLUMN trace_parent TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE messages ADD COLUMN priority INTEGER NOT NULL DEFAULT 0`,
+		`INSERT INTO messages (app_key, data, trace_parent, priority) VALUES ('app1', '{}', '00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01', 5)`,
+		`CREATE TABLE dead_letters (id INTEGER PRIMARY KEY, app_key TEXT NOT NULL, data TEXT NOT NULL, created_at DATETIME,
+			attempts INTEGER NOT NULL DEFAULT 0, trace_parent TEXT NOT NULL DEFAULT '', priority INTEGER NOT NULL DEFAULT 0,
+			expires_at INTEGER NOT NULL DEFAULT 0, reason TEXT NOT NULL, dead_lettered_at DATETIME DEFAULT CURRENT_TIMESTAMP)`,
+		`INSERT INTO dead_letters (id, app_key, data, created_at, reason) VALUES (7, 'app1', '{}', CURRENT_TIMESTAMP, 'expired')`,
+	)
+
+	q, err := NewSQLite(path, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if v := schemaVersion(t, q); v != SchemaVersion {
+		t.Errorf("user_version = %d, want %d", v, SchemaVersion)
+	}
+	msgs, err := q.Lease(ctx, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Priority != 5 || msgs[0].TraceParent == "" {
+		t.Errorf("leased %+v, want the existing priority and trace context", msgs)
+	}
+	var dead []int64
+	if err := q.DeadLetters(ctx, func(dl *DeadLetter) error {
+		dead = append(dead, dl.ID)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0] != 7 {
+		t.Errorf("dead letters %v after upgrade, want [7]", dead)
+	}
+}
+
+func TestMigrateNewerVersion(t *testing.T) {
+	path := createBaselineDB(t, "PRAGMA user_version = 1000")
+	if q, err := NewSQLite(path, Options{MaxSize: 100}); err == nil {
+		q.Close()
+		t.Fatal("opened a database written by a newer version")
+	}
+}
@@ -0,0 +1,38 @@
+package queue
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLeaseByPriority(t *testing.T) {
+	forEachBackend(t, Options{MaxSize: 100, Ordering: OrderingUnordered}, func(t *testing.T, q Store) {
+		low := enqueue(t, q, &Message{AppKey: "a"})
+		high := enqueue(t, q, &Message{AppKey: "b", Priority: 5})
+		mid := enqueue(t, q, &Message{AppKey: "c", Priority: 2})
+		tie := enqueue(t, q, &Message{AppKey: "d", Priority: 5})
+
+		// Highest first, oldest first within a priority
+		want := []int64{high, tie, mid, low}
+		if ids := leaseIDs(t, q, 10); fmt.Sprint(ids) != fmt.Sprint(want) {
+			t.Errorf("leased %v, want %v", ids, want)
+		}
+	})
+}
+
+func TestPriorityAging(t *testing.T) {
+	opts := Options{MaxSize: 100, PriorityAging: time.Minute, Ordering: OrderingUnordered}
+	q := openTestStore(t, BackendSQLite, opts).(*SQLiteStore)
+	old := enqueue(t, q, &Message{AppKey: "a"})
+	high := enqueue(t, q, &Message{AppKey: "b", Priority: 2})
+
+	// Three minutes of waiting outrank two priority levels
+	if _, err := q.db.Exec("UPDATE messages SET created_at = datetime('now', '-3 minutes') WHERE id = ?", old); err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{old, high}
+	if ids := leaseIDs(t, q, 10); fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("leased %v, want %v", ids, want)
+	}
+}
@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/logging"
+	"github.com/nexus/nexus-agent/internal/metrics"
+)
+
+// ErrCorrupt is returned (wrapped) when a store fails its integrity check
+var ErrCorrupt = errors.New("buffer is corrupt")
+
+// CorruptionPolicy decides what Open does with a corrupt store
+type CorruptionPolicy string
+
+const (
+	// CorruptionQuarantine moves the damaged store aside and starts with an
+	// empty one
+	CorruptionQuarantine CorruptionPolicy = "quarantine"
+	// CorruptionFail returns the error, so the agent refuses to start
+	CorruptionFail CorruptionPolicy = "fail"
+)
+
+// openRecovering opens a store, quarantining it first if it is corrupt and
+// the policy allows
+func openRecovering(open func() (Store, error), path string, policy CorruptionPolicy) (Store, error) {
+	store, err := open()
+	if err == nil || !errors.Is(err, ErrCorrupt) || policy == CorruptionFail {
+		return store, err
+	}
+
+	moved, qerr := quarantineFiles(path)
+	if qerr != nil {
+		return nil, fmt.Errorf("%w (quarantine failed: %v)", err, qerr)
+	}
+	slog.Error("Buffer failed its integrity check; moved it aside and starting with an empty buffer",
+		"path", path, "quarantined", moved, logging.Err(err))
+	return open()
+}
+
+// quarantineFiles renames path, and the SQLite journal files next to it, to
+// <name>.corrupt-<time> and returns the new name of path
+func quarantineFiles(path string) (string, error) {
+	suffix := ".corrupt-" + time.Now().UTC().Format("20060102T150405Z")
+	for _, ext := range []string{"", "-wal", "-shm"} {
+		err := os.Rename(path+ext, path+suffix+ext)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("failed to move %s aside: %w", path+ext, err)
+		}
+	}
+	return path + suffix, nil
+}
+
+// recordCorrupt counts and logs a message removed because its data can't be
+// decoded
+func recordCorrupt(dest, appKey string, id int64, err error) {
+	metrics.Quarantined.Inc(dest, appKey)
+	slog.Error("Quarantined buffered message with unreadable data",
+		"destination", dest, logging.AppKey(appKey), logging.MessageID(id), logging.Err(err))
+}
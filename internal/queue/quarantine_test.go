@@ -0,0 +1,165 @@
+package queue
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// flipByte inverts one byte of a file
+func flipByte(t *testing.T, path string, offset int64) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset < 0 {
+		offset += int64(len(data))
+	}
+	data[offset] ^= 0xff
+	if err := os.WriteFile(path, data, 0o640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// damagedFileLog writes a file log spread over several segments and
+// damages the middle of one that isn't the newest. It returns the log
+// directory, the damaged segment and how many messages were written.
+func damagedFileLog(t *testing.T) (string, string, int) {
+	t.Helper()
+	dir := t.TempDir()
+	q, err := NewFile(dir, Options{MaxSize: 1000, SegmentSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 40
+	for i := 0; i < count; i++ {
+		enqueue(t, q, &Message{AppKey: "a"})
+	}
+	q.Close()
+
+	segs := segmentFiles(t, dir)
+	if len(segs) < 3 {
+		t.Fatalf("%d segments, want at least 3", len(segs))
+	}
+	damaged := segs[len(segs)-2]
+	info, err := os.Stat(damaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipByte(t, damaged, info.Size()/2)
+	return dir, damaged, count
+}
+
+func TestFileDamagedSegmentQuarantined(t *testing.T) {
+	dir, damaged, count := damagedFileLog(t)
+
+	q, err := Open(BackendFile, dir, Options{MaxSize: 1000, SegmentSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// Messages before the damage are kept; the segment is moved aside
+	if n := len(bufferedIDs(t, q)); n == 0 || n >= count {
+		t.Errorf("%d messages buffered, want those read before the damage", n)
+	}
+	if _, err := os.Stat(damaged); !os.IsNotExist(err) {
+		t.Errorf("damaged segment still in the log: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "quarantine", filepath.Base(damaged))); err != nil {
+		t.Errorf("damaged segment not quarantined: %v", err)
+	}
+}
+
+func TestFileDamagedSegmentFail(t *testing.T) {
+	dir, damaged, _ := damagedFileLog(t)
+	before := segmentFiles(t, dir)
+
+	q, err := Open(BackendFile, dir, Options{MaxSize: 1000, SegmentSize: 512, Corruption: CorruptionFail})
+	if err == nil {
+		q.Close()
+		t.Fatal("opened a damaged log under CorruptionFail")
+	}
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("err = %v, want ErrCorrupt", err)
+	}
+
+	// Nothing is repaired or moved
+	if after := segmentFiles(t, dir); len(after) != len(before) {
+		t.Errorf("segments changed from %v to %v", before, after)
+	}
+	if _, err := os.Stat(damaged); err != nil {
+		t.Errorf("damaged segment moved: %v", err)
+	}
+}
+
+func TestFileDamagedLastRecord(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewFile(dir, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := enqueue(t, q, &Message{AppKey: "a"})
+	enqueue(t, q, &Message{AppKey: "a"})
+	q.Close()
+
+	// A complete record with a bad checksum is damage, not a torn write
+	segs := segmentFiles(t, dir)
+	flipByte(t, segs[len(segs)-1], -2)
+
+	if q, err := Open(BackendFile, dir, Options{MaxSize: 100, Corruption: CorruptionFail}); !errors.Is(err, ErrCorrupt) {
+		if err == nil {
+			q.Close()
+		}
+		t.Fatalf("err = %v, want ErrCorrupt under CorruptionFail", err)
+	}
+
+	q2, err := Open(BackendFile, dir, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q2.Close()
+	if ids := bufferedIDs(t, q2); len(ids) != 1 || ids[0] != kept {
+		t.Errorf("buffered %v, want [%d]", ids, kept)
+	}
+}
+
+func TestSQLiteCorruptDatabase(t *testing.T) {
+	for _, policy := range []CorruptionPolicy{CorruptionQuarantine, CorruptionFail} {
+		t.Run(string(policy), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "queue.db")
+			garbage := []byte("this is not a SQLite database, just some bytes long enough to have a header")
+			if err := os.WriteFile(path, garbage, 0o640); err != nil {
+				t.Fatal(err)
+			}
+
+			q, err := Open(BackendSQLite, path, Options{MaxSize: 100, Corruption: policy})
+			if policy == CorruptionFail {
+				if err == nil {
+					q.Close()
+				}
+				if !errors.Is(err, ErrCorrupt) {
+					t.Fatalf("err = %v, want ErrCorrupt", err)
+				}
+				if data, _ := os.ReadFile(path); string(data) != string(garbage) {
+					t.Error("database changed under CorruptionFail")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer q.Close()
+			if ids := bufferedIDs(t, q); len(ids) != 0 {
+				t.Errorf("buffered %v, want an empty buffer", ids)
+			}
+			moved, _ := filepath.Glob(path + ".corrupt-*")
+			if len(moved) != 1 {
+				t.Errorf("moved aside: %v, want the damaged database", moved)
+			}
+		})
+	}
+}
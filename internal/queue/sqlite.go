@@ -0,0 +1,479 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteStore buffers messages in a SQLite database
+type SQLiteStore struct {
+	db      *sql.DB
+	opts    Options
+	maxSize int
+	drain   *scheduler
+}
+
+// NewSQLite opens a SQLite store, creating or upgrading the database
+//
+// Writes run in IMMEDIATE transactions, so concurrent workers and requests
+// serialize on SQLite's write lock (waiting up to BusyTimeout) rather than
+// on a process-wide mutex. The journal is always in WAL mode so reads don't
+// block behind writes.
+//
+// The database is integrity-checked after opening; a damaged file is
+// reported as ErrCorrupt.
+func NewSQLite(dbPath string, opts Options) (*SQLiteStore, error) {
+	opts = opts.withDefaults()
+
+	db, err := sql.Open("sqlite", dsn(dbPath, opts))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	err = migrate(db)
+	if err == nil {
+		err = checkIntegrity(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, asCorrupt(err)
+	}
+
+	return &SQLiteStore{
+		db:      db,
+		opts:    opts,
+		maxSize: opts.MaxSize,
+		drain:   newScheduler(opts.Drain),
+	}, nil
+}
+
+// Enqueue adds a message to the queue
+// Only AppKey, Data, CreatedAt (default: now), TraceParent, Priority,
+// ExpiresAt, Sequence, Encrypted and LeasedFor are read from msg. A message for an app with strict
+// ordering that has no Sequence yet is numbered in the same transaction and
+// msg.Sequence set, so a number is only used by a buffered message. When
+// the app's quota or a global limit is reached, the overflow policy either
+// rejects the message (ErrFull) or drops buffered messages to make room.
+func (q *SQLiteStore) Enqueue(ctx context.Context, msg *Message) (int64, error) {
+	// Marshal data to JSON
+	dataJSON, err := json.Marshal(msg.Data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal data: %w", err)
+	}
+	size := int64(len(dataJSON))
+
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Drops are only reported once the transaction commits
+	var drops []drop
+
+	// Per-app quota
+	quota := q.opts.quota(msg.AppKey)
+	if quota.MaxMessages > 0 || quota.MaxBytes > 0 {
+		err := q.makeRoom(ctx, tx, &drops, limit{
+			where:       "WHERE app_key = ?",
+			args:        []interface{}{msg.AppKey},
+			maxMessages: quota.MaxMessages,
+			maxBytes:    quota.MaxBytes,
+			policy:      quota.Overflow,
+			reason:      "app_quota",
+		}, size, msg.Priority)
+		if err != nil {
+			return 0, fmt.Errorf("app %s: %w", msg.AppKey, err)
+		}
+	}
+
+	// Global limits
+	err = q.makeRoom(ctx, tx, &drops, limit{
+		maxMessages: q.maxSize,
+		maxBytes:    q.opts.MaxBytes,
+		policy:      q.opts.Overflow,
+		reason:      "queue_full",
+	}, size, msg.Priority)
+	if err != nil {
+		return 0, err
+	}
+
+	seq := msg.Sequence
+	if seq == 0 && quota.Ordering == OrderingStrict {
+		if err := tx.QueryRowContext(ctx, nextSequenceSQL, msg.AppKey).Scan(&seq); err != nil {
+			return 0, fmt.Errorf("failed to allocate sequence number: %w", err)
+		}
+	}
+	var leasedUntil int64
+	if msg.LeasedFor > 0 {
+		leasedUntil = time.Now().Add(msg.LeasedFor).Unix()
+	}
+	// Stored like CURRENT_TIMESTAMP so aging can compare them
+	var createdAt interface{}
+	if !msg.CreatedAt.IsZero() {
+		createdAt = msg.CreatedAt.UTC().Format(time.DateTime)
+	}
+
+	// Insert message
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO messages (app_key, data, created_at, trace_parent, size_bytes, priority, expires_at, sequence, encrypted, leased_until) VALUES (?, ?, COALESCE(?, CURRENT_TIMESTAMP), ?, ?, ?, ?, ?, ?, ?)",
+		msg.AppKey, string(dataJSON), createdAt, msg.TraceParent, size, msg.Priority, unixOrZero(msg.ExpiresAt), seq, msg.Encrypted, leasedUntil,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert message: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit message: %w", err)
+	}
+	for _, d := range drops {
+		recordDrop(q.opts.Destination, d)
+	}
+	msg.Sequence = seq
+
+	id, _ := result.LastInsertId()
+	return id, nil
+}
+
+// limit is a message count and byte cap over the rows matched by where
+// Zero maximums are ignored.
+type limit struct {
+	where       string
+	args        []interface{}
+	maxMessages int
+	maxBytes    int64
+	policy      OverflowPolicy
+	reason      string // Reported in metrics and logs for each drop
+}
+
+// makeRoom ensures a message of size bytes and the given priority fits
+// within l, dropping messages according to l.policy and adding them to
+// drops. It returns ErrFull if the policy is reject or nothing suitable can
+// be dropped.
+func (q *SQLiteStore) makeRoom(ctx context.Context, tx *sql.Tx, drops *[]drop, l limit, size int64, priority int) error {
+	if l.maxBytes > 0 && size > l.maxBytes {
+		return fmt.Errorf("%w: message of %d bytes exceeds limit of %d bytes", ErrFull, size, l.maxBytes)
+	}
+
+	for {
+		var count int
+		var bytes int64
+		err := tx.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(size_bytes), 0) FROM messages "+l.where, l.args...).Scan(&count, &bytes)
+		if err != nil {
+			return fmt.Errorf("failed to check queue size: %w", err)
+		}
+
+		overCount := l.maxMessages > 0 && count >= l.maxMessages
+		overBytes := l.maxBytes > 0 && bytes+size > l.maxBytes
+		if !overCount && !overBytes {
+			return nil
+		}
+
+		full := fmt.Errorf("%w (max: %d bytes)", ErrFull, l.maxBytes)
+		if overCount {
+			full = fmt.Errorf("%w (max: %d messages)", ErrFull, l.maxMessages)
+		}
+
+		var victim string
+		switch l.policy {
+		case OverflowDropOldest:
+			victim = "ORDER BY id ASC"
+		case OverflowDropLowestPriority:
+			// Only messages that are not more important than the new one
+			victim = "ORDER BY priority ASC, id ASC"
+		default:
+			return full
+		}
+
+		dropped, err := q.dropOne(ctx, tx, drops, l, victim, priority)
+		if err != nil {
+			return err
+		}
+		if !dropped {
+			return full
+		}
+	}
+}
+
+// dropOne deletes the first row matched by l in the given order and adds it
+// to drops. With drop_lowest_priority, rows with a higher priority than the
+// incoming message are never dropped. It reports false if nothing matched.
+func (q *SQLiteStore) dropOne(ctx context.Context, tx *sql.Tx, drops *[]drop, l limit, order string, priority int) (bool, error) {
+	where, args := l.where, l.args
+	if l.policy == OverflowDropLowestPriority {
+		if where == "" {
+			where = "WHERE priority <= ?"
+		} else {
+			where += " AND priority <= ?"
+		}
+		args = append(append([]interface{}(nil), args...), priority)
+	}
+
+	var id, size int64
+	var appKey string
+	err := tx.QueryRowContext(ctx, "SELECT id, app_key, size_bytes FROM messages "+where+" "+order+" LIMIT 1", args...).Scan(&id, &appKey, &size)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to find message to drop: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE id = ?", id); err != nil {
+		return false, fmt.Errorf("failed to drop message: %w", err)
+	}
+
+	*drops = append(*drops, drop{appKey: appKey, id: id, size: size, policy: l.policy, reason: l.reason})
+	return true, nil
+}
+
+// order returns the ORDER BY clause used to pick the next message
+// With aging, every PriorityAging interval a message has waited counts as
+// one extra priority level.
+func (q *SQLiteStore) order() string {
+	aging := q.opts.PriorityAging.Seconds()
+	if aging <= 0 {
+		return "priority DESC, id ASC"
+	}
+	return fmt.Sprintf("priority + (julianday('now') - julianday(created_at)) * 86400.0 / %g DESC, id ASC", aging)
+}
+
+// notExpired matches messages that are still deliverable at the Unix time
+// given as its single argument
+const notExpired = "(expires_at = 0 OR expires_at > ?)"
+
+// unixOrZero converts t to Unix seconds, mapping the zero time to 0
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// Expire removes messages whose TTL has passed and returns how many were
+// removed. Under ExpireDeadLetter they are moved to the dead_letters table
+// with reason "expired"; each is counted as a dead letter or a drop.
+func (q *SQLiteStore) Expire(ctx context.Context) (int, error) {
+	now := time.Now().Unix()
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT app_key, COUNT(*) FROM messages WHERE expires_at > 0 AND expires_at <= ? GROUP BY app_key", now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find expired messages: %w", err)
+	}
+	expired := make(map[string]int)
+	for rows.Next() {
+		var appKey string
+		var count int
+		if err := rows.Scan(&appKey, &count); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to find expired messages: %w", err)
+		}
+		expired[appKey] = count
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to find expired messages: %w", err)
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	const where = "expires_at > 0 AND expires_at <= ?"
+	if q.opts.Expiry == ExpireDeadLetter {
+		if err := moveToDeadLetters(ctx, tx, where, now, "expired"); err != nil {
+			return 0, err
+		}
+	} else if _, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE "+where, now); err != nil {
+		return 0, fmt.Errorf("failed to remove expired messages: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit expiry: %w", err)
+	}
+
+	return recordExpired(q.opts.Destination, q.opts.Expiry, expired), nil
+}
+
+// Scan calls fn for every unexpired message in ID order
+// Messages whose data can't be decoded are skipped (Lease quarantines them).
+func (q *SQLiteStore) Scan(ctx context.Context, fn func(*Message) error) error {
+	rows, err := q.db.QueryContext(ctx, `
+		SELECT id, app_key, data, created_at, attempts, trace_parent, priority, expires_at, sequence, encrypted
+		FROM messages
+		WHERE `+notExpired+`
+		ORDER BY id`, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to scan messages: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg Message
+		var dataJSON string
+		var expiresAt int64
+		err := rows.Scan(&msg.ID, &msg.AppKey, &dataJSON, &msg.CreatedAt, &msg.Attempts, &msg.TraceParent, &msg.Priority, &expiresAt, &msg.Sequence, &msg.Encrypted)
+		if err != nil {
+			return fmt.Errorf("failed to scan messages: %w", err)
+		}
+		if expiresAt > 0 {
+			msg.ExpiresAt = time.Unix(expiresAt, 0)
+		}
+		if err := json.Unmarshal([]byte(dataJSON), &msg.Data); err != nil {
+			continue
+		}
+		if err := fn(&msg); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Ack deletes a message from the queue, acknowledging its delivery
+func (q *SQLiteStore) Ack(ctx context.Context, id int64) error {
+	_, err := q.db.ExecContext(ctx, "DELETE FROM messages WHERE id = ?", id)
+	return err
+}
+
+// Pending returns the number of deliverable messages buffered for an app
+func (q *SQLiteStore) Pending(ctx context.Context, appKey string) (int, error) {
+	var count int
+	err := q.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM messages WHERE app_key = ? AND "+notExpired, appKey, time.Now().Unix()).Scan(&count)
+	return count, err
+}
+
+// NextSequence returns the app's next sequence number, starting at 1
+// Numbers are stored in the buffer database and survive restarts.
+func (q *SQLiteStore) NextSequence(ctx context.Context, appKey string) (int64, error) {
+	var seq int64
+	err := q.db.QueryRowContext(ctx, nextSequenceSQL, appKey).Scan(&seq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate sequence number: %w", err)
+	}
+	return seq, nil
+}
+
+// nextSequenceSQL increments an app's sequence counter and returns the new
+// value
+const nextSequenceSQL = `
+	INSERT INTO sequences (app_key, last) VALUES (?, 1)
+	ON CONFLICT (app_key) DO UPDATE SET last = last + 1
+	RETURNING last
+`
+
+// Size returns the number of messages in the queue
+func (q *SQLiteStore) Size(ctx context.Context) (int, error) {
+	var count int
+	err := q.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM messages").Scan(&count)
+	return count, err
+}
+
+// Bytes returns the total payload size of the messages in the queue
+func (q *SQLiteStore) Bytes(ctx context.Context) (int64, error) {
+	var bytes int64
+	err := q.db.QueryRowContext(ctx, "SELECT COALESCE(SUM(size_bytes), 0) FROM messages").Scan(&bytes)
+	return bytes, err
+}
+
+// Oldest returns the creation time of the oldest message
+// ok is false when the queue is empty.
+func (q *SQLiteStore) Oldest(ctx context.Context) (createdAt time.Time, ok bool, err error) {
+	err = q.db.QueryRowContext(ctx, "SELECT created_at FROM messages ORDER BY id ASC LIMIT 1").Scan(&createdAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return createdAt, true, nil
+}
+
+// Ping verifies the database can be written by inserting a row inside a
+// transaction that is always rolled back
+func (q *SQLiteStore) Ping(ctx context.Context) error {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO messages (app_key, data) VALUES ('', '{}')"); err != nil {
+		return fmt.Errorf("write failed: %w", err)
+	}
+	return nil
+}
+
+// checkIntegrity runs SQLite's integrity check
+func checkIntegrity(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA integrity_check(10)")
+	if err != nil {
+		return fmt.Errorf("failed to check database integrity: %w", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return fmt.Errorf("failed to check database integrity: %w", err)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to check database integrity: %w", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrCorrupt, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// asCorrupt wraps err in ErrCorrupt when SQLite reports the file as damaged
+// or not a database at all
+func asCorrupt(err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.Is(err, ErrCorrupt) || !errors.As(err, &sqliteErr) {
+		return err
+	}
+	// Extended result codes keep the primary code in the low byte
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_CORRUPT, sqlite3.SQLITE_NOTADB:
+		return fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+	return err
+}
+
+// dsn builds the driver connection string, applying pragmas to every
+// pooled connection
+func dsn(dbPath string, opts Options) string {
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", opts.BusyTimeout.Milliseconds()))
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "synchronous("+opts.Synchronous+")")
+	params.Set("_txlock", "immediate")
+	return dbPath + "?" + params.Encode()
+}
+
+// Close flushes the write-ahead log into the database file and closes the
+// database, so the file is complete on its own (e.g. for a backup)
+func (q *SQLiteStore) Close() error {
+	_, err := q.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	if cerr := q.db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to close database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// messageColumns are the columns dead_letters shares with messages
+const messageColumns = "id, app_key, data, created_at, attempts, trace_parent, priority, expires_at, sequence, encrypted"
+
+// moveToDeadLetters moves the messages matching where (with its single
+// argument) to the dead_letters table
+func moveToDeadLetters(ctx context.Context, tx *sql.Tx, where string, arg interface{}, reason string) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT OR REPLACE INTO dead_letters ("+messageColumns+", reason) SELECT "+messageColumns+", ? FROM messages WHERE "+where,
+		reason, arg)
+	if err != nil {
+		return fmt.Errorf("failed to move messages to dead letters: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE "+where, arg); err != nil {
+		return fmt.Errorf("failed to remove dead-lettered messages: %w", err)
+	}
+	return nil
+}
+
+// DeadLetter moves a message to the dead_letters table
+func (q *SQLiteStore) DeadLetter(ctx context.Context, id int64, reason string) error {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := moveToDeadLetters(ctx, tx, "id = ?", id, reason); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit dead letter: %w", err)
+	}
+	return nil
+}
+
+// DeadLetters calls fn for every dead letter in ID order
+// Dead letters whose data can't be decoded are skipped.
+func (q *SQLiteStore) DeadLetters(ctx context.Context, fn func(*DeadLetter) error) error {
+	rows, err := q.db.QueryContext(ctx, "SELECT "+messageColumns+", reason, dead_lettered_at FROM dead_letters ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("failed to read dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var dl DeadLetter
+		var dataJSON string
+		var expiresAt int64
+		err := rows.Scan(&dl.ID, &dl.AppKey, &dataJSON, &dl.CreatedAt, &dl.Attempts, &dl.TraceParent, &dl.Priority, &expiresAt, &dl.Sequence, &dl.Encrypted,
+			&dl.Reason, &dl.DeadLetteredAt)
+		if err != nil {
+			return fmt.Errorf("failed to read dead letters: %w", err)
+		}
+		if expiresAt > 0 {
+			dl.ExpiresAt = time.Unix(expiresAt, 0)
+		}
+		if err := json.Unmarshal([]byte(dataJSON), &dl.Data); err != nil {
+			continue
+		}
+		if err := fn(&dl); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// RemoveDeadLetters deletes dead letters by ID in one transaction
+func (q *SQLiteStore) RemoveDeadLetters(ctx context.Context, ids []int64) error {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Stay below SQLite's bound parameter limit
+	const chunk = 500
+	for start := 0; start < len(ids); start += chunk {
+		part := ids[start:min(start+chunk, len(ids))]
+		args := make([]interface{}, len(part))
+		for i, id := range part {
+			args[i] = id
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(part)), ",")
+		if _, err := tx.ExecContext(ctx, "DELETE FROM dead_letters WHERE id IN ("+placeholders+")", args...); err != nil {
+			return fmt.Errorf("failed to remove dead letters: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit dead letter removal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Lease hands out up to max deliverable messages and marks them as leased
+// for d, so no other caller receives them until they are removed, released
+// or the lease runs out. Leases are stored with the rows, so messages held
+// by a worker that crashed become available again once d has passed.
+//
+// Messages come in delivery order: highest effective priority first (see
+// Options.PriorityAging), with the app chosen by the DrainPolicy. Expired
+// messages are skipped and left for Expire to remove. Messages whose data
+// can't be decoded are moved to the quarantine table and counted as dead
+// letters.
+func (q *SQLiteStore) Lease(ctx context.Context, max int, d time.Duration) ([]*Message, error) {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	busy, err := q.leasedApps(ctx, tx, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	heads, err := q.heads(ctx, tx, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	where := notExpired + " AND leased_until <= ?"
+	args := []interface{}{now.Unix(), now.Unix()}
+
+	// Fair draining picks the app first, then its next messages
+	if q.drain.policy != DrainFIFO {
+		appKey, err := q.nextApp(ctx, tx, now.Unix(), busy)
+		if err != nil {
+			return nil, err
+		}
+		if appKey == "" {
+			return nil, nil
+		}
+		where += " AND app_key = ?"
+		args = append(args, appKey)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, app_key, data, created_at, attempts, trace_parent, priority, expires_at, sequence, encrypted
+		FROM messages
+		WHERE `+where+`
+		ORDER BY `+q.order(), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease messages: %w", err)
+	}
+
+	var leased []*Message
+	corrupt := make(map[int64]corruptRow)
+	for len(leased) < max && rows.Next() {
+		var msg Message
+		var dataJSON string
+		var expiresAt int64
+		err := rows.Scan(&msg.ID, &msg.AppKey, &dataJSON, &msg.CreatedAt, &msg.Attempts, &msg.TraceParent, &msg.Priority, &expiresAt, &msg.Sequence, &msg.Encrypted)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to lease messages: %w", err)
+		}
+		ordering := q.opts.quota(msg.AppKey).Ordering
+		if busy[msg.AppKey] && ordering != OrderingUnordered {
+			continue
+		}
+		if ordering == OrderingStrict {
+			// Only the app's oldest message, one per lease
+			if msg.ID != heads[msg.AppKey] {
+				continue
+			}
+		}
+		if expiresAt > 0 {
+			msg.ExpiresAt = time.Unix(expiresAt, 0)
+		}
+
+		// Parse data JSON
+		if err := json.Unmarshal([]byte(dataJSON), &msg.Data); err != nil {
+			corrupt[msg.ID] = corruptRow{appKey: msg.AppKey, err: err}
+			continue
+		}
+		leased = append(leased, &msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to lease messages: %w", err)
+	}
+	if len(corrupt) > 0 {
+		if err := quarantineRows(ctx, tx, corrupt); err != nil {
+			return nil, err
+		}
+	}
+	if len(leased) == 0 {
+		if len(corrupt) > 0 {
+			if err := tx.Commit(); err != nil {
+				return nil, fmt.Errorf("failed to commit quarantine: %w", err)
+			}
+			recordCorruptRows(q.opts.Destination, corrupt)
+		}
+		return nil, nil
+	}
+
+	ids := make([]interface{}, 0, len(leased)+1)
+	ids = append(ids, now.Add(d).Unix())
+	for _, msg := range leased {
+		ids = append(ids, msg.ID)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(leased)), ",")
+	if _, err := tx.ExecContext(ctx, "UPDATE messages SET leased_until = ? WHERE id IN ("+placeholders+")", ids...); err != nil {
+		return nil, fmt.Errorf("failed to lease messages: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit lease: %w", err)
+	}
+	recordCorruptRows(q.opts.Destination, corrupt)
+	return leased, nil
+}
+
+// corruptRow is a message whose data failed to decode
+type corruptRow struct {
+	appKey string
+	err    error
+}
+
+// quarantineRows moves messages to the quarantine table
+func quarantineRows(ctx context.Context, tx *sql.Tx, corrupt map[int64]corruptRow) error {
+	for id, row := range corrupt {
+		_, err := tx.ExecContext(ctx, `
+			INSERT OR REPLACE INTO quarantine (id, app_key, data, created_at, attempts, reason)
+			SELECT id, app_key, data, created_at, attempts, ? FROM messages WHERE id = ?`,
+			row.err.Error(), id)
+		if err != nil {
+			return fmt.Errorf("failed to quarantine message: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to quarantine message: %w", err)
+		}
+	}
+	return nil
+}
+
+// recordCorruptRows counts and logs quarantined messages once committed
+func recordCorruptRows(dest string, corrupt map[int64]corruptRow) {
+	for id, row := range corrupt {
+		recordCorrupt(dest, row.appKey, id, row.err)
+	}
+}
+
+// Release returns a leased message to the queue without counting an attempt
+func (q *SQLiteStore) Release(ctx context.Context, id int64) error {
+	_, err := q.db.ExecContext(ctx, "UPDATE messages SET leased_until = 0 WHERE id = ?", id)
+	return err
+}
+
+// Extend renews the leases of the messages among ids that are still leased
+// and returns how many were renewed
+func (q *SQLiteStore) Extend(ctx context.Context, ids []int64, d time.Duration) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	now := time.Now()
+	args := []interface{}{now.Add(d).Unix(), now.Unix()}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	res, err := q.db.ExecContext(ctx, "UPDATE messages SET leased_until = ? WHERE leased_until > ? AND id IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to extend leases: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Nack records a failed delivery attempt and keeps the message leased for
+// retryAfter, so it is retried no sooner than that
+func (q *SQLiteStore) Nack(ctx context.Context, id int64, retryAfter time.Duration) error {
+	_, err := q.db.ExecContext(ctx, "UPDATE messages SET attempts = attempts + 1, leased_until = ? WHERE id = ?",
+		time.Now().Add(retryAfter).Unix(), id)
+	return err
+}
+
+// heads returns the ID of each app's oldest deliverable message
+func (q *SQLiteStore) heads(ctx context.Context, tx *sql.Tx, now int64) (map[string]int64, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT app_key, MIN(id) FROM messages WHERE "+notExpired+" GROUP BY app_key", now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find oldest messages: %w", err)
+	}
+	defer rows.Close()
+
+	heads := make(map[string]int64)
+	for rows.Next() {
+		var appKey string
+		var id int64
+		if err := rows.Scan(&appKey, &id); err != nil {
+			return nil, fmt.Errorf("failed to find oldest messages: %w", err)
+		}
+		heads[appKey] = id
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to find oldest messages: %w", err)
+	}
+	return heads, nil
+}
+
+// leasedApps returns the apps that have messages under an active lease
+func (q *SQLiteStore) leasedApps(ctx context.Context, tx *sql.Tx, now int64) (map[string]bool, error) {
+	apps, err := listApps(ctx, tx, "SELECT DISTINCT app_key FROM messages WHERE leased_until > ?", now)
+	if err != nil {
+		return nil, err
+	}
+	busy := make(map[string]bool, len(apps))
+	for _, appKey := range apps {
+		busy[appKey] = true
+	}
+	return busy, nil
+}
+
+// nextApp asks the drain scheduler which app to serve next, among those
+// with messages that can be leased now
+func (q *SQLiteStore) nextApp(ctx context.Context, tx *sql.Tx, now int64, busy map[string]bool) (string, error) {
+	pending, err := listApps(ctx, tx, "SELECT DISTINCT app_key FROM messages WHERE "+notExpired+" AND leased_until <= ?", now, now)
+	if err != nil {
+		return "", err
+	}
+
+	var apps []string
+	for _, appKey := range pending {
+		if busy[appKey] && q.opts.quota(appKey).Ordering != OrderingUnordered {
+			continue
+		}
+		apps = append(apps, appKey)
+	}
+	return q.drain.next(apps, func(appKey string) int { return q.opts.quota(appKey).Weight }), nil
+}
+
+// listApps runs a query returning a single app_key column
+func listApps(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pending apps: %w", err)
+	}
+	defer rows.Close()
+
+	var apps []string
+	for rows.Next() {
+		var appKey string
+		if err := rows.Scan(&appKey); err != nil {
+			return nil, fmt.Errorf("failed to list pending apps: %w", err)
+		}
+		apps = append(apps, appKey)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list pending apps: %w", err)
+	}
+	return apps, nil
+}
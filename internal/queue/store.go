@@ -0,0 +1,349 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/logging"
+	"github.com/nexus/nexus-agent/internal/metrics"
+)
+
+// Store is an offline buffer for messages that couldn't be delivered
+//
+// A delivery worker leases a batch, sends each message and then Acks it,
+// Nacks it (failed attempt, retry later) or Releases it (not attempted).
+// Every operation except Close takes a context that bounds how long it may
+// wait, e.g. for SQLite's write lock. All implementations apply the same
+// quotas, overflow and expiry policies, priorities and ordering rules
+// described by Options.
+type Store interface {
+	// Enqueue adds a message and returns its ID (see SQLiteStore.Enqueue)
+	Enqueue(ctx context.Context, msg *Message) (int64, error)
+	// Lease hands out up to max messages in delivery order, reserving them
+	// for d (see SQLiteStore.Lease)
+	Lease(ctx context.Context, max int, d time.Duration) ([]*Message, error)
+	// Ack removes a delivered (or abandoned) message
+	Ack(ctx context.Context, id int64) error
+	// Nack records a failed attempt and holds the message back for retryAfter
+	Nack(ctx context.Context, id int64, retryAfter time.Duration) error
+	// Release returns a leased message without counting an attempt
+	Release(ctx context.Context, id int64) error
+	// Extend renews the leases of messages that are still leased, for d
+	// from now, and returns how many it renewed. A message whose lease has
+	// already run out may have been leased again and isn't renewed.
+	Extend(ctx context.Context, ids []int64, d time.Duration) (int, error)
+	// Expire removes messages past their TTL and returns how many; under
+	// ExpireDeadLetter they are moved to the dead letters
+	Expire(ctx context.Context) (int, error)
+	// DeadLetter moves a message to the dead letters, e.g. after a permanent
+	// delivery failure
+	DeadLetter(ctx context.Context, id int64, reason string) error
+	// DeadLetters calls fn for every dead letter in ID order, stopping at
+	// the first error
+	DeadLetters(ctx context.Context, fn func(*DeadLetter) error) error
+	// RemoveDeadLetters deletes dead letters, e.g. once they are exported
+	RemoveDeadLetters(ctx context.Context, ids []int64) error
+	// Scan calls fn for every unexpired message in ID order, leased or not,
+	// stopping at the first error
+	Scan(ctx context.Context, fn func(*Message) error) error
+
+	// Pending returns the number of deliverable messages for an app
+	Pending(ctx context.Context, appKey string) (int, error)
+	// NextSequence returns the app's next strict-ordering sequence number,
+	// for messages numbered before they are enqueued (Enqueue numbers the
+	// others itself)
+	NextSequence(ctx context.Context, appKey string) (int64, error)
+
+	// Size returns the number of buffered messages
+	Size(ctx context.Context) (int, error)
+	// Bytes returns the total payload size of buffered messages
+	Bytes(ctx context.Context) (int64, error)
+	// Oldest returns the creation time of the oldest message; ok is false
+	// when the store is empty
+	Oldest(ctx context.Context) (createdAt time.Time, ok bool, err error)
+	// Ping verifies the store can be written
+	Ping(ctx context.Context) error
+	// Close flushes and releases the store's resources
+	Close() error
+}
+
+var (
+	_ Store = (*SQLiteStore)(nil)
+	_ Store = (*FileStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+// Backend names a Store implementation
+type Backend string
+
+const (
+	// BackendSQLite stores messages in a SQLite database file
+	BackendSQLite Backend = "sqlite"
+	// BackendFile stores messages in an append-only segmented log directory
+	BackendFile Backend = "file"
+	// BackendMemory keeps messages in memory only; they are lost on restart
+	BackendMemory Backend = "memory"
+)
+
+// Open creates the store for a backend
+// path is the database file for BackendSQLite, the log directory for
+// BackendFile and ignored for BackendMemory. A store that fails its
+// integrity check is handled according to Options.Corruption.
+func Open(backend Backend, path string, opts Options) (Store, error) {
+	switch backend {
+	case BackendSQLite, "":
+		return openRecovering(func() (Store, error) {
+			store, err := NewSQLite(path, opts)
+			if err != nil {
+				return nil, err
+			}
+			return store, nil
+		}, path, opts.Corruption)
+	case BackendFile:
+		return openRecovering(func() (Store, error) {
+			store, err := NewFile(path, opts)
+			if err != nil {
+				return nil, err
+			}
+			return store, nil
+		}, path, opts.Corruption)
+	case BackendMemory:
+		return NewMemory(opts), nil
+	default:
+		return nil, fmt.Errorf("unknown queue backend %q", backend)
+	}
+}
+
+// Message represents a queued message
+type Message struct {
+	ID          int64
+	AppKey      string
+	Data        map[string]interface{}
+	CreatedAt   time.Time
+	Attempts    int
+	TraceParent string    // W3C traceparent of the request that queued the message
+	Priority    int       // Higher values are more important
+	ExpiresAt   time.Time // Zero means the message never expires
+	Sequence    int64     // Per-app sequence number under strict ordering (0 = none)
+	Encrypted   bool      // Data is already a crypto.EncryptedPayload (imported)
+
+	// LeasedFor, on Enqueue, leases the new message to the caller for this
+	// long, e.g. while it is sent directly (0 = available at once)
+	LeasedFor time.Duration
+}
+
+// DeadLetter is a message taken out of delivery and kept for inspection
+// Dead letters don't count towards the buffer's limits; they are kept
+// until removed (see "nexus-agent queue export -dead-letters -remove") or
+// trimmed by TrimDeadLetters.
+type DeadLetter struct {
+	Message
+	Reason         string // expired, max_attempts or permanent_error
+	DeadLetteredAt time.Time
+}
+
+// ErrFull is returned (wrapped) when a message can't be buffered because the
+// queue or the app's quota is full and the overflow policy is reject
+var ErrFull = errors.New("queue is full")
+
+// OverflowPolicy decides what happens when a limit would be exceeded
+type OverflowPolicy string
+
+const (
+	// OverflowReject refuses the new message
+	OverflowReject OverflowPolicy = "reject"
+	// OverflowDropOldest deletes the oldest message(s) to make room
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowDropLowestPriority deletes the oldest of the lowest-priority
+	// messages, never one more important than the new message
+	OverflowDropLowestPriority OverflowPolicy = "drop_lowest_priority"
+)
+
+// ExpiryPolicy decides what happens to expired messages
+type ExpiryPolicy string
+
+const (
+	// ExpireDeadLetter moves expired messages to the dead letters
+	ExpireDeadLetter ExpiryPolicy = "dead_letter"
+	// ExpireDrop deletes expired messages
+	ExpireDrop ExpiryPolicy = "drop"
+)
+
+// Ordering decides whether an app's messages may be sent concurrently
+type Ordering string
+
+const (
+	// OrderingOrdered sends an app's messages one at a time in queue order:
+	// while any of its messages is leased, no other is handed out
+	OrderingOrdered Ordering = "ordered"
+	// OrderingUnordered lets several workers send an app's messages at once
+	OrderingUnordered Ordering = "unordered"
+	// OrderingStrict is ordered delivery in arrival order, ignoring
+	// priorities. Callers also queue new messages behind pending ones
+	// instead of sending them directly (see Pending).
+	OrderingStrict Ordering = "strict"
+)
+
+// Quota limits how much of the buffer a single app may use and how its
+// messages are delivered. Zero limits mean unlimited (only the global
+// limits apply).
+type Quota struct {
+	MaxMessages int
+	MaxBytes    int64
+	Overflow    OverflowPolicy // Default: the global policy
+	Weight      int            // Share of draining under DrainWeighted (default: 1)
+	Ordering    Ordering       // Default: the global ordering
+}
+
+// Options configures a Store
+type Options struct {
+	// Destination is the name of the destination the store buffers for,
+	// used to label its metrics and logs
+	Destination string
+
+	MaxSize  int   // Maximum number of messages
+	MaxBytes int64 // Maximum total payload size (0 = unlimited)
+	Overflow OverflowPolicy
+	Drain    DrainPolicy
+
+	// PriorityAging raises a waiting message's effective priority by one
+	// for every interval spent in the queue, so low priorities aren't
+	// starved (0 = strict priority order)
+	PriorityAging time.Duration
+
+	// Expiry decides whether messages past their TTL are kept as dead
+	// letters or deleted
+	Expiry ExpiryPolicy
+
+	// Ordering is the default delivery ordering for each app
+	Ordering Ordering
+
+	// Synchronous is normal (default) or full. With full every write is
+	// flushed to disk before returning (SQLite synchronous=FULL, fsync for
+	// the file log); normal may lose the last writes on power loss.
+	Synchronous string
+	// BusyTimeout is how long a SQLite write waits for the database lock
+	// (default: 5s)
+	BusyTimeout time.Duration
+	// SegmentSize is the size at which the file log starts a new segment
+	// (default: 16 MiB)
+	SegmentSize int64
+
+	// Corruption decides what Open does with a store that fails its
+	// integrity check (default: quarantine)
+	Corruption CorruptionPolicy
+
+	// AppQuota returns the quota for an app; nil means no per-app quotas
+	AppQuota func(appKey string) Quota
+}
+
+// withDefaults fills in unset options
+func (o Options) withDefaults() Options {
+	if o.Overflow == "" {
+		o.Overflow = OverflowReject
+	}
+	if o.Expiry == "" {
+		o.Expiry = ExpireDeadLetter
+	}
+	if o.Ordering == "" {
+		o.Ordering = OrderingOrdered
+	}
+	if o.Synchronous == "" {
+		o.Synchronous = "normal"
+	}
+	if o.BusyTimeout <= 0 {
+		o.BusyTimeout = 5 * time.Second
+	}
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = 16 << 20
+	}
+	if o.Corruption == "" {
+		o.Corruption = CorruptionQuarantine
+	}
+	return o
+}
+
+// quota returns the app's quota with defaults applied
+func (o Options) quota(appKey string) Quota {
+	var quota Quota
+	if o.AppQuota != nil {
+		quota = o.AppQuota(appKey)
+	}
+	if quota.Overflow == "" {
+		quota.Overflow = o.Overflow
+	}
+	if quota.Weight < 1 {
+		quota.Weight = 1
+	}
+	if quota.Ordering == "" {
+		quota.Ordering = o.Ordering
+	}
+	return quota
+}
+
+// drop is a message removed by an overflow policy
+type drop struct {
+	appKey string
+	id     int64
+	size   int64
+	policy OverflowPolicy
+	reason string
+}
+
+// recordDrop counts and logs a message dropped by an overflow policy
+// Call it only once the removal is durable.
+func recordDrop(dest string, d drop) {
+	metrics.Dropped.Inc(dest, d.appKey, d.reason)
+	slog.Warn("Dropped buffered message to make room",
+		"destination", dest, logging.AppKey(d.appKey), logging.MessageID(d.id),
+		"size_bytes", d.size, "policy", string(d.policy), "reason", d.reason)
+}
+
+// recordExpired counts and logs messages removed by Expire, per app
+func recordExpired(dest string, policy ExpiryPolicy, expired map[string]int) int {
+	total := 0
+	for appKey, count := range expired {
+		if policy == ExpireDrop {
+			metrics.Dropped.Add(float64(count), dest, appKey, "expired")
+		} else {
+			metrics.DeadLettered.Add(float64(count), dest, appKey, "expired")
+		}
+		slog.Warn("Removed expired buffered messages", "destination", dest, logging.AppKey(appKey), "count", count, "policy", string(policy))
+		total += count
+	}
+	return total
+}
+
+// TrimDeadLetters removes dead letters older than retention and, oldest
+// first, any beyond max (zero disables either limit). It returns how many
+// were removed.
+func TrimDeadLetters(ctx context.Context, s Store, max int, retention time.Duration) (int, error) {
+	var remove, kept []int64
+	err := s.DeadLetters(ctx, func(dl *DeadLetter) error {
+		if retention > 0 && time.Since(dl.DeadLetteredAt) > retention {
+			remove = append(remove, dl.ID)
+		} else {
+			kept = append(kept, dl.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Dead letters are listed in ID order, so the oldest come first
+	if max > 0 && len(kept) > max {
+		remove = append(remove, kept[:len(kept)-max]...)
+	}
+	if len(remove) == 0 {
+		return 0, nil
+	}
+
+	if err := s.RemoveDeadLetters(ctx, remove); err != nil {
+		return 0, err
+	}
+	slog.Warn("Removed old dead letters", "count", len(remove), "max", max, "retention", retention)
+	return len(remove), nil
+}
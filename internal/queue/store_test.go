@@ -0,0 +1,89 @@
+package queue
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// backends lists every Store implementation for tests that must hold for
+// all of them
+var backends = []Backend{BackendSQLite, BackendFile, BackendMemory}
+
+// openTestStore opens a store of the given backend in a temporary directory
+// and closes it when the test ends
+func openTestStore(t *testing.T, backend Backend, opts Options) Store {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "queue")
+	if backend == BackendSQLite {
+		path += ".db"
+	}
+	q, err := Open(backend, path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+// forEachBackend runs fn as a subtest against a new store of each backend
+func forEachBackend(t *testing.T, opts Options, fn func(t *testing.T, q Store)) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			fn(t, openTestStore(t, backend, opts))
+		})
+	}
+}
+
+// enqueue adds a message for appKey and returns its ID
+func enqueue(t *testing.T, q Store, msg *Message) int64 {
+	t.Helper()
+	if msg.Data == nil {
+		msg.Data = map[string]interface{}{"v": 1.0}
+	}
+	id, err := q.Enqueue(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// leaseIDs leases up to max messages and returns their IDs in order
+func leaseIDs(t *testing.T, q Store, max int) []int64 {
+	t.Helper()
+	msgs, err := q.Lease(context.Background(), max, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int64, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	return ids
+}
+
+// segmentFiles returns the log segments in dir, oldest first
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// bufferedIDs returns the IDs of every buffered message
+func bufferedIDs(t *testing.T, q Store) []int64 {
+	t.Helper()
+	var ids []int64
+	if err := q.Scan(context.Background(), func(msg *Message) error {
+		ids = append(ids, msg.ID)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
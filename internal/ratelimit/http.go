@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/auth"
+	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/logging"
+	"github.com/nexus/nexus-agent/internal/metrics"
+)
+
+// Ingress applies the configured per-client and per-app limits to /send
+type Ingress struct {
+	config  *config.Config
+	clients *Limiter
+	apps    *Limiter
+}
+
+// NewIngress creates the /send rate limiter
+func NewIngress(cfg *config.Config) *Ingress {
+	return &Ingress{
+		config:  cfg,
+		clients: New(),
+		apps:    New(),
+	}
+}
+
+// ClientMiddleware limits requests per auth identity, or per client IP when
+// the request is unauthenticated. It must run after the auth middleware.
+func (i *Ingress) ClientMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := clientKey(r)
+		ok, wait := i.clients.Allow(key, toLimit(i.config.Agent.RateLimit.PerClient))
+		if !ok {
+			metrics.RateLimited.Inc("client")
+			slog.Warn("Client rate limited", "client", key, "retry_after", wait.String())
+			WriteLimited(w, "rate limit exceeded for client", wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AllowApp takes a token from the app's bucket
+// The limit comes from the app's own rate_limit (static or synced) when set,
+// otherwise from agent.rate_limit.per_app.
+func (i *Ingress) AllowApp(appKey string) (bool, time.Duration) {
+	limit := i.config.Agent.RateLimit.PerApp
+	if app := i.config.GetAppByKey(appKey); app != nil && app.RateLimit != nil {
+		limit = *app.RateLimit
+	}
+
+	ok, wait := i.apps.Allow(appKey, toLimit(limit))
+	if !ok {
+		metrics.RateLimited.Inc("app")
+		slog.Warn("App rate limited", logging.AppKey(appKey), "retry_after", wait.String())
+	}
+	return ok, wait
+}
+
+// WriteLimited sends a 429 response with a Retry-After header in whole seconds
+func WriteLimited(w http.ResponseWriter, message string, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(errorResponse{Success: false, Message: message})
+}
+
+// errorResponse matches the handler's SendResponse shape
+type errorResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// clientKey identifies the caller for per-client limits
+func clientKey(r *http.Request) string {
+	if id := auth.FromContext(r.Context()); id != nil {
+		return "id:" + id.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || host == "" {
+		// Unix socket connections have no IP
+		return "local"
+	}
+	return "ip:" + host
+}
+
+func toLimit(l config.RateLimit) Limit {
+	return Limit{Rate: l.Rate, Burst: l.Burst}
+}
@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced time source
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestLimiter() (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	l := New()
+	l.now = clock.Now
+	return l, clock
+}
+
+// take calls Allow n times and returns how many were allowed
+func take(l *Limiter, key string, limit Limit, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if ok, _ := l.Allow(key, limit); ok {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestAllowBurst(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit Limit
+		want  int
+	}{
+		{"explicit burst", Limit{Rate: 1, Burst: 5}, 5},
+		{"burst defaults to rate", Limit{Rate: 3}, 3},
+		{"fractional rate rounds up", Limit{Rate: 2.5}, 3},
+		{"slow rate allows one", Limit{Rate: 0.1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := newTestLimiter()
+			if got := take(l, "k", tt.limit, 20); got != tt.want {
+				t.Errorf("allowed %d of 20 at once, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowUnlimited(t *testing.T) {
+	l, _ := newTestLimiter()
+	if got := take(l, "k", Limit{}, 1000); got != 1000 {
+		t.Errorf("allowed %d of 1000 with no rate, want all", got)
+	}
+}
+
+func TestAllowRefill(t *testing.T) {
+	l, clock := newTestLimiter()
+	limit := Limit{Rate: 2, Burst: 4}
+
+	if got := take(l, "k", limit, 4); got != 4 {
+		t.Fatalf("initial burst allowed %d, want 4", got)
+	}
+
+	ok, wait := l.Allow("k", limit)
+	if ok {
+		t.Fatal("allowed with an empty bucket")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %v, want 500ms at 2/s", wait)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if ok, _ := l.Allow("k", limit); !ok {
+		t.Error("not allowed after refilling one token")
+	}
+
+	// Refill is capped at the burst
+	clock.Advance(time.Hour)
+	if got := take(l, "k", limit, 10); got != 4 {
+		t.Errorf("allowed %d after a long idle period, want the burst of 4", got)
+	}
+}
+
+func TestAllowWaitPartialToken(t *testing.T) {
+	l, clock := newTestLimiter()
+	limit := Limit{Rate: 1, Burst: 1}
+
+	l.Allow("k", limit)
+	clock.Advance(250 * time.Millisecond)
+	if ok, wait := l.Allow("k", limit); ok || wait != 750*time.Millisecond {
+		t.Errorf("Allow = %v, %v; want false, 750ms", ok, wait)
+	}
+}
+
+func TestAllowKeysAreIndependent(t *testing.T) {
+	l, _ := newTestLimiter()
+	limit := Limit{Rate: 1, Burst: 1}
+
+	if ok, _ := l.Allow("a", limit); !ok {
+		t.Fatal("first request for a denied")
+	}
+	if ok, _ := l.Allow("b", limit); !ok {
+		t.Error("b limited by a's bucket")
+	}
+}
+
+func TestAllowLimitChangeResetsBucket(t *testing.T) {
+	l, _ := newTestLimiter()
+	take(l, "k", Limit{Rate: 1, Burst: 1}, 1)
+
+	if ok, _ := l.Allow("k", Limit{Rate: 10, Burst: 10}); !ok {
+		t.Error("a raised limit should start with a full bucket")
+	}
+}
+
+func TestSweepEvictsIdleBuckets(t *testing.T) {
+	l, clock := newTestLimiter()
+	limit := Limit{Rate: 1, Burst: 1}
+	l.Allow("idle", limit)
+
+	clock.Advance(idleTTL + time.Second)
+	l.Allow("active", limit)
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("idle bucket not evicted")
+	}
+	if _, ok := l.buckets["active"]; !ok {
+		t.Error("active bucket evicted")
+	}
+}
+
+func TestWriteLimited(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{200 * time.Millisecond, "1"},
+		{1500 * time.Millisecond, "2"},
+		{0, "1"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		WriteLimited(w, "slow down", tt.wait)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("status = %d, want 429", w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != tt.want {
+			t.Errorf("Retry-After for %v = %q, want %q", tt.wait, got, tt.want)
+		}
+	}
+}
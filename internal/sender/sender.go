@@ -2,30 +2,89 @@ package sender
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/nexus/nexus-agent/internal/config"
 	"github.com/nexus/nexus-agent/internal/crypto"
+	"github.com/nexus/nexus-agent/internal/logging"
+	"github.com/nexus/nexus-agent/internal/metrics"
+	"github.com/nexus/nexus-agent/internal/tracing"
+	"github.com/nexus/nexus-agent/internal/upstream"
 )
 
-// Sender handles sending encrypted data to the Nexus server
+// Sender handles sending encrypted data to one destination: a Nexus server
+// or a local archive
 type Sender struct {
 	config *config.Config
+	dest   config.DestinationConfig
+	pool   *upstream.Pool // nil for an archive
 	client *http.Client
+
+	archiveMu sync.Mutex // Keeps archive lines whole
+
+	mu     sync.Mutex
+	status Status
 }
 
-// New creates a new Sender instance
-func New(cfg *config.Config) *Sender {
-	return &Sender{
+// Status describes the outcome of recent sends
+type Status struct {
+	LastSuccess time.Time
+	LastFailure time.Time
+	LastError   string
+}
+
+// New creates a Sender for a destination; a Nexus destination is sent to
+// via the endpoints of pool
+func New(cfg *config.Config, dest config.DestinationConfig, pool *upstream.Pool) *Sender {
+	s := &Sender{
 		config: cfg,
+		dest:   dest,
+		pool:   pool,
 		client: &http.Client{
-			Timeout: cfg.Nexus.Timeout,
+			Timeout: dest.Timeout,
 		},
 	}
+	if pool != nil {
+		s.client.Transport = pool.Transport()
+	}
+	return s
+}
+
+// Destination returns the name of the sender's destination
+func (s *Sender) Destination() string {
+	return s.dest.Name
+}
+
+// RetryAttempts returns how often a send to the destination is tried
+func (s *Sender) RetryAttempts() int {
+	return s.dest.RetryAttempts
+}
+
+// Status returns the outcome of recent sends
+func (s *Sender) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// SequenceHeader carries a message's per-app sequence number to Nexus
+const SequenceHeader = "X-Nexus-Sequence"
+
+type sequenceKey struct{}
+
+// WithSequence returns a context whose sends carry seq in SequenceHeader
+func WithSequence(ctx context.Context, seq int64) context.Context {
+	return context.WithValue(ctx, sequenceKey{}, seq)
 }
 
 // SendResult contains the result of a send operation
@@ -36,10 +95,87 @@ type SendResult struct {
 }
 
 // Send encrypts and sends data to the Nexus server
-func (s *Sender) Send(appKey string, data map[string]interface{}) SendResult {
-	// Find the app configuration
-	appConfig := s.config.GetAppByKey(appKey)
-	if appConfig == nil {
+// The trace context in ctx is propagated to Nexus via the traceparent header,
+// and a sequence number set with WithSequence via SequenceHeader.
+func (s *Sender) Send(ctx context.Context, appKey string, data map[string]interface{}) SendResult {
+	return s.observe(ctx, appKey, func(ctx context.Context) SendResult {
+		return s.send(ctx, appKey, data)
+	})
+}
+
+// SendEncrypted sends a payload that was encrypted earlier, such as a
+// message imported from another agent, as is. The app doesn't have to be
+// configured since its master secret isn't needed; if it is, the payload is
+// sent as the app's key for this destination, which it was encrypted with.
+func (s *Sender) SendEncrypted(ctx context.Context, appKey string, payload *crypto.EncryptedPayload) SendResult {
+	return s.observe(ctx, appKey, func(ctx context.Context) SendResult {
+		apiKey := appKey
+		if key, _, ok := s.config.AppCredentials(appKey, s.dest.Name); ok {
+			apiKey = key
+		}
+		bodyJSON, err := json.Marshal(payload)
+		if err != nil {
+			return SendResult{
+				Success: false,
+				Message: fmt.Sprintf("failed to marshal body: %v", err),
+				Retry:   false,
+			}
+		}
+		return s.deliver(ctx, appKey, apiKey, bodyJSON)
+	})
+}
+
+// observe wraps a send in a span and records its metrics
+func (s *Sender) observe(ctx context.Context, appKey string, send func(ctx context.Context) SendResult) SendResult {
+	ctx, span := tracing.Start(ctx, "sender.send", tracing.KindInternal)
+	defer span.End()
+	span.SetAttr(logging.KeyAppKey, appKey)
+	span.SetAttr("destination", s.dest.Name)
+
+	start := time.Now()
+	result := send(ctx)
+	if !result.Success {
+		span.SetError(result.Message)
+	}
+	s.record(ctx, result)
+
+	metrics.SendDuration.Observe(time.Since(start).Seconds(), appKey)
+	switch {
+	case result.Success:
+		metrics.Sends.Inc(appKey, "success")
+	case result.Retry:
+		metrics.Sends.Inc(appKey, "retryable")
+	default:
+		metrics.Sends.Inc(appKey, "failed")
+	}
+
+	return result
+}
+
+// record updates the destination's status and metrics with a send result
+// Sends abandoned by their caller say nothing about the destination.
+func (s *Sender) record(ctx context.Context, result SendResult) {
+	if !result.Success && ctx.Err() != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if result.Success {
+		s.status.LastSuccess = time.Now()
+		metrics.DestinationSends.Inc(s.dest.Name, "success")
+		return
+	}
+	s.status.LastFailure = time.Now()
+	s.status.LastError = result.Message
+	metrics.DestinationSends.Inc(s.dest.Name, "failure")
+}
+
+// send does the work for Send
+func (s *Sender) send(ctx context.Context, appKey string, data map[string]interface{}) SendResult {
+	// Find the app's credentials for this destination
+	apiKey, masterSecret, ok := s.config.AppCredentials(appKey, s.dest.Name)
+	if !ok {
 		return SendResult{
 			Success: false,
 			Message: fmt.Sprintf("unknown app_key: %s", appKey),
@@ -48,8 +184,9 @@ func (s *Sender) Send(appKey string, data map[string]interface{}) SendResult {
 	}
 
 	// Encrypt the data using the Nexus Enigma format
-	encryptedPayload, err := crypto.EncryptPayload(data, appConfig.MasterSecret, appKey)
+	encryptedPayload, err := crypto.EncryptPayload(data, masterSecret, apiKey)
 	if err != nil {
+		metrics.EncryptionErrors.Inc(appKey)
 		return SendResult{
 			Success: false,
 			Message: fmt.Sprintf("encryption failed: %v", err),
@@ -67,15 +204,31 @@ func (s *Sender) Send(appKey string, data map[string]interface{}) SendResult {
 		}
 	}
 
-	// Send to Nexus with retry
+	return s.deliver(ctx, appKey, apiKey, bodyJSON)
+}
+
+// deliver posts an encrypted body to the destination as apiKey, retrying
+// retryable failures. Cancelling ctx abandons the send, and no retry is
+// started that couldn't begin before ctx's deadline. The result is then
+// retryable so the caller can buffer the data.
+func (s *Sender) deliver(ctx context.Context, appKey, apiKey string, bodyJSON []byte) SendResult {
 	var lastErr error
-	for attempt := 1; attempt <= s.config.Nexus.RetryAttempts; attempt++ {
-		result := s.doSend(appKey, appConfig.MasterSecret, bodyJSON)
+	for attempt := 1; attempt <= s.dest.RetryAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return interrupted(err)
+		}
+
+		var result SendResult
+		if s.dest.Type == config.DestinationArchive {
+			result = s.archive(ctx, apiKey, bodyJSON)
+		} else {
+			result = s.attempt(ctx, appKey, apiKey, attempt, bodyJSON)
+		}
 		if result.Success {
 			return result
 		}
 
-		lastErr = fmt.Errorf(result.Message)
+		lastErr = errors.New(result.Message)
 
 		// If not retryable, return immediately
 		if !result.Retry {
@@ -83,8 +236,27 @@ func (s *Sender) Send(appKey string, data map[string]interface{}) SendResult {
 		}
 
 		// Wait before retry
-		if attempt < s.config.Nexus.RetryAttempts {
-			time.Sleep(s.config.Nexus.RetryDelay)
+		if attempt < s.dest.RetryAttempts {
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < s.dest.RetryDelay {
+				return SendResult{
+					Success: false,
+					Message: fmt.Sprintf("no time left to retry: %v", lastErr),
+					Retry:   true,
+				}
+			}
+			metrics.SendRetries.Inc(appKey)
+			slog.Warn("Upstream send failed, retrying",
+				logging.AppKey(appKey),
+				logging.Attempt(attempt),
+				"destination", s.dest.Name,
+				"reason", result.Message,
+				"retry_in", s.dest.RetryDelay.String(),
+			)
+			select {
+			case <-ctx.Done():
+				return interrupted(ctx.Err())
+			case <-time.After(s.dest.RetryDelay):
+			}
 		}
 	}
 
@@ -95,11 +267,112 @@ func (s *Sender) Send(appKey string, data map[string]interface{}) SendResult {
 	}
 }
 
+// interrupted is the result of a send abandoned because its context ended
+func interrupted(err error) SendResult {
+	return SendResult{
+		Success: false,
+		Message: fmt.Sprintf("send interrupted: %v", err),
+		Retry:   true,
+	}
+}
+
+// attempt tries the endpoints in the pool's order until one accepts the
+// body or rejects it permanently. Endpoints that fail with a transport error
+// or 5xx are marked down.
+func (s *Sender) attempt(ctx context.Context, appKey, apiKey string, attempt int, body []byte) SendResult {
+	var result SendResult
+	for _, ep := range s.pool.Order() {
+		start := time.Now()
+		result = s.doSend(ctx, ep, apiKey, attempt, body)
+		slog.Debug("Upstream send attempt",
+			logging.AppKey(appKey),
+			logging.Attempt(attempt),
+			"destination", s.dest.Name,
+			"endpoint", ep.Name,
+			logging.Duration(time.Since(start)),
+			"success", result.Success,
+		)
+		if result.Success || !result.Retry {
+			ep.Succeeded(upstream.KindIngress)
+			return result
+		}
+		if ctx.Err() != nil {
+			// Abandoned, not the endpoint's fault
+			return result
+		}
+		ep.Failed(upstream.KindIngress, errors.New(result.Message))
+	}
+	return result
+}
+
+// archiveRecord is one line of an archive destination's file
+type archiveRecord struct {
+	AppKey     string          `json:"app_key"`
+	Sequence   int64           `json:"sequence,omitempty"`
+	ArchivedAt time.Time       `json:"archived_at"`
+	Payload    json.RawMessage `json:"payload"` // The encrypted payload, as sent to Nexus
+}
+
+// archive appends an encrypted body to an archive destination's file
+func (s *Sender) archive(ctx context.Context, apiKey string, body []byte) SendResult {
+	record := archiveRecord{AppKey: apiKey, ArchivedAt: time.Now().UTC(), Payload: body}
+	if seq, ok := ctx.Value(sequenceKey{}).(int64); ok {
+		record.Sequence = seq
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return SendResult{
+			Success: false,
+			Message: fmt.Sprintf("failed to marshal archive record: %v", err),
+			Retry:   false,
+		}
+	}
+	line = append(line, '\n')
+
+	s.archiveMu.Lock()
+	defer s.archiveMu.Unlock()
+
+	f, err := os.OpenFile(s.dest.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err == nil {
+		_, err = f.Write(line)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return SendResult{
+			Success: false,
+			Message: fmt.Sprintf("failed to write archive: %v", err),
+			Retry:   true,
+		}
+	}
+	return SendResult{
+		Success: true,
+		Message: "data archived",
+		Retry:   false,
+	}
+}
+
 // doSend performs the actual HTTP request
-func (s *Sender) doSend(appKey, masterSecret string, body []byte) SendResult {
-	url := fmt.Sprintf("%s/ingress", s.config.Nexus.ServerURL)
+func (s *Sender) doSend(ctx context.Context, ep *upstream.Endpoint, apiKey string, attempt int, body []byte) SendResult {
+	ctx, span := tracing.Start(ctx, "POST /ingress", tracing.KindClient)
+	defer span.End()
+	span.SetAttr(logging.KeyAttempt, attempt)
+	span.SetAttr("endpoint", ep.Name)
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	result := s.post(ctx, span, ep, apiKey, body)
+	if !result.Success {
+		span.SetError(result.Message)
+	}
+	return result
+}
+
+// post sends the encrypted body to the Nexus ingress endpoint
+func (s *Sender) post(ctx context.Context, span *tracing.Span, ep *upstream.Endpoint, apiKey string, body []byte) SendResult {
+	url := fmt.Sprintf("%s/ingress", ep.URL)
+	span.SetAttr("http.url", url)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
 		return SendResult{
 			Success: false,
@@ -110,11 +383,17 @@ func (s *Sender) doSend(appKey, masterSecret string, body []byte) SendResult {
 
 	// Set headers
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-API-Key", appKey) // Nexus API expects X-API-Key
+	req.Header.Set("X-API-Key", apiKey) // Nexus API expects X-API-Key
+	tracing.Inject(ctx, req.Header)
+	if seq, ok := ctx.Value(sequenceKey{}).(int64); ok && seq > 0 {
+		req.Header.Set(SequenceHeader, strconv.FormatInt(seq, 10))
+		span.SetAttr("sequence", seq)
+	}
 
 	// Send request
 	resp, err := s.client.Do(req)
 	if err != nil {
+		metrics.UpstreamResponses.Inc("error")
 		return SendResult{
 			Success: false,
 			Message: fmt.Sprintf("request failed: %v", err),
@@ -122,6 +401,8 @@ func (s *Sender) doSend(appKey, masterSecret string, body []byte) SendResult {
 		}
 	}
 	defer resp.Body.Close()
+	metrics.UpstreamResponses.Inc(strconv.Itoa(resp.StatusCode))
+	span.SetAttr("http.status_code", resp.StatusCode)
 
 	// Read response
 	respBody, _ := io.ReadAll(resp.Body)
@@ -0,0 +1,165 @@
+package sender
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/crypto"
+	"github.com/nexus/nexus-agent/internal/upstream"
+)
+
+// testSecret is a base64 master secret
+const testSecret = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+// recorder is an ingress endpoint answering with status and recording the
+// API keys it was sent
+type recorder struct {
+	status int
+	mu     sync.Mutex
+	keys   []string
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.keys = append(r.keys, req.Header.Get("X-API-Key"))
+	r.mu.Unlock()
+	w.WriteHeader(r.status)
+}
+
+func (r *recorder) sent() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.keys...)
+}
+
+// newTestSender returns a sender for a destination named name with the
+// given endpoints, tried once each
+func newTestSender(cfg *config.Config, name string, urls ...string) *Sender {
+	dest := config.DestinationConfig{
+		Name:          name,
+		Type:          config.DestinationNexus,
+		Strategy:      string(upstream.StrategyFailover),
+		Timeout:       5 * time.Second,
+		RetryAttempts: 1,
+	}
+	for _, url := range urls {
+		dest.Endpoints = append(dest.Endpoints, config.EndpointConfig{URL: url})
+	}
+	pool := upstream.New(dest.Endpoints, upstream.Options{Strategy: upstream.StrategyFailover})
+	return New(cfg, dest, pool)
+}
+
+func TestSendEncryptedDestinationKey(t *testing.T) {
+	rec := &recorder{status: http.StatusOK}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	cfg := &config.Config{Apps: []config.AppConfig{{
+		AppKey:       "local",
+		MasterSecret: testSecret,
+		Destinations: []config.AppDestination{{Name: "staging", AppKey: "staging-key", MasterSecret: testSecret}},
+	}}}
+	s := newTestSender(cfg, "staging", srv.URL)
+	payload, err := crypto.EncryptPayload(map[string]interface{}{"v": 1}, testSecret, "staging-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if result := s.SendEncrypted(ctx, "local", payload); !result.Success {
+		t.Fatalf("send failed: %s", result.Message)
+	}
+	// An app this agent doesn't know is sent as its own key
+	if result := s.SendEncrypted(ctx, "foreign", payload); !result.Success {
+		t.Fatalf("send failed: %s", result.Message)
+	}
+	if keys := rec.sent(); len(keys) != 2 || keys[0] != "staging-key" || keys[1] != "foreign" {
+		t.Errorf("sent as %v, want [staging-key foreign]", keys)
+	}
+}
+
+func TestSendFailsOver(t *testing.T) {
+	down := &recorder{status: http.StatusServiceUnavailable}
+	up := &recorder{status: http.StatusOK}
+	first, second := httptest.NewServer(down), httptest.NewServer(up)
+	defer first.Close()
+	defer second.Close()
+
+	cfg := &config.Config{Apps: []config.AppConfig{{AppKey: "app", MasterSecret: testSecret}}}
+	s := newTestSender(cfg, "nexus", first.URL, second.URL)
+
+	for i := 0; i < 2; i++ {
+		if result := s.Send(context.Background(), "app", map[string]interface{}{"v": i}); !result.Success {
+			t.Fatalf("send %d failed: %s", i, result.Message)
+		}
+	}
+	// The failing endpoint is marked down and skipped by the next send
+	if n := len(down.sent()); n != 1 {
+		t.Errorf("failing endpoint got %d requests, want 1", n)
+	}
+	if n := len(up.sent()); n != 2 {
+		t.Errorf("healthy endpoint got %d requests, want 2", n)
+	}
+	if s.pool.Endpoints()[0].Status().Up {
+		t.Error("failing endpoint still up")
+	}
+}
+
+func TestSendInterrupted(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	cfg := &config.Config{Apps: []config.AppConfig{{AppKey: "app", MasterSecret: testSecret}}}
+	s := newTestSender(cfg, "nexus", srv.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	result := s.Send(ctx, "app", map[string]interface{}{"v": 1})
+	if result.Success || !result.Retry {
+		t.Errorf("result = %+v, want a retryable failure", result)
+	}
+	// An abandoned send says nothing about the destination
+	if status := s.Status(); !status.LastFailure.IsZero() {
+		t.Errorf("status = %+v, want no failure recorded", status)
+	}
+	if !s.pool.Endpoints()[0].Status().Up {
+		t.Error("endpoint marked down for an abandoned send")
+	}
+}
+
+func TestSendNoTimeToRetry(t *testing.T) {
+	rec := &recorder{status: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	// The retry delay is longer than what is left of the deadline
+	cfg := &config.Config{Apps: []config.AppConfig{{AppKey: "app", MasterSecret: testSecret}}}
+	dest := config.DestinationConfig{
+		Name:          "nexus",
+		Type:          config.DestinationNexus,
+		Endpoints:     []config.EndpointConfig{{URL: srv.URL}},
+		Timeout:       5 * time.Second,
+		RetryAttempts: 3,
+		RetryDelay:    time.Second,
+	}
+	s := New(cfg, dest, upstream.New(dest.Endpoints, upstream.Options{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	result := s.Send(ctx, "app", map[string]interface{}{"v": 1})
+	if result.Success || !result.Retry {
+		t.Errorf("result = %+v, want a retryable failure", result)
+	}
+	if n := len(rec.sent()); n != 1 {
+		t.Errorf("ingress got %d requests, want 1", n)
+	}
+}
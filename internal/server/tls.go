@@ -0,0 +1,334 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/logging"
+)
+
+// TLSVersions maps config values to crypto/tls versions
+var TLSVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// selfSignedValidity is how long a generated certificate is valid
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// renewBefore is how long before its expiry a self-signed certificate is
+// replaced, and a loaded one is warned about
+const renewBefore = 30 * 24 * time.Hour
+
+// NewTLSConfig builds the listener TLS config
+// Certificates loaded from files are re-read when they change on disk, so
+// renewals take effect without a restart. A self-signed certificate is
+// regenerated when it is about to expire. Call the returned stop function on
+// shutdown to end the reload loop.
+func NewTLSConfig(cfg config.TLSConfig, bind string) (*tls.Config, func(), error) {
+	tlsCfg := &tls.Config{
+		MinVersion: TLSVersions[cfg.MinVersion],
+	}
+
+	stop := func() {}
+	switch {
+	case cfg.CertFile != "" && cfg.KeyFile != "" && (!cfg.SelfSigned || fileExists(cfg.CertFile)):
+		var renew func() error
+		if cfg.SelfSigned {
+			// A saved certificate from an earlier run may have expired
+			renew = func() error { return renewSelfSigned(bind, cfg.CertFile, cfg.KeyFile) }
+			if err := renew(); err != nil {
+				return nil, nil, err
+			}
+		}
+		r, err := newCertReloader(cfg.CertFile, cfg.KeyFile, cfg.ReloadInterval, renew)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsCfg.GetCertificate = r.getCertificate
+		stop = r.stop
+
+	case cfg.SelfSigned:
+		s := &selfSignedCert{bind: bind, certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+		cert, err := s.getCertificate(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsCfg.GetCertificate = s.getCertificate
+		slog.Warn("Using self-signed TLS certificate; clients must trust or pin it",
+			"sha256_fingerprint", fingerprint(cert.Certificate[0]))
+
+	default:
+		return nil, nil, fmt.Errorf("tls requires cert_file and key_file, or self_signed")
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsCfg.ClientCAs = pool
+		// Optional client certs let bearer/HMAC clients share the listener
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.RequireClientCert {
+			tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsCfg, stop, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// certReloader serves a certificate and reloads it when the files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+	renew    func() error // Replaces the files before they expire, if set
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration, renew func() error) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		renew:    renew,
+		stopCh:   make(chan struct{}),
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if r.renew != nil {
+					if err := r.renew(); err != nil {
+						slog.Error("Failed to renew self-signed TLS certificate", logging.Err(err))
+					}
+				}
+				if !r.changed() {
+					continue
+				}
+				if err := r.reload(); err != nil {
+					// Keep serving the previous certificate
+					slog.Error("Failed to reload TLS certificate", logging.Err(err))
+				} else {
+					slog.Info("Reloaded TLS certificate", "cert_file", r.certFile)
+				}
+			case <-r.stopCh:
+				return
+			}
+		}
+	}()
+
+	return r, nil
+}
+
+// latestModTime returns the newer modification time of the cert and key
+func (r *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (r *certReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.latestModTime().After(r.modTime)
+}
+
+func (r *certReloader) reload() error {
+	modTime := r.latestModTime()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	// Served anyway: clients report the expiry more clearly than a listener
+	// that won't start
+	if notAfter := cert.Leaf.NotAfter; time.Now().After(notAfter) {
+		slog.Error("TLS certificate has expired", "cert_file", r.certFile, "not_after", notAfter)
+	} else if time.Until(notAfter) < renewBefore {
+		slog.Warn("TLS certificate expires soon", "cert_file", r.certFile, "not_after", notAfter)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) stop() {
+	r.stopOnce.Do(func() { close(r.stopCh) })
+}
+
+// selfSignedCert serves a generated certificate and replaces it before it
+// expires
+type selfSignedCert struct {
+	bind     string
+	certFile string // Where the certificate is saved, if set
+	keyFile  string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+func (s *selfSignedCert) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cert == nil || time.Until(s.cert.Leaf.NotAfter) < renewBefore {
+		cert, err := generateSelfSigned(s.bind, s.certFile, s.keyFile, selfSignedValidity)
+		if err != nil {
+			return nil, err
+		}
+		if s.cert != nil {
+			slog.Warn("Replaced expiring self-signed TLS certificate; clients must trust or pin the new one",
+				"sha256_fingerprint", fingerprint(cert.Certificate[0]))
+		}
+		s.cert = &cert
+	}
+	return s.cert, nil
+}
+
+// renewSelfSigned replaces the self-signed certificate in certFile and
+// keyFile if it has expired or will expire within renewBefore
+func renewSelfSigned(bind, certFile, keyFile string) error {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read cert file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("no certificate found in %s", certFile)
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	if time.Until(leaf.NotAfter) >= renewBefore {
+		return nil
+	}
+
+	cert, err := generateSelfSigned(bind, certFile, keyFile, selfSignedValidity)
+	if err != nil {
+		return err
+	}
+	slog.Warn("Replaced expiring self-signed TLS certificate; clients must trust or pin the new one",
+		"not_after", leaf.NotAfter, "sha256_fingerprint", fingerprint(cert.Certificate[0]))
+	return nil
+}
+
+// generateSelfSigned creates a certificate for localhost, the host name and
+// the bind address, valid for validFor. If certFile and keyFile are set the
+// pair is written there so the same certificate is reused (and can be
+// distributed) across restarts.
+func generateSelfSigned(bind, certFile, keyFile string, validFor time.Duration) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate serial: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "nexus-agent", Organization: []string{"Nexus Agent (self-signed)"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+	if ip := net.ParseIP(bind); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to marshal key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if certFile != "" && keyFile != "" {
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to write key file: %w", err)
+		}
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to write cert file: %w", err)
+		}
+		slog.Info("Wrote self-signed TLS certificate", "cert_file", certFile, "key_file", keyFile)
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// fingerprint returns the hex SHA-256 of a DER certificate
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
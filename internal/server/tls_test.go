@@ -0,0 +1,167 @@
+package server
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+)
+
+// servedFingerprint returns the fingerprint of the certificate a TLS
+// config presents
+func servedFingerprint(t *testing.T, cfg *tls.Config) string {
+	t.Helper()
+	if cfg.GetCertificate == nil {
+		return fingerprint(cfg.Certificates[0].Certificate[0])
+	}
+	cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fingerprint(cert.Certificate[0])
+}
+
+func TestSelfSignedReused(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.TLSConfig{
+		SelfSigned:     true,
+		CertFile:       filepath.Join(dir, "agent.crt"),
+		KeyFile:        filepath.Join(dir, "agent.key"),
+		ReloadInterval: time.Minute,
+	}
+
+	first, stop, err := NewTLSConfig(cfg, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	if info, err := os.Stat(cfg.KeyFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("key file: %v, %v; want mode 0600", info, err)
+	}
+
+	// A restart serves the certificate written the first time
+	second, stop, err := NewTLSConfig(cfg, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if a, b := servedFingerprint(t, first), servedFingerprint(t, second); a != b {
+		t.Errorf("restart served %s, want the written certificate %s", b, a)
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "agent.crt"), filepath.Join(dir, "agent.key")
+	if _, err := generateSelfSigned("", certFile, keyFile, selfSignedValidity); err != nil {
+		t.Fatal(err)
+	}
+	cfg, stop, err := NewTLSConfig(config.TLSConfig{CertFile: certFile, KeyFile: keyFile, ReloadInterval: 10 * time.Millisecond}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	before := servedFingerprint(t, cfg)
+
+	// Renew the certificate in place
+	if _, err := generateSelfSigned("", certFile, keyFile, selfSignedValidity); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for servedFingerprint(t, cfg) == before {
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientCertModes(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	if _, err := generateSelfSigned("", caFile, filepath.Join(dir, "ca.key"), selfSignedValidity); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, require := range []bool{false, true} {
+		cfg, stop, err := NewTLSConfig(config.TLSConfig{SelfSigned: true, ClientCAFile: caFile, RequireClientCert: require}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop()
+		want := tls.VerifyClientCertIfGiven
+		if require {
+			want = tls.RequireAndVerifyClientCert
+		}
+		if cfg.ClientAuth != want || cfg.ClientCAs == nil {
+			t.Errorf("require_client_cert %v: client auth %v, want %v", require, cfg.ClientAuth, want)
+		}
+	}
+
+	if _, _, err := NewTLSConfig(config.TLSConfig{}, ""); err == nil {
+		t.Error("accepted TLS without a certificate")
+	}
+}
+
+func TestSelfSignedRenewed(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.TLSConfig{
+		SelfSigned:     true,
+		CertFile:       filepath.Join(dir, "agent.crt"),
+		KeyFile:        filepath.Join(dir, "agent.key"),
+		ReloadInterval: time.Minute,
+	}
+
+	tests := []struct {
+		name     string
+		validFor time.Duration
+		renewed  bool
+	}{
+		{"expired", -time.Hour, true},
+		{"expiring", renewBefore / 2, true},
+		{"valid", selfSignedValidity, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, err := generateSelfSigned("", cfg.CertFile, cfg.KeyFile, tt.validFor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsCfg, stop, err := NewTLSConfig(cfg, "127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stop()
+			if renewed := servedFingerprint(t, tlsCfg) != fingerprint(old.Certificate[0]); renewed != tt.renewed {
+				t.Errorf("renewed = %v, want %v", renewed, tt.renewed)
+			}
+		})
+	}
+}
+
+func TestSelfSignedInMemoryRenewed(t *testing.T) {
+	s := &selfSignedCert{bind: "127.0.0.1"}
+	old, err := generateSelfSigned("", "", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.cert = &old
+
+	cert, err := s.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint(cert.Certificate[0]) == fingerprint(old.Certificate[0]) {
+		t.Error("expiring in-memory certificate was not replaced")
+	}
+}
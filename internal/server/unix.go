@@ -0,0 +1,155 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+)
+
+// ListenUnix creates the Unix domain socket listener described by cfg
+// A stale socket file left by a previous run is removed, but a socket that
+// another process is still serving on is left alone. The file is removed
+// again when the listener is closed.
+//
+// The socket is created in a private (0700) directory next to cfg.Path and
+// only renamed into place once its mode and owner are set, so it is never
+// reachable with the permissions of the process umask.
+func ListenUnix(cfg config.SocketConfig) (net.Listener, error) {
+	if err := removeStaleSocket(cfg.Path); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(cfg.Path), ".nexus-agent-socket-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "socket")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", cfg.Path, err)
+	}
+	ul := l.(*net.UnixListener)
+	// The file is renamed, so it is removed by path in Close instead
+	ul.SetUnlinkOnClose(false)
+
+	if err := applySocketPermissions(tmp, cfg); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, cfg.Path); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to move socket to %s: %w", cfg.Path, err)
+	}
+	return &unixListener{UnixListener: ul, path: cfg.Path}, nil
+}
+
+// unixListener removes its socket file when closed
+type unixListener struct {
+	*net.UnixListener
+	path string
+	once sync.Once
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.once.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// removeStaleSocket deletes path if it is a socket nobody is listening on
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+	}
+	return nil
+}
+
+// applySocketPermissions sets the mode and ownership of the socket file at
+// path
+func applySocketPermissions(path string, cfg config.SocketConfig) error {
+	mode, err := ParseFileMode(cfg.Mode)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("failed to set socket mode: %w", err)
+	}
+
+	if cfg.Owner == "" && cfg.Group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1 // -1 leaves the value unchanged
+	if cfg.Owner != "" {
+		if uid, err = lookupID(cfg.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		}); err != nil {
+			return fmt.Errorf("unknown socket owner %q: %w", cfg.Owner, err)
+		}
+	}
+	if cfg.Group != "" {
+		if gid, err = lookupID(cfg.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		}); err != nil {
+			return fmt.Errorf("unknown socket group %q: %w", cfg.Group, err)
+		}
+	}
+
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("failed to set socket owner: %w", err)
+	}
+	return nil
+}
+
+// lookupID accepts a numeric ID or resolves a name with lookup
+func lookupID(nameOrID string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+	idStr, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(idStr)
+}
+
+// ParseFileMode parses an octal permission string such as "0660"
+func ParseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid file mode %q (expected octal, e.g. \"0660\")", s)
+	}
+	return os.FileMode(mode), nil
+}
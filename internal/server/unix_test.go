@@ -0,0 +1,89 @@
+//go:build !windows
+
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nexus/nexus-agent/internal/config"
+)
+
+func TestListenUnixMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent.sock")
+
+	l, err := ListenUnix(config.SocketConfig{Path: path, Mode: "0600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want a socket with 0600", info.Mode())
+	}
+
+	// Only the socket is left in the directory
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory has %d entries, want only the socket", len(entries))
+	}
+
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left after Close: %v", err)
+	}
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+
+	// A listener that exits without removing its socket
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := ListenUnix(config.SocketConfig{Path: path, Mode: "0660"})
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	defer l.Close()
+
+	// A live socket is left alone
+	if _, err := ListenUnix(config.SocketConfig{Path: path, Mode: "0660"}); err == nil {
+		t.Error("listened on a socket that is in use")
+	}
+}
+
+func TestListenUnixNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenUnix(config.SocketConfig{Path: path, Mode: "0660"}); err == nil {
+		t.Error("replaced a regular file")
+	}
+}
@@ -1,14 +1,19 @@
 package sync
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/logging"
+	"github.com/nexus/nexus-agent/internal/metrics"
+	"github.com/nexus/nexus-agent/internal/upstream"
 )
 
 // SyncResponse is the response from the server's sync endpoint
@@ -26,76 +31,150 @@ type AppData struct {
 	AppKey            string `json:"app_key"`
 	MasterSecret      string `json:"master_secret"`
 	EncryptionEnabled bool   `json:"encryption_enabled"`
+
+	// Optional per-app quotas set centrally in Nexus
+	RateLimit *config.RateLimit `json:"rate_limit,omitempty"`
+	Queue     *config.AppQueue  `json:"queue,omitempty"`
 }
 
 // Syncer handles auto-sync with the Nexus server
 type Syncer struct {
 	config     *config.Config
+	pool       *upstream.Pool
 	httpClient *http.Client
-	stopCh     chan struct{}
-	running    bool
+	cancel     context.CancelFunc // Stops the sync loop; nil when not running
+	done       chan struct{}      // Closed when the sync loop has stopped
+
+	mu     sync.Mutex
+	status Status
+}
+
+// Status describes the outcome of recent sync attempts
+type Status struct {
+	LastAttempt time.Time
+	LastSuccess time.Time
+	LastError   string
+	Endpoint    string // Endpoint that answered the last attempt
 }
 
-// NewSyncer creates a new syncer instance
-func NewSyncer(cfg *config.Config) *Syncer {
+// NewSyncer creates a new syncer instance that syncs with the endpoints of
+// pool
+func NewSyncer(cfg *config.Config, pool *upstream.Pool) *Syncer {
 	return &Syncer{
 		config: cfg,
+		pool:   pool,
 		httpClient: &http.Client{
-			Timeout: cfg.Nexus.Timeout,
+			Timeout:   cfg.Nexus.Timeout,
+			Transport: pool.Transport(),
 		},
-		stopCh: make(chan struct{}),
 	}
 }
 
-// Start begins the periodic sync loop
-func (s *Syncer) Start() {
+// Start runs an initial sync and then syncs periodically until ctx is done
+// or Stop is called
+func (s *Syncer) Start(ctx context.Context) {
 	if !s.config.HasAutoSync() {
-		log.Println("Auto-sync disabled (no agent_token configured)")
+		slog.Info("Auto-sync disabled (no agent_token configured)")
 		return
 	}
 
-	s.running = true
-	log.Printf("Starting auto-sync (interval: %v)", s.config.Nexus.SyncInterval)
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	slog.Info("Starting auto-sync", "interval", s.config.Nexus.SyncInterval.String())
 
 	// Initial sync
-	if err := s.Sync(); err != nil {
-		log.Printf("WARN: Initial sync failed: %v (will retry)", err)
+	if err := s.Sync(ctx); err != nil {
+		slog.Warn("Initial sync failed (will retry)", logging.Err(err))
 	}
 
 	// Periodic sync
 	go func() {
+		defer close(s.done)
 		ticker := time.NewTicker(s.config.Nexus.SyncInterval)
 		defer ticker.Stop()
 
 		for {
 			select {
 			case <-ticker.C:
-				if err := s.Sync(); err != nil {
-					log.Printf("WARN: Sync failed: %v", err)
+				if err := s.Sync(ctx); err != nil && ctx.Err() == nil {
+					slog.Warn("Sync failed", logging.Err(err))
 				}
-			case <-s.stopCh:
-				log.Println("Auto-sync stopped")
+			case <-ctx.Done():
+				slog.Info("Auto-sync stopped")
 				return
 			}
 		}
 	}()
 }
 
-// Stop stops the sync loop
+// Stop stops the sync loop, abandoning a sync in progress, and waits for it
+// to exit
 func (s *Syncer) Stop() {
-	if s.running {
-		close(s.stopCh)
-		s.running = false
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+		s.cancel = nil
 	}
 }
 
+// Status returns the outcome of recent sync attempts
+func (s *Syncer) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
 // Sync performs a single sync with the server
-func (s *Syncer) Sync() error {
-	url := fmt.Sprintf("%s/agent/sync", s.config.Nexus.ServerURL)
+func (s *Syncer) Sync(ctx context.Context) error {
+	endpoint, err := s.sync(ctx)
+	now := time.Now()
 
-	req, err := http.NewRequest("POST", url, nil)
+	s.mu.Lock()
+	s.status.LastAttempt = now
+	s.status.Endpoint = endpoint
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		s.status.LastError = err.Error()
+	} else {
+		s.status.LastSuccess = now
+		s.status.LastError = ""
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		metrics.Syncs.Inc("failure")
+		return err
+	}
+	metrics.Syncs.Inc("success")
+	metrics.LastSyncSuccess.Set(float64(now.Unix()))
+	return nil
+}
+
+// sync does the work for Sync, trying the endpoints in the pool's order
+// until one answers. It returns the name of that endpoint.
+func (s *Syncer) sync(ctx context.Context) (string, error) {
+	var err error
+	for _, ep := range s.pool.Order() {
+		var failover bool
+		if failover, err = s.syncFrom(ctx, ep); !failover {
+			ep.Succeeded(upstream.KindSync)
+			return ep.Name, err
+		}
+		if ctx.Err() != nil {
+			return "", err
+		}
+		ep.Failed(upstream.KindSync, err)
+	}
+	return "", err
+}
+
+// syncFrom syncs with one endpoint; failover reports a transport error or
+// 5xx, for which the next endpoint should be tried
+func (s *Syncer) syncFrom(ctx context.Context, ep *upstream.Endpoint) (failover bool, err error) {
+	url := fmt.Sprintf("%s/agent/sync", ep.URL)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("X-Agent-Token", s.config.Nexus.AgentToken)
@@ -103,26 +182,26 @@ func (s *Syncer) Sync() error {
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return true, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to read response: %w", err)
+		return true, fmt.Errorf("failed to read response: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned %d: %s", resp.StatusCode, string(body))
+		return resp.StatusCode >= 500, fmt.Errorf("server returned %d: %s", resp.StatusCode, string(body))
 	}
 
 	var syncResp SyncResponse
 	if err := json.Unmarshal(body, &syncResp); err != nil {
-		return fmt.Errorf("failed to parse response: %w", err)
+		return false, fmt.Errorf("failed to parse response: %w", err)
 	}
 
 	if !syncResp.Success {
-		return fmt.Errorf("sync failed: %s", syncResp.Message)
+		return false, fmt.Errorf("sync failed: %s", syncResp.Message)
 	}
 
 	// Update config with synced apps
@@ -132,11 +211,14 @@ func (s *Syncer) Sync() error {
 			Name:         app.Name,
 			AppKey:       app.AppKey,
 			MasterSecret: app.MasterSecret,
+			RateLimit:    app.RateLimit,
+			Queue:        app.Queue,
 		}
 	}
 
 	s.config.UpdateSyncedApps(apps)
-	log.Printf("Synced %d apps from server", len(apps))
+	metrics.SyncedApps.Set(float64(len(apps)))
+	slog.Info("Synced apps from server", "apps", len(apps), "endpoint", ep.Name)
 
-	return nil
+	return false, nil
 }
@@ -0,0 +1,295 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/logging"
+)
+
+const (
+	// maxBatchSize is the number of spans sent per OTLP request
+	maxBatchSize = 512
+	// maxQueuedSpans bounds memory when the collector is unreachable
+	maxQueuedSpans = 4096
+)
+
+// Exporter batches finished spans and sends them to an OTLP/HTTP collector
+// using the JSON encoding.
+type Exporter struct {
+	endpoint    string
+	serviceName string
+	headers     map[string]string
+	client      *http.Client
+	interval    time.Duration
+
+	mu      sync.Mutex
+	pending []*Span
+	dropped int
+
+	flushCh chan chan struct{}
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// New creates the tracer described by cfg and installs it globally
+// When tracing is disabled the returned tracer still propagates trace
+// context but records nothing.
+func New(cfg config.TracingConfig) *Tracer {
+	t := &Tracer{sampleRatio: cfg.SampleRatio}
+	if cfg.Enabled {
+		t.exporter = newExporter(cfg)
+	}
+	SetGlobal(t)
+	return t
+}
+
+// Shutdown flushes pending spans and stops the exporter
+func (t *Tracer) Shutdown(ctx context.Context) {
+	if t.exporter != nil {
+		t.exporter.shutdown(ctx)
+	}
+}
+
+func newExporter(cfg config.TracingConfig) *Exporter {
+	e := &Exporter{
+		endpoint:    strings.TrimSuffix(cfg.Endpoint, "/") + "/v1/traces",
+		serviceName: cfg.ServiceName,
+		headers:     cfg.Headers,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		interval:    cfg.ExportInterval,
+		flushCh:     make(chan chan struct{}),
+		stopCh:      make(chan struct{}),
+		doneCh:      make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// enqueue adds a finished span to the pending batch
+func (e *Exporter) enqueue(s *Span) {
+	e.mu.Lock()
+	if len(e.pending) >= maxQueuedSpans {
+		e.dropped++
+		e.mu.Unlock()
+		return
+	}
+	e.pending = append(e.pending, s)
+	full := len(e.pending) >= maxBatchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.flushCh <- nil:
+		default:
+		}
+	}
+}
+
+// run exports on a timer until stopped
+func (e *Exporter) run() {
+	defer close(e.doneCh)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.flush(context.Background())
+		case done := <-e.flushCh:
+			e.flush(context.Background())
+			if done != nil {
+				close(done)
+			}
+		case <-e.stopCh:
+			e.flush(context.Background())
+			return
+		}
+	}
+}
+
+// shutdown stops the exporter after a final flush, bounded by ctx
+func (e *Exporter) shutdown(ctx context.Context) {
+	close(e.stopCh)
+	select {
+	case <-e.doneCh:
+	case <-ctx.Done():
+		slog.Warn("Trace exporter shutdown timed out, spans may be lost")
+	}
+}
+
+// flush sends all pending spans in batches
+func (e *Exporter) flush(ctx context.Context) {
+	e.mu.Lock()
+	spans := e.pending
+	dropped := e.dropped
+	e.pending = nil
+	e.dropped = 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		slog.Warn("Trace exporter queue full, spans dropped", "spans", dropped)
+	}
+
+	for len(spans) > 0 {
+		n := min(len(spans), maxBatchSize)
+		if err := e.send(ctx, spans[:n]); err != nil {
+			slog.Warn("Failed to export spans", "spans", n, logging.Err(err))
+		}
+		spans = spans[n:]
+	}
+}
+
+// send posts one batch in OTLP/JSON format
+func (e *Exporter) send(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return fmt.Errorf("failed to marshal spans: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector returned %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// OTLP/JSON wire types (opentelemetry-proto, JSON mapping)
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0 unset, 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (e *Exporter) encode(spans []*Span) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.Context.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        encodeAttrs(s.attrs),
+		}
+		if s.ParentID != ([8]byte{}) {
+			span.ParentSpanID = hex.EncodeToString(s.ParentID[:])
+		}
+		if s.hasError {
+			span.Status = otlpStatus{Code: 2, Message: s.errMsg}
+		}
+		s.mu.Unlock()
+		out = append(out, span)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: encodeAttrs(map[string]interface{}{
+			"service.name": e.serviceName,
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/nexus/nexus-agent"},
+			Spans: out,
+		}},
+	}}}
+}
+
+func encodeAttrs(attrs map[string]interface{}) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		var val otlpValue
+		switch x := v.(type) {
+		case string:
+			val.StringValue = &x
+		case bool:
+			val.BoolValue = &x
+		case int:
+			s := strconv.Itoa(x)
+			val.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(x, 10)
+			val.IntValue = &s
+		case float64:
+			val.DoubleValue = &x
+		default:
+			s := fmt.Sprint(x)
+			val.StringValue = &s
+		}
+		out = append(out, otlpKeyValue{Key: k, Value: val})
+	}
+	return out
+}
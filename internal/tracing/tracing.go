@@ -0,0 +1,285 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the W3C Trace Context header name
+const TraceparentHeader = "traceparent"
+
+// SpanKind values match the OTLP enum
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+	KindProducer SpanKind = 4
+	KindConsumer SpanKind = 5
+)
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether both IDs are non-zero
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent formats the span context as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value
+// Only version 00 fields are read; future versions are accepted as long as
+// the leading fields are well formed, as the spec requires.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != 16 {
+		return sc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != 8 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&0x01 != 0
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	return sc, true
+}
+
+// Span is a single timed operation
+// Spans are always created so trace context can be propagated, but only
+// sampled spans are exported.
+type Span struct {
+	Name     string
+	Kind     SpanKind
+	Context  SpanContext
+	ParentID [8]byte
+	Start    time.Time
+
+	mu        sync.Mutex
+	end       time.Time
+	attrs     map[string]interface{}
+	errMsg    string
+	hasError  bool
+	ended     bool
+	tracer    *Tracer
+	recording bool
+}
+
+// SetAttr sets an attribute on the span
+// Supported value types are string, bool, int, int64 and float64.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil || !s.recording {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(msg string) {
+	if s == nil || !s.recording {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hasError = true
+	s.errMsg = msg
+}
+
+// End finishes the span and hands it to the exporter
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.recording && s.tracer != nil {
+		s.tracer.export(s)
+	}
+}
+
+// Tracer creates spans and passes finished ones to an exporter
+type Tracer struct {
+	exporter    *Exporter
+	sampleRatio float64
+}
+
+// global is the tracer used by Start; a nil exporter disables recording
+var (
+	globalMu sync.RWMutex
+	global   = &Tracer{}
+)
+
+// SetGlobal installs the tracer used by Start
+func SetGlobal(t *Tracer) {
+	globalMu.Lock()
+	global = t
+	globalMu.Unlock()
+}
+
+func getGlobal() *Tracer {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	return global
+}
+
+func (t *Tracer) export(s *Span) {
+	if t.exporter != nil {
+		t.exporter.enqueue(s)
+	}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start begins a new span as a child of the span (or remote parent) in ctx
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	t := getGlobal()
+
+	parent, hasParent := SpanContextFromContext(ctx)
+
+	span := &Span{
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+		tracer: t,
+	}
+	span.Context.SpanID = newSpanID()
+	if hasParent {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.ParentID = parent.SpanID
+	} else {
+		span.Context.TraceID = newTraceID()
+		span.Context.Sampled = t.sample(span.Context.TraceID)
+	}
+	span.recording = t.exporter != nil && span.Context.Sampled
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// sample decides whether a new root trace is sampled
+// The decision is derived from the trace ID so it is consistent per trace.
+func (t *Tracer) sample(traceID [16]byte) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	if t.sampleRatio <= 0 {
+		return false
+	}
+	bound := uint64(t.sampleRatio * (1 << 63))
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < bound
+}
+
+// SpanFromContext returns the current span, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanContextFromContext returns the current span context, falling back to a
+// remote parent extracted from an incoming request or queued message.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.Context, true
+	}
+	if sc, ok := ctx.Value(remoteKey{}).(SpanContext); ok && sc.IsValid() {
+		return sc, true
+	}
+	return SpanContext{}, false
+}
+
+// ContextWithRemoteParent returns a context whose next span will be a child
+// of the traceparent value. Invalid values are ignored.
+func ContextWithRemoteParent(ctx context.Context, traceparent string) context.Context {
+	sc, ok := ParseTraceparent(traceparent)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Extract reads the traceparent header of an incoming request into ctx
+func Extract(ctx context.Context, h http.Header) context.Context {
+	return ContextWithRemoteParent(ctx, h.Get(TraceparentHeader))
+}
+
+// Inject writes the current span context to an outgoing request's headers
+func Inject(ctx context.Context, h http.Header) {
+	if sc, ok := SpanContextFromContext(ctx); ok {
+		h.Set(TraceparentHeader, sc.Traceparent())
+	}
+}
+
+// Traceparent returns the traceparent value for the current span, or ""
+func Traceparent(ctx context.Context) string {
+	sc, _ := SpanContextFromContext(ctx)
+	return sc.Traceparent()
+}
+
+func newTraceID() [16]byte {
+	var id [16]byte
+	for id == ([16]byte{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() [8]byte {
+	var id [8]byte
+	for id == ([8]byte{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
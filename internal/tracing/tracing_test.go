@@ -0,0 +1,135 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"sampled", "00-" + testTraceID + "-" + testSpanID + "-01", true, true},
+		{"not sampled", "00-" + testTraceID + "-" + testSpanID + "-00", true, false},
+		{"surrounding space", " 00-" + testTraceID + "-" + testSpanID + "-01 ", true, true},
+		{"future version with extra field", "cc-" + testTraceID + "-" + testSpanID + "-01-extra", true, true},
+		{"version 00 with extra field", "00-" + testTraceID + "-" + testSpanID + "-01-extra", false, false},
+		{"forbidden version", "ff-" + testTraceID + "-" + testSpanID + "-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-" + testSpanID + "-01", false, false},
+		{"zero span id", "00-" + testTraceID + "-0000000000000000-01", false, false},
+		{"short trace id", "00-4bf92f35-" + testSpanID + "-01", false, false},
+		{"bad hex", "00-" + testTraceID + "-zzf067aa0ba902b7-01", false, false},
+		{"bad flags", "00-" + testTraceID + "-" + testSpanID + "-1", false, false},
+		{"missing fields", "00-" + testTraceID, false, false},
+		{"empty", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				if sc.IsValid() {
+					t.Error("rejected value returned a valid span context")
+				}
+				return
+			}
+			if sc.Sampled != tt.sampled {
+				t.Errorf("sampled = %v, want %v", sc.Sampled, tt.sampled)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	for _, value := range []string{
+		"00-" + testTraceID + "-" + testSpanID + "-01",
+		"00-" + testTraceID + "-" + testSpanID + "-00",
+	} {
+		sc, ok := ParseTraceparent(value)
+		if !ok {
+			t.Fatalf("ParseTraceparent(%q) failed", value)
+		}
+		if got := sc.Traceparent(); got != value {
+			t.Errorf("Traceparent() = %q, want %q", got, value)
+		}
+	}
+}
+
+func TestTraceparentInvalid(t *testing.T) {
+	if got := (SpanContext{}).Traceparent(); got != "" {
+		t.Errorf("Traceparent() of an empty context = %q, want \"\"", got)
+	}
+}
+
+func TestStartContinuesRemoteParent(t *testing.T) {
+	h := http.Header{}
+	h.Set(TraceparentHeader, "00-"+testTraceID+"-"+testSpanID+"-01")
+
+	ctx, span := Start(Extract(context.Background(), h), "test", KindServer)
+	defer span.End()
+
+	if span.Context.TraceID != mustParse(t, testTraceID, testSpanID).TraceID {
+		t.Error("span isn't part of the remote trace")
+	}
+	if span.ParentID != mustParse(t, testTraceID, testSpanID).SpanID {
+		t.Error("span's parent isn't the remote span")
+	}
+	if !span.Context.Sampled {
+		t.Error("sampled flag not inherited")
+	}
+
+	out := http.Header{}
+	Inject(ctx, out)
+	if sc, ok := ParseTraceparent(out.Get(TraceparentHeader)); !ok || sc.SpanID != span.Context.SpanID {
+		t.Errorf("injected traceparent %q doesn't name the current span", out.Get(TraceparentHeader))
+	}
+}
+
+func TestExtractIgnoresInvalidHeader(t *testing.T) {
+	h := http.Header{}
+	h.Set(TraceparentHeader, "garbage")
+	if _, ok := SpanContextFromContext(Extract(context.Background(), h)); ok {
+		t.Error("invalid traceparent produced a parent")
+	}
+}
+
+func TestSample(t *testing.T) {
+	var low, high [16]byte
+	high[8] = 0xff
+	tests := []struct {
+		ratio   float64
+		traceID [16]byte
+		want    bool
+	}{
+		{1, high, true},
+		{0, low, false},
+		{0.5, low, true},
+		{0.5, high, false},
+	}
+	for _, tt := range tests {
+		tracer := &Tracer{sampleRatio: tt.ratio}
+		if got := tracer.sample(tt.traceID); got != tt.want {
+			t.Errorf("sample(ratio %v, %x) = %v, want %v", tt.ratio, tt.traceID, got, tt.want)
+		}
+	}
+}
+
+func mustParse(t *testing.T, traceID, spanID string) SpanContext {
+	t.Helper()
+	sc, ok := ParseTraceparent("00-" + traceID + "-" + spanID + "-01")
+	if !ok {
+		t.Fatal("invalid test traceparent")
+	}
+	return sc
+}
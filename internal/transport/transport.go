@@ -0,0 +1,230 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/logging"
+)
+
+// New builds the HTTP transport for connections to a Nexus destination. It
+// goes through the configured proxy, or the one named by HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY, and applies the destination's CA bundle, pinned
+// fingerprints and client certificate.
+func New(proxy config.ProxyConfig, tlsCfg config.ClientTLSConfig) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	proxyFunc, err := newProxyFunc(proxy)
+	if err != nil {
+		return nil, err
+	}
+	t.Proxy = proxyFunc
+
+	if t.TLSClientConfig, err = newTLSConfig(tlsCfg); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// newProxyFunc picks the proxy for each request
+func newProxyFunc(cfg config.ProxyConfig) (func(*http.Request) (*url.URL, error), error) {
+	switch cfg.URL {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case config.ProxyDirect:
+		return nil, nil
+	}
+
+	proxyURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	bypass := newNoProxy(cfg.NoProxy)
+	return func(req *http.Request) (*url.URL, error) {
+		if bypass.match(req.URL.Hostname()) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// noProxy is the list of hosts reached without the proxy
+type noProxy struct {
+	all     bool
+	domains []string // Match the name and its subdomains
+	nets    []*net.IPNet
+}
+
+func newNoProxy(entries []string) noProxy {
+	var n noProxy
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "*" {
+			n.all = true
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			n.nets = append(n.nets, ipNet)
+			continue
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		n.domains = append(n.domains, strings.TrimSuffix(entry, "."))
+	}
+	return n
+}
+
+func (n noProxy) match(host string) bool {
+	if n.all {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipNet := range n.nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, domain := range n.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// newTLSConfig builds the client TLS config; nil keeps Go's defaults
+func newTLSConfig(cfg config.ClientTLSConfig) (*tls.Config, error) {
+	if cfg.IsZero() {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{}
+
+	if cfg.CAFile != "" {
+		// Added to the system roots so a proxy's CA doesn't replace them
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := newClientCert(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.GetClientCertificate = cert.get
+	}
+
+	if len(cfg.PinnedSHA256) > 0 {
+		pins := make(map[string]bool, len(cfg.PinnedSHA256))
+		for _, pin := range cfg.PinnedSHA256 {
+			pins[strings.ToLower(strings.ReplaceAll(pin, ":", ""))] = true
+		}
+		tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+
+	return tlsCfg, nil
+}
+
+// verifyPins accepts a connection whose verified chain contains a pinned
+// certificate, so either the server's own or an issuing CA can be pinned
+func verifyPins(cs tls.ConnectionState, pins map[string]bool) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if pins[fingerprint(cert.Raw)] {
+				return nil
+			}
+		}
+	}
+	leaf := "none"
+	if len(cs.PeerCertificates) > 0 {
+		leaf = fingerprint(cs.PeerCertificates[0].Raw)
+	}
+	return fmt.Errorf("server certificate chain matches no pinned fingerprint (server certificate sha256 %s)", leaf)
+}
+
+// fingerprint returns the hex SHA-256 of a DER certificate
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// clientCert serves the mTLS client certificate, re-reading the files when
+// they change so renewals take effect without a restart
+type clientCert struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newClientCert(certFile, keyFile string) (*clientCert, error) {
+	c := &clientCert{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(c.latestModTime()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *clientCert) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if modTime := c.latestModTime(); modTime.After(c.modTime) {
+		if err := c.reload(modTime); err != nil {
+			// Keep presenting the previous certificate
+			slog.Error("Failed to reload client certificate", logging.Err(err))
+		} else {
+			slog.Info("Reloaded client certificate", "cert_file", c.certFile)
+		}
+	}
+	return c.cert, nil
+}
+
+// reload loads the key pair; modTime is recorded even on failure so a bad
+// file is retried only once it changes again
+func (c *clientCert) reload(modTime time.Time) error {
+	c.modTime = modTime
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	c.cert = &cert
+	return nil
+}
+
+// latestModTime returns the newer modification time of the cert and key
+func (c *clientCert) latestModTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
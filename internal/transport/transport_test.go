@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nexus/nexus-agent/internal/config"
+)
+
+func TestNoProxy(t *testing.T) {
+	n := newNoProxy([]string{"internal.example", ".corp.example", "*.lab.example", "10.0.0.0/8", " Upper.Example "})
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"internal.example", true},
+		{"api.internal.example", true},
+		{"notinternal.example", false},
+		{"corp.example", true},
+		{"nexus.corp.example", true},
+		{"nexus.lab.example.", true},
+		{"upper.example", true},
+		{"10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"nexus.example", false},
+	}
+	for _, tt := range tests {
+		if got := n.match(tt.host); got != tt.want {
+			t.Errorf("match(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+	if !newNoProxy([]string{"*"}).match("anything.example") {
+		t.Error("* doesn't match every host")
+	}
+}
+
+func TestProxyFunc(t *testing.T) {
+	proxy, err := newProxyFunc(config.ProxyConfig{URL: "http://proxy.example:3128", NoProxy: []string{"local.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"nexus.example": "http://proxy.example:3128",
+		"local.example": "",
+	} {
+		req, _ := http.NewRequest(http.MethodPost, "https://"+host+"/ingress", nil)
+		u, err := proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != want {
+			t.Errorf("proxy for %s = %q, want %q", host, got, want)
+		}
+	}
+
+	if proxy, err := newProxyFunc(config.ProxyConfig{URL: config.ProxyDirect}); err != nil || proxy != nil {
+		t.Errorf("direct: proxy func = %v, %v; want none", proxy != nil, err)
+	}
+	if _, err := newProxyFunc(config.ProxyConfig{URL: "http://proxy example"}); err == nil {
+		t.Error("accepted an invalid proxy URL")
+	}
+}
+
+func TestCustomCA(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	cert := srv.Certificate()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tls     config.ClientTLSConfig
+		wantErr string
+	}{
+		{"system roots only", config.ClientTLSConfig{}, "certificate"},
+		{"CA file", config.ClientTLSConfig{CAFile: caFile}, ""},
+		{"pinned", config.ClientTLSConfig{CAFile: caFile, PinnedSHA256: []string{strings.ToUpper(fingerprint(cert.Raw))}}, ""},
+		{"wrong pin", config.ClientTLSConfig{CAFile: caFile, PinnedSHA256: []string{strings.Repeat("ab", 32)}}, "pinned fingerprint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, err := New(config.ProxyConfig{URL: config.ProxyDirect}, tt.tls)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rt.CloseIdleConnections()
+			resp, err := (&http.Client{Transport: rt}).Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("request failed: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("err = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := New(config.ProxyConfig{}, config.ClientTLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("accepted a missing CA file")
+	}
+}
@@ -0,0 +1,285 @@
+package upstream
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+	"github.com/nexus/nexus-agent/internal/metrics"
+)
+
+// Strategy decides which healthy endpoint a request tries first
+type Strategy string
+
+const (
+	// StrategyFailover uses endpoints in list order, moving on only while
+	// earlier ones are down
+	StrategyFailover Strategy = "failover"
+	// StrategyRoundRobin spreads requests over the healthy endpoints
+	StrategyRoundRobin Strategy = "round_robin"
+	// StrategyLowestLatency prefers the endpoint with the fastest probes
+	StrategyLowestLatency Strategy = "lowest_latency"
+)
+
+// Request kinds, as reported in metrics
+const (
+	KindIngress = "ingress"
+	KindSync    = "sync"
+)
+
+// latencyWeight is the weight of a new probe in the smoothed latency
+const latencyWeight = 0.3
+
+// Options configures a Pool
+type Options struct {
+	Strategy      Strategy
+	Timeout       time.Duration     // Per probe
+	ProbeInterval time.Duration     // 0 disables background probing
+	Transport     http.RoundTripper // Shared by every client of the pool (nil: http.DefaultTransport)
+}
+
+// Pool is the set of upstream Nexus endpoints requests are spread over
+// Health comes from background probes and from the outcome of real
+// requests: a transport error or 5xx marks an endpoint down until a probe
+// or request to it succeeds again.
+type Pool struct {
+	endpoints []*Endpoint
+	opts      Options
+	client    *http.Client
+	next      atomic.Uint64 // Round-robin position
+}
+
+// Endpoint is one upstream Nexus server
+type Endpoint struct {
+	Name string
+	URL  string
+
+	mu        sync.Mutex
+	up        bool
+	latency   time.Duration // Smoothed probe round trip; 0 until probed
+	lastError string
+	lastProbe time.Time
+	lastUsed  time.Time
+}
+
+// Status is a snapshot of an endpoint's health
+type Status struct {
+	Name      string
+	URL       string
+	Up        bool
+	Latency   time.Duration
+	LastError string
+	LastProbe time.Time
+	LastUsed  time.Time
+}
+
+// New creates a pool of endpoints; all start out healthy
+func New(endpoints []config.EndpointConfig, opts Options) *Pool {
+	p := &Pool{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout, Transport: opts.Transport},
+	}
+	for _, ec := range endpoints {
+		name := ec.Name
+		if name == "" {
+			name = ec.URL
+		}
+		p.endpoints = append(p.endpoints, &Endpoint{Name: name, URL: ec.URL, up: true})
+		metrics.EndpointUp.Set(1, name)
+	}
+	return p
+}
+
+// Strategy returns the pool's strategy
+func (p *Pool) Strategy() Strategy {
+	return p.opts.Strategy
+}
+
+// Transport returns the transport requests to the pool's endpoints go
+// through
+func (p *Pool) Transport() http.RoundTripper {
+	return p.opts.Transport
+}
+
+// Endpoints returns the endpoints in configured order
+func (p *Pool) Endpoints() []*Endpoint {
+	return p.endpoints
+}
+
+// Order returns the endpoints in the order a request should try them: the
+// healthy ones as the strategy ranks them, then the others in list order as
+// a last resort
+func (p *Pool) Order() []*Endpoint {
+	healthy := make([]*Endpoint, 0, len(p.endpoints))
+	var down []*Endpoint
+	for _, ep := range p.endpoints {
+		if ep.Status().Up {
+			healthy = append(healthy, ep)
+		} else {
+			down = append(down, ep)
+		}
+	}
+
+	switch p.opts.Strategy {
+	case StrategyRoundRobin:
+		if n := len(healthy); n > 1 {
+			start := int(p.next.Add(1)-1) % n
+			healthy = append(healthy[start:], healthy[:start]...)
+		}
+	case StrategyLowestLatency:
+		// Endpoints not probed yet go after those with a known latency
+		sort.SliceStable(healthy, func(i, j int) bool {
+			li, lj := healthy[i].Status().Latency, healthy[j].Status().Latency
+			if li == 0 || lj == 0 {
+				return lj == 0 && li != 0
+			}
+			return li < lj
+		})
+	}
+	return append(healthy, down...)
+}
+
+// Start probes every endpoint now and then every ProbeInterval until ctx
+// is done
+func (p *Pool) Start(ctx context.Context) {
+	if p.opts.ProbeInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(p.opts.ProbeInterval)
+		defer ticker.Stop()
+
+		for {
+			p.probeAll(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// probeAll probes the endpoints concurrently
+func (p *Pool) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, ep := range p.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.probe(ctx, ep)
+		}()
+	}
+	wg.Wait()
+}
+
+// probe sends a HEAD request to an endpoint. Any response below 500 counts
+// as healthy.
+func (p *Pool) probe(ctx context.Context, ep *Endpoint) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, ep.URL, nil)
+	if err != nil {
+		ep.setDown(err.Error())
+		return
+	}
+
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	if ctx.Err() != nil {
+		return
+	}
+	ep.mu.Lock()
+	ep.lastProbe = time.Now()
+	ep.mu.Unlock()
+	if err != nil {
+		ep.setDown(err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		ep.setDown(resp.Status)
+		return
+	}
+	ep.probed(time.Since(start))
+}
+
+// Succeeded records a request to the endpoint that got a non-5xx response
+func (e *Endpoint) Succeeded(kind string) {
+	metrics.EndpointRequests.Inc(e.Name, kind, "success")
+	e.mu.Lock()
+	e.lastUsed = time.Now()
+	e.mu.Unlock()
+	e.setUp()
+}
+
+// Failed records a request to the endpoint that failed with a transport
+// error or 5xx, marking the endpoint down
+func (e *Endpoint) Failed(kind string, err error) {
+	metrics.EndpointRequests.Inc(e.Name, kind, "failure")
+	e.mu.Lock()
+	e.lastUsed = time.Now()
+	e.mu.Unlock()
+	e.setDown(err.Error())
+}
+
+// Status returns a snapshot of the endpoint's health
+func (e *Endpoint) Status() Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return Status{
+		Name:      e.Name,
+		URL:       e.URL,
+		Up:        e.up,
+		Latency:   e.latency,
+		LastError: e.lastError,
+		LastProbe: e.lastProbe,
+		LastUsed:  e.lastUsed,
+	}
+}
+
+// probed records a successful probe
+func (e *Endpoint) probed(rtt time.Duration) {
+	e.mu.Lock()
+	if e.latency == 0 {
+		e.latency = rtt
+	} else {
+		e.latency = time.Duration(latencyWeight*float64(rtt) + (1-latencyWeight)*float64(e.latency))
+	}
+	latency := e.latency
+	e.mu.Unlock()
+
+	metrics.EndpointLatency.Set(latency.Seconds(), e.Name)
+	e.setUp()
+}
+
+// setUp marks the endpoint healthy
+func (e *Endpoint) setUp() {
+	e.mu.Lock()
+	changed := !e.up
+	e.up = true
+	e.lastError = ""
+	e.mu.Unlock()
+
+	metrics.EndpointUp.Set(1, e.Name)
+	if changed {
+		slog.Info("Upstream endpoint is back up", "endpoint", e.Name)
+	}
+}
+
+// setDown marks the endpoint unhealthy
+func (e *Endpoint) setDown(reason string) {
+	e.mu.Lock()
+	changed := e.up
+	e.up = false
+	e.lastError = reason
+	e.mu.Unlock()
+
+	metrics.EndpointUp.Set(0, e.Name)
+	if changed {
+		slog.Warn("Upstream endpoint is down", "endpoint", e.Name, "reason", reason)
+	}
+}
@@ -0,0 +1,101 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nexus/nexus-agent/internal/config"
+)
+
+// newTestPool returns a pool of endpoints named a, b and c
+func newTestPool(strategy Strategy) *Pool {
+	return New([]config.EndpointConfig{
+		{Name: "a", URL: "http://a.invalid"},
+		{Name: "b", URL: "http://b.invalid"},
+		{Name: "c", URL: "http://c.invalid"},
+	}, Options{Strategy: strategy})
+}
+
+// names returns the names of endpoints in order
+func names(eps []*Endpoint) string {
+	var s string
+	for _, ep := range eps {
+		s += ep.Name
+	}
+	return s
+}
+
+func TestOrderFailover(t *testing.T) {
+	p := newTestPool(StrategyFailover)
+	if got := names(p.Order()); got != "abc" {
+		t.Errorf("order = %s, want abc", got)
+	}
+
+	// A down endpoint is tried last, and first again once it recovers
+	p.Endpoints()[0].Failed(KindIngress, errors.New("connection refused"))
+	if got := names(p.Order()); got != "bca" {
+		t.Errorf("order with a down = %s, want bca", got)
+	}
+	p.Endpoints()[0].Succeeded(KindIngress)
+	if got := names(p.Order()); got != "abc" {
+		t.Errorf("order after a recovered = %s, want abc", got)
+	}
+}
+
+func TestOrderRoundRobin(t *testing.T) {
+	p := newTestPool(StrategyRoundRobin)
+	p.Endpoints()[1].Failed(KindIngress, errors.New("503"))
+
+	var firsts string
+	for i := 0; i < 4; i++ {
+		order := p.Order()
+		if got := order[len(order)-1].Name; got != "b" {
+			t.Errorf("last = %s, want the down endpoint b", got)
+		}
+		firsts += order[0].Name
+	}
+	if firsts != "acac" {
+		t.Errorf("first endpoints = %s, want the healthy ones in turn (acac)", firsts)
+	}
+}
+
+func TestOrderLowestLatency(t *testing.T) {
+	p := newTestPool(StrategyLowestLatency)
+	a, _, c := p.Endpoints()[0], p.Endpoints()[1], p.Endpoints()[2]
+	a.probed(30 * time.Millisecond)
+	c.probed(10 * time.Millisecond)
+
+	// b hasn't been probed, so goes after those with a known latency
+	if got := names(p.Order()); got != "cab" {
+		t.Errorf("order = %s, want cab", got)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	p := New([]config.EndpointConfig{{Name: "a", URL: srv.URL}}, Options{Timeout: time.Second})
+	ep := p.Endpoints()[0]
+	ctx := context.Background()
+
+	status = http.StatusBadGateway
+	p.probeAll(ctx)
+	if s := ep.Status(); s.Up || s.LastError == "" || s.LastProbe.IsZero() {
+		t.Errorf("status after a 502 probe = %+v, want down", s)
+	}
+
+	// Any answer below 500 means the server is there
+	status = http.StatusNotFound
+	p.probeAll(ctx)
+	if s := ep.Status(); !s.Up || s.LastError != "" || s.Latency == 0 {
+		t.Errorf("status after a 404 probe = %+v, want up with a latency", s)
+	}
+}